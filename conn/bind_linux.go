@@ -194,6 +194,27 @@ func (bind *LinuxSocketBind) SetMark(value uint32) error {
 	return nil
 }
 
+func (bind *LinuxSocketBind) SetDSCP(dscp uint8) error {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+
+	if bind.sock6 != -1 {
+		err := unix.SetsockoptInt(bind.sock6, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, int(dscp)<<2)
+		if err != nil {
+			return err
+		}
+	}
+
+	if bind.sock4 != -1 {
+		err := unix.SetsockoptInt(bind.sock4, unix.IPPROTO_IP, unix.IP_TOS, int(dscp)<<2)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (bind *LinuxSocketBind) Close() error {
 	// Take a readlock to shut down the sockets...
 	bind.mu.RLock()
@@ -247,6 +268,26 @@ func (bind *LinuxSocketBind) receiveIPv6(buf []byte) (int, Endpoint, error) {
 }
 
 func (bind *LinuxSocketBind) Send(buff []byte, end Endpoint) error {
+	return bind.send(buff, end, nil)
+}
+
+// SendDSCP is like Send, but sets the traffic class of the packet with
+// an IP_TOS or IPV6_TCLASS control message.
+func (bind *LinuxSocketBind) SendDSCP(buff []byte, end Endpoint, dscp uint8) error {
+	if dscp > 63 {
+		return unix.EINVAL
+	}
+	nend, ok := end.(*LinuxSocketEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	if nend.isV6 {
+		return bind.send(buff, end, trafficClassCmsg(unix.IPPROTO_IPV6, unix.IPV6_TCLASS, dscp))
+	}
+	return bind.send(buff, end, trafficClassCmsg(unix.IPPROTO_IP, unix.IP_TOS, dscp))
+}
+
+func (bind *LinuxSocketBind) send(buff []byte, end Endpoint, extra []byte) error {
 	nend, ok := end.(*LinuxSocketEndpoint)
 	if !ok {
 		return ErrWrongEndpointType
@@ -257,12 +298,12 @@ func (bind *LinuxSocketBind) Send(buff []byte, end Endpoint) error {
 		if bind.sock4 == -1 {
 			return net.ErrClosed
 		}
-		return send4(bind.sock4, nend, buff)
+		return send4(bind.sock4, nend, buff, extra)
 	} else {
 		if bind.sock6 == -1 {
 			return net.ErrClosed
 		}
-		return send6(bind.sock6, nend, buff)
+		return send6(bind.sock6, nend, buff, extra)
 	}
 }
 
@@ -436,7 +477,7 @@ func create6(port uint16) (int, uint16, error) {
 	return fd, uint16(addr.Port), err
 }
 
-func send4(sock int, end *LinuxSocketEndpoint, buff []byte) error {
+func send4(sock int, end *LinuxSocketEndpoint, buff []byte, extra []byte) error {
 
 	// construct message header
 
@@ -456,7 +497,7 @@ func send4(sock int, end *LinuxSocketEndpoint, buff []byte) error {
 	}
 
 	end.mu.Lock()
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+	_, err := unix.SendmsgN(sock, buff, appendCmsg((*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], extra), end.dst4(), 0)
 	end.mu.Unlock()
 
 	if err == nil {
@@ -469,14 +510,14 @@ func send4(sock int, end *LinuxSocketEndpoint, buff []byte) error {
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet4Pktinfo{}
 		end.mu.Lock()
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+		_, err = unix.SendmsgN(sock, buff, appendCmsg((*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], extra), end.dst4(), 0)
 		end.mu.Unlock()
 	}
 
 	return err
 }
 
-func send6(sock int, end *LinuxSocketEndpoint, buff []byte) error {
+func send6(sock int, end *LinuxSocketEndpoint, buff []byte, extra []byte) error {
 
 	// construct message header
 
@@ -500,7 +541,7 @@ func send6(sock int, end *LinuxSocketEndpoint, buff []byte) error {
 	}
 
 	end.mu.Lock()
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+	_, err := unix.SendmsgN(sock, buff, appendCmsg((*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], extra), end.dst6(), 0)
 	end.mu.Unlock()
 
 	if err == nil {
@@ -513,13 +554,38 @@ func send6(sock int, end *LinuxSocketEndpoint, buff []byte) error {
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet6Pktinfo{}
 		end.mu.Lock()
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+		_, err = unix.SendmsgN(sock, buff, appendCmsg((*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], extra), end.dst6(), 0)
 		end.mu.Unlock()
 	}
 
 	return err
 }
 
+// appendCmsg returns oob, which holds a single control message, followed by
+// the control messages in extra. If extra is empty, oob is returned as is.
+func appendCmsg(oob, extra []byte) []byte {
+	if len(extra) == 0 {
+		return oob
+	}
+	space := unix.CmsgSpace(len(oob) - unix.SizeofCmsghdr)
+	out := make([]byte, space+len(extra))
+	copy(out, oob)
+	copy(out[space:], extra)
+	return out
+}
+
+// trafficClassCmsg returns a control message that sets the DSCP of a packet,
+// with type IP_TOS at level IPPROTO_IP or IPV6_TCLASS at level IPPROTO_IPV6.
+func trafficClassCmsg(level, typ int, dscp uint8) []byte {
+	b := make([]byte, unix.CmsgSpace(4))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(unix.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&b[unix.CmsgLen(0)])) = int32(dscp) << 2
+	return b
+}
+
 func receive4(sock int, buff []byte, end *LinuxSocketEndpoint) (int, error) {
 
 	// construct message header
@@ -7,7 +7,9 @@ package conn
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"os"
 	"sync"
 	"syscall"
 )
@@ -22,10 +24,47 @@ type StdNetBind struct {
 	ipv6       *net.UDPConn
 	blackhole4 bool
 	blackhole6 bool
+	families   Family // set at creation; 0 means both
+}
+
+// A Family is a set of IP address families.
+type Family uint8
+
+const (
+	FamilyIPv4 Family = 1 << iota
+	FamilyIPv6
+	FamilyAll = FamilyIPv4 | FamilyIPv6
+)
+
+func (f Family) String() string {
+	switch f {
+	case FamilyIPv4:
+		return "IPv4"
+	case FamilyIPv6:
+		return "IPv6"
+	case FamilyAll:
+		return "IPv4 and IPv6"
+	}
+	return fmt.Sprintf("Family(%d)", uint8(f))
 }
 
 func NewStdNetBind() Bind { return &StdNetBind{} }
 
+// NewStdNetBindFamily returns a StdNetBind that only opens sockets for the
+// address families in families, which must not be empty. Sending to an
+// endpoint of another family fails with an error wrapping
+// syscall.EAFNOSUPPORT.
+func NewStdNetBindFamily(families Family) Bind {
+	if families&FamilyAll == 0 {
+		panic("conn: no address family selected")
+	}
+	return &StdNetBind{families: families & FamilyAll}
+}
+
+func (bind *StdNetBind) listens(family Family) bool {
+	return bind.families == 0 || bind.families&family != 0
+}
+
 type StdNetEndpoint net.UDPAddr
 
 var _ Bind = (*StdNetBind)(nil)
@@ -100,21 +139,25 @@ again:
 	port := int(uport)
 	var ipv4, ipv6 *net.UDPConn
 
-	ipv4, port, err = listenNet("udp4", port)
-	if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
-		return nil, 0, err
+	if bind.listens(FamilyIPv4) {
+		ipv4, port, err = listenNet("udp4", port)
+		if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
+			return nil, 0, err
+		}
 	}
 
 	// Listen on the same port as we're using for ipv4.
-	ipv6, port, err = listenNet("udp6", port)
-	if uport == 0 && errors.Is(err, syscall.EADDRINUSE) && tries < 100 {
-		ipv4.Close()
-		tries++
-		goto again
-	}
-	if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
-		ipv4.Close()
-		return nil, 0, err
+	if bind.listens(FamilyIPv6) {
+		ipv6, port, err = listenNet("udp6", port)
+		if uport == 0 && errors.Is(err, syscall.EADDRINUSE) && tries < 100 {
+			ipv4.Close()
+			tries++
+			goto again
+		}
+		if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
+			ipv4.Close()
+			return nil, 0, err
+		}
 	}
 	var fns []ReceiveFunc
 	if ipv4 != nil {
@@ -131,6 +174,52 @@ again:
 	return fns, uint16(port), nil
 }
 
+// OpenFromFd puts the Bind into a listening state using fd, an already bound
+// UDP socket such as one inherited from a privileged parent process,
+// instead of creating a socket itself. The socket is used for IPv4 or IPv6
+// according to the address it is bound to; call OpenFromFd once per family
+// to use both. OpenFromFd takes ownership of fd, closing it even on failure.
+func (bind *StdNetBind) OpenFromFd(fd uintptr) ([]ReceiveFunc, uint16, error) {
+	file := os.NewFile(fd, "udp")
+	pc, err := net.FilePacketConn(file)
+	file.Close() // FilePacketConn duplicates the descriptor
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, 0, errors.New("file descriptor is not a UDP socket")
+	}
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	family := FamilyIPv6
+	if laddr.IP.To4() != nil {
+		family = FamilyIPv4
+	}
+	if !bind.listens(family) {
+		conn.Close()
+		return nil, 0, fmt.Errorf("%w: %v is disabled on this bind", syscall.EAFNOSUPPORT, family)
+	}
+
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	if family == FamilyIPv4 {
+		if bind.ipv4 != nil {
+			conn.Close()
+			return nil, 0, ErrBindAlreadyOpen
+		}
+		bind.ipv4 = conn
+		return []ReceiveFunc{bind.makeReceiveIPv4(conn)}, uint16(laddr.Port), nil
+	}
+	if bind.ipv6 != nil {
+		conn.Close()
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	bind.ipv6 = conn
+	return []ReceiveFunc{bind.makeReceiveIPv6(conn)}, uint16(laddr.Port), nil
+}
+
 func (bind *StdNetBind) Close() error {
 	bind.mu.Lock()
 	defer bind.mu.Unlock()
@@ -177,9 +266,11 @@ func (bind *StdNetBind) Send(buff []byte, endpoint Endpoint) error {
 	}
 
 	bind.mu.Lock()
+	family := FamilyIPv4
 	blackhole := bind.blackhole4
 	conn := bind.ipv4
 	if nend.IP.To4() == nil {
+		family = FamilyIPv6
 		blackhole = bind.blackhole6
 		conn = bind.ipv6
 	}
@@ -188,6 +279,9 @@ func (bind *StdNetBind) Send(buff []byte, endpoint Endpoint) error {
 	if blackhole {
 		return nil
 	}
+	if !bind.listens(family) {
+		return fmt.Errorf("%w: %v is disabled on this bind", syscall.EAFNOSUPPORT, family)
+	}
 	if conn == nil {
 		return syscall.EAFNOSUPPORT
 	}
@@ -0,0 +1,91 @@
+// +build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestStdNetBindOpenFromFd(t *testing.T) {
+	for _, network := range []string{"udp4", "udp6"} {
+		t.Run(network, func(t *testing.T) {
+			ip := net.IPv4(127, 0, 0, 1)
+			if network == "udp6" {
+				ip = net.IPv6loopback
+			}
+			sock, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+			if err != nil {
+				t.Skipf("%s unavailable: %v", network, err)
+			}
+			file, err := sock.File()
+			sock.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fd, err := syscall.Dup(int(file.Fd()))
+			file.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bind := NewStdNetBind().(*StdNetBind)
+			fns, port, err := bind.OpenFromFd(uintptr(fd))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer bind.Close()
+			if len(fns) != 1 || port != uint16(sock.LocalAddr().(*net.UDPAddr).Port) {
+				t.Fatalf("got %d receive funcs on port %d", len(fns), port)
+			}
+
+			ep := &StdNetEndpoint{IP: ip, Port: int(port)}
+			if network == "udp4" {
+				ep.IP = ip.To4()
+			}
+			msg := []byte("hello")
+			if err := bind.Send(msg, ep); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 16)
+			n, _, err := fns[0](buf)
+			if err != nil || !bytes.Equal(buf[:n], msg) {
+				t.Errorf("received %q, %v; want %q", buf[:n], err, msg)
+			}
+		})
+	}
+}
+
+func TestStdNetBindFamily(t *testing.T) {
+	bind := NewStdNetBindFamily(FamilyIPv4)
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Skipf("udp4 unavailable: %v", err)
+	}
+	defer bind.Close()
+	if len(fns) != 1 {
+		t.Fatalf("got %d receive funcs; want 1", len(fns))
+	}
+
+	msg := []byte("hello")
+	if err := bind.Send(msg, &StdNetEndpoint{IP: net.IPv4(127, 0, 0, 1).To4(), Port: int(port)}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, _, err := fns[0](buf); err != nil || !bytes.Equal(buf[:n], msg) {
+		t.Errorf("received %q, %v; want %q", buf[:n], err, msg)
+	}
+
+	err = bind.Send(msg, &StdNetEndpoint{IP: net.IPv6loopback, Port: int(port)})
+	if !errors.Is(err, syscall.EAFNOSUPPORT) {
+		t.Errorf("Send to IPv6 error = %v; want EAFNOSUPPORT", err)
+	}
+}
@@ -0,0 +1,344 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TCPBind is a Bind that carries packets over TCP instead of UDP, for
+// networks that block UDP altogether. Each packet is sent as a frame: its
+// length as a 16-bit big-endian integer, followed by its bytes.
+//
+// TCPBind accepts connections on the port given to Open and dials the
+// endpoints it has no connection to yet. Dialing happens in the background:
+// packets sent meanwhile are held, up to TCPDialQueueLen of them, and
+// written once the connection is up. Packets to and from an address share
+// a single connection, whichever side opened it. A connection accepted from
+// a peer is identified by the peer's source address, usually an ephemeral
+// port, which the device then learns as the peer's endpoint by roaming.
+// Should such a connection break, only the peer can reestablish it, so
+// both sides should have each other's endpoint configured.
+//
+// TCP's retransmissions and head-of-line blocking make for a worse tunnel
+// than UDP does, so TCPBind is meant only as a fallback.
+// It does not support SO_MARK; SetMark is a no-op.
+type TCPBind struct {
+	mu       sync.Mutex
+	listener *net.TCPListener    // nil if the bind is not open
+	conns    map[string]*tcpConn // by remote address
+	dialing  map[string][][]byte // frames awaiting a connection being dialed, by remote address
+	accepted int                 // connections in conns that were accepted
+	received chan tcpPacket
+	closed   chan struct{} // closed by Close
+}
+
+const (
+	TCPDialTimeout  = 5 * time.Second // how long dialing an endpoint may take
+	TCPDialQueueLen = 16              // packets held while dialing an endpoint; older ones are dropped
+	TCPWriteTimeout = time.Second     // how long writing a packet may block before the connection is dropped
+	TCPMaxAccepted  = 256             // connections accepted at a time; further ones are refused
+	TCPMaxFrameSize = 1 << 14         // largest packet carried; a connection sending a larger one is dropped
+)
+
+type tcpConn struct {
+	*net.TCPConn
+	from     *TCPEndpoint
+	accepted bool       // whether the connection was accepted rather than dialed
+	writeMu  sync.Mutex // serializes frames
+}
+
+type tcpPacket struct {
+	data []byte
+	from *TCPEndpoint
+}
+
+type TCPEndpoint net.TCPAddr
+
+var _ Bind = (*TCPBind)(nil)
+var _ Endpoint = (*TCPEndpoint)(nil)
+
+func NewTCPBind() Bind { return &TCPBind{} }
+
+func (*TCPBind) ParseEndpoint(s string) (Endpoint, error) {
+	addr, err := parseEndpoint(s)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPEndpoint{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}, nil
+}
+
+func (*TCPEndpoint) ClearSrc() {}
+
+func (e *TCPEndpoint) DstIP() net.IP {
+	return e.IP
+}
+
+func (e *TCPEndpoint) SrcIP() net.IP {
+	return nil // not supported
+}
+
+func (e *TCPEndpoint) DstToBytes() []byte {
+	out := e.IP.To4()
+	if out == nil {
+		out = e.IP
+	}
+	out = append(out, byte(e.Port&0xff))
+	out = append(out, byte((e.Port>>8)&0xff))
+	return out
+}
+
+func (e *TCPEndpoint) DstToString() string {
+	return (*net.TCPAddr)(e).String()
+}
+
+func (e *TCPEndpoint) SrcToString() string {
+	return ""
+}
+
+func (bind *TCPBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	if bind.listener != nil {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: int(port)})
+	if err != nil {
+		return nil, 0, err
+	}
+	bind.listener = listener
+	bind.conns = make(map[string]*tcpConn)
+	bind.dialing = make(map[string][][]byte)
+	bind.accepted = 0
+	bind.received = make(chan tcpPacket, 1024)
+	bind.closed = make(chan struct{})
+	go bind.accept(listener)
+	return []ReceiveFunc{bind.makeReceive(bind.received, bind.closed)}, uint16(listener.Addr().(*net.TCPAddr).Port), nil
+}
+
+func (bind *TCPBind) Close() error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	if bind.listener == nil {
+		return nil
+	}
+	err := bind.listener.Close()
+	close(bind.closed)
+	for _, c := range bind.conns {
+		c.Close()
+	}
+	bind.listener = nil
+	bind.conns = nil
+	bind.dialing = nil
+	return err
+}
+
+func (*TCPBind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (bind *TCPBind) accept(listener *net.TCPListener) {
+	for {
+		c, err := listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		bind.mu.Lock()
+		if bind.listener != listener {
+			bind.mu.Unlock()
+			c.Close()
+			return
+		}
+		if bind.accepted >= TCPMaxAccepted {
+			bind.mu.Unlock()
+			c.Close()
+			continue
+		}
+		conn := newTCPConn(c)
+		conn.accepted = true
+		bind.add(conn)
+		bind.mu.Unlock()
+	}
+}
+
+func newTCPConn(c *net.TCPConn) *tcpConn {
+	addr := *c.RemoteAddr().(*net.TCPAddr)
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		addr.IP = ip4
+	}
+	c.SetNoDelay(true)
+	return &tcpConn{TCPConn: c, from: (*TCPEndpoint)(&addr)}
+}
+
+// add registers c and starts reading from it, replacing any connection
+// to the same address. bind.mu must be held and the bind open.
+func (bind *TCPBind) add(c *tcpConn) {
+	key := c.from.DstToString()
+	if old := bind.conns[key]; old != nil {
+		old.Close()
+		bind.forgetLocked(key, old)
+	}
+	bind.conns[key] = c
+	if c.accepted {
+		bind.accepted++
+	}
+	go bind.read(c, bind.received, bind.closed)
+}
+
+// drop closes c and forgets it, unless it has been replaced already.
+func (bind *TCPBind) drop(c *tcpConn) {
+	c.Close()
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	if key := c.from.DstToString(); bind.conns[key] == c {
+		bind.forgetLocked(key, c)
+	}
+}
+
+// forgetLocked removes c, registered under key, from bind.conns.
+// bind.mu must be held.
+func (bind *TCPBind) forgetLocked(key string, c *tcpConn) {
+	delete(bind.conns, key)
+	if c.accepted {
+		bind.accepted--
+	}
+}
+
+func (bind *TCPBind) read(c *tcpConn, received chan<- tcpPacket, closed <-chan struct{}) {
+	defer bind.drop(c)
+	var header [2]byte
+	buf := make([]byte, TCPMaxFrameSize)
+	for {
+		if _, err := io.ReadFull(c, header[:]); err != nil {
+			return
+		}
+		size := int(binary.BigEndian.Uint16(header[:]))
+		if size > TCPMaxFrameSize {
+			return
+		}
+		// buf is reused for the next frame, so pass on a copy of this one.
+		if _, err := io.ReadFull(c, buf[:size]); err != nil {
+			return
+		}
+		data := append([]byte(nil), buf[:size]...)
+		select {
+		case received <- tcpPacket{data, c.from}:
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (*TCPBind) makeReceive(received <-chan tcpPacket, closed <-chan struct{}) ReceiveFunc {
+	return func(buff []byte) (int, Endpoint, error) {
+		select {
+		case p := <-received:
+			return copy(buff, p.data), p.from, nil
+		case <-closed:
+			return 0, nil, net.ErrClosed
+		}
+	}
+}
+
+// connTo returns the connection to endpoint. If there is none, it starts
+// dialing one, unless that is already underway, holds frame to be written
+// once the connection is up and returns a nil connection.
+func (bind *TCPBind) connTo(endpoint *TCPEndpoint, frame []byte) (*tcpConn, error) {
+	key := endpoint.DstToString()
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	if bind.listener == nil {
+		return nil, net.ErrClosed
+	}
+	if c := bind.conns[key]; c != nil {
+		return c, nil
+	}
+	pending, dialing := bind.dialing[key]
+	if len(pending) == TCPDialQueueLen {
+		pending = append(pending[:0], pending[1:]...)
+	}
+	bind.dialing[key] = append(pending, frame)
+	if !dialing {
+		go bind.dial(key, bind.closed)
+	}
+	return nil, nil
+}
+
+// dial connects to key and writes the frames held for it meanwhile.
+// closed is the channel of the bind as it was opened, to tell whether it
+// has been closed since.
+func (bind *TCPBind) dial(key string, closed chan struct{}) {
+	dialed, err := net.DialTimeout("tcp", key, TCPDialTimeout)
+
+	bind.mu.Lock()
+	if bind.listener == nil || bind.closed != closed {
+		bind.mu.Unlock()
+		if err == nil {
+			dialed.Close()
+		}
+		return
+	}
+	pending := bind.dialing[key]
+	delete(bind.dialing, key)
+	if err != nil {
+		bind.mu.Unlock()
+		return
+	}
+	c := newTCPConn(dialed.(*net.TCPConn))
+	if existing := bind.conns[key]; existing != nil {
+		// The peer got there first.
+		c.Close()
+		c = existing
+	} else {
+		bind.add(c)
+	}
+	bind.mu.Unlock()
+
+	for _, frame := range pending {
+		if bind.write(c, frame) != nil {
+			return
+		}
+	}
+}
+
+// write writes frame to c, dropping c if that fails or takes longer than
+// TCPWriteTimeout.
+func (bind *TCPBind) write(c *tcpConn, frame []byte) error {
+	c.writeMu.Lock()
+	c.SetWriteDeadline(time.Now().Add(TCPWriteTimeout))
+	_, err := c.Write(frame)
+	c.writeMu.Unlock()
+	if err != nil {
+		bind.drop(c)
+	}
+	return err
+}
+
+func (bind *TCPBind) Send(buff []byte, endpoint Endpoint) error {
+	nend, ok := endpoint.(*TCPEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	if len(buff) > TCPMaxFrameSize {
+		return syscall.EMSGSIZE
+	}
+	frame := make([]byte, 2+len(buff))
+	binary.BigEndian.PutUint16(frame, uint16(len(buff)))
+	copy(frame[2:], buff)
+
+	c, err := bind.connTo(nend, frame)
+	if c == nil {
+		return err
+	}
+	return bind.write(c, frame)
+}
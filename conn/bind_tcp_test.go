@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTCPBind(t *testing.T) {
+	a, b := NewTCPBind(), NewTCPBind()
+	fnsA, _, err := a.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	fnsB, portB, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	ep, err := a.ParseEndpoint(fmt.Sprintf("127.0.0.1:%d", portB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	for _, size := range []int{1, 1420, 0} {
+		packet := make([]byte, size)
+		for i := range packet {
+			packet[i] = byte(i)
+		}
+		if err := a.Send(packet, ep); err != nil {
+			t.Fatal(err)
+		}
+		n, from, err := fnsB[0](buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != size {
+			t.Fatalf("received %d bytes; want %d", n, size)
+		}
+		if from.DstIP().String() != "127.0.0.1" {
+			t.Errorf("received from %v; want 127.0.0.1", from.DstToString())
+		}
+
+		// The reply travels back over the same connection.
+		if err := b.Send(buf[:n], from); err != nil {
+			t.Fatal(err)
+		}
+		if n, _, err := fnsA[0](buf); err != nil || n != size {
+			t.Fatalf("reply: received %d bytes, %v; want %d", n, err, size)
+		}
+	}
+	if n := len(b.(*TCPBind).conns); n != 1 {
+		t.Errorf("%d connections after exchanging packets; want 1", n)
+	}
+
+	b.Close()
+	if _, _, err := fnsB[0](buf); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receive after Close = %v; want net.ErrClosed", err)
+	}
+	if err := b.Send([]byte{1}, ep); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Send after Close = %v; want net.ErrClosed", err)
+	}
+}
+
+func TestTCPBindLimits(t *testing.T) {
+	bind := NewTCPBind()
+	_, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	// Sending to an endpoint that is not reachable yet must not wait for
+	// the connection.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := bind.ParseEndpoint(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	start := time.Now()
+	if err := bind.Send([]byte{1}, ep); err != nil {
+		t.Errorf("Send while dialing = %v; want nil", err)
+	}
+	if d := time.Since(start); d > TCPDialTimeout/2 {
+		t.Errorf("Send blocked for %v", d)
+	}
+	if err := bind.Send(make([]byte, TCPMaxFrameSize+1), ep); !errors.Is(err, syscall.EMSGSIZE) {
+		t.Errorf("Send of an oversized packet = %v; want EMSGSIZE", err)
+	}
+
+	// A peer announcing an oversized frame is disconnected.
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte{0xff, 0xff}); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from connection with oversized frame = %v; want EOF", err)
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"sync"
+	"syscall"
 
 	"golang.zx2c4.com/wireguard/conn"
 )
@@ -21,6 +23,32 @@ type ChannelBind struct {
 	closeSignal      chan bool
 	source4, source6 ChannelEndpoint
 	target4, target6 ChannelEndpoint
+	families         conn.Family // set at creation
+
+	mu         sync.Mutex // protects following fields
+	impairment Impairment
+	rand       *rand.Rand
+	pending    []pendingPacket
+}
+
+// An Impairment describes the adverse network conditions a ChannelBind
+// simulates for the packets it sends. The zero value delivers every packet,
+// in order, which is the default.
+type Impairment struct {
+	// Loss is the probability, from 0 to 1, that a packet is dropped.
+	Loss float64
+
+	// Reorder, if positive, holds up to Reorder packets back and
+	// releases a randomly chosen one each time another is sent.
+	Reorder int
+
+	// Seed seeds the random choices, so that runs can be reproduced.
+	Seed int64
+}
+
+type pendingPacket struct {
+	packet []byte
+	tx     chan []byte
 }
 
 type ChannelEndpoint uint16
@@ -29,6 +57,25 @@ var _ conn.Bind = (*ChannelBind)(nil)
 var _ conn.Endpoint = (*ChannelEndpoint)(nil)
 
 func NewChannelBinds() [2]conn.Bind {
+	return NewChannelBindsWithFamilies(true, true)
+}
+
+// NewChannelBindsWithFamilies is like NewChannelBinds, but the binds only
+// carry the address families for which v4 and v6 are true, to simulate
+// single-stack networks. At least one must be. Like a real bind, they fail
+// to send to an endpoint of a disabled family, with an error wrapping
+// syscall.EAFNOSUPPORT.
+func NewChannelBindsWithFamilies(v4, v6 bool) [2]conn.Bind {
+	var families conn.Family
+	if v4 {
+		families |= conn.FamilyIPv4
+	}
+	if v6 {
+		families |= conn.FamilyIPv6
+	}
+	if families == 0 {
+		panic("bindtest: no address family selected")
+	}
 	arx4 := make(chan []byte, 8192)
 	brx4 := make(chan []byte, 8192)
 	arx6 := make(chan []byte, 8192)
@@ -50,6 +97,8 @@ func NewChannelBinds() [2]conn.Bind {
 	binds[0].source6 = binds[1].target6
 	binds[1].source4 = binds[0].target4
 	binds[1].source6 = binds[0].target6
+	binds[0].families = families
+	binds[1].families = families
 	return [2]conn.Bind{&binds[0], &binds[1]}
 }
 
@@ -67,9 +116,13 @@ func (c ChannelEndpoint) SrcIP() net.IP { return nil }
 
 func (c *ChannelBind) Open(port uint16) (fns []conn.ReceiveFunc, actualPort uint16, err error) {
 	c.closeSignal = make(chan bool)
-	fns = append(fns, c.makeReceiveFunc(*c.rx4))
-	fns = append(fns, c.makeReceiveFunc(*c.rx6))
-	if rand.Uint32()&1 == 0 {
+	if c.families&conn.FamilyIPv4 != 0 {
+		fns = append(fns, c.makeReceiveFunc(*c.rx4, c.target4))
+	}
+	if c.families&conn.FamilyIPv6 != 0 {
+		fns = append(fns, c.makeReceiveFunc(*c.rx6, c.target6))
+	}
+	if c.families == conn.FamilyIPv4 || (c.families == conn.FamilyAll && rand.Uint32()&1 == 0) {
 		return fns, uint16(c.source4), nil
 	} else {
 		return fns, uint16(c.source6), nil
@@ -89,13 +142,47 @@ func (c *ChannelBind) Close() error {
 
 func (c *ChannelBind) SetMark(mark uint32) error { return nil }
 
-func (c *ChannelBind) makeReceiveFunc(ch chan []byte) conn.ReceiveFunc {
+// SetImpairment makes c apply imp to the packets it subsequently sends.
+// Packets held back by a previous Impairment are delivered first, in order.
+func (c *ChannelBind) SetImpairment(imp Impairment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.pending {
+		p.tx <- p.packet
+	}
+	c.pending = nil
+	c.impairment = imp
+	c.rand = rand.New(rand.NewSource(imp.Seed))
+}
+
+// transmit sends packet on tx, subject to c's impairment.
+func (c *ChannelBind) transmit(packet []byte, tx chan []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	imp := c.impairment
+	if imp.Loss > 0 && c.rand.Float64() < imp.Loss {
+		return
+	}
+	if imp.Reorder <= 0 {
+		tx <- packet
+		return
+	}
+	c.pending = append(c.pending, pendingPacket{packet, tx})
+	if len(c.pending) > imp.Reorder {
+		i := c.rand.Intn(len(c.pending))
+		p := c.pending[i]
+		c.pending = append(c.pending[:i], c.pending[i+1:]...)
+		p.tx <- p.packet
+	}
+}
+
+func (c *ChannelBind) makeReceiveFunc(ch chan []byte, from ChannelEndpoint) conn.ReceiveFunc {
 	return func(b []byte) (n int, ep conn.Endpoint, err error) {
 		select {
 		case <-c.closeSignal:
 			return 0, nil, net.ErrClosed
 		case rx := <-ch:
-			return copy(b, rx), c.target6, nil
+			return copy(b, rx), from, nil
 		}
 	}
 }
@@ -107,13 +194,20 @@ func (c *ChannelBind) Send(b []byte, ep conn.Endpoint) error {
 	default:
 		bc := make([]byte, len(b))
 		copy(bc, b)
-		if ep.(ChannelEndpoint) == c.target4 {
-			*c.tx4 <- bc
-		} else if ep.(ChannelEndpoint) == c.target6 {
-			*c.tx6 <- bc
-		} else {
+		var family conn.Family
+		var tx chan []byte
+		switch ep.(ChannelEndpoint) {
+		case c.target4:
+			family, tx = conn.FamilyIPv4, *c.tx4
+		case c.target6:
+			family, tx = conn.FamilyIPv6, *c.tx6
+		default:
 			return os.ErrInvalid
 		}
+		if c.families&family == 0 {
+			return fmt.Errorf("%w: %v is disabled on this bind", syscall.EAFNOSUPPORT, family)
+		}
+		c.transmit(bc, tx)
 	}
 	return nil
 }
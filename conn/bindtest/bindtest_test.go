@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2019-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package bindtest
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestImpairment(t *testing.T) {
+	binds := NewChannelBinds()
+	a, b := binds[0].(*ChannelBind), binds[1].(*ChannelBind)
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	recv := func() []byte {
+		buf := make([]byte, 8)
+		n, _, err := fns[0](buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+	const count = 100
+
+	a.SetImpairment(Impairment{Loss: 1})
+	for i := 0; i < count; i++ {
+		if err := a.Send([]byte{byte(i)}, a.target4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(*b.rx4); n != 0 {
+		t.Errorf("%d packets delivered with total loss", n)
+	}
+
+	a.SetImpairment(Impairment{Reorder: 8, Seed: 1})
+	for i := 0; i < count; i++ {
+		if err := a.Send([]byte{byte(i)}, a.target4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.SetImpairment(Impairment{})
+	seen := make(map[byte]bool)
+	reordered := false
+	for i := 0; i < count; i++ {
+		p := recv()
+		seen[p[0]] = true
+		reordered = reordered || p[0] != byte(i)
+	}
+	if len(seen) != count {
+		t.Errorf("received %d distinct packets; want %d", len(seen), count)
+	}
+	if !reordered {
+		t.Errorf("packets were not reordered")
+	}
+
+	if err := a.Send([]byte{42}, a.target4); err != nil {
+		t.Fatal(err)
+	}
+	if p := recv(); p[0] != 42 {
+		t.Errorf("unimpaired bind delivered %v; want [42]", p)
+	}
+}
+
+func TestChannelBindsWithFamilies(t *testing.T) {
+	binds := NewChannelBindsWithFamilies(false, true)
+	a, b := binds[0].(*ChannelBind), binds[1].(*ChannelBind)
+	fns, port, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if len(fns) != 1 || port != uint16(b.source6) {
+		t.Errorf("Open = %d receive funcs on port %d; want 1 on port %d", len(fns), port, b.source6)
+	}
+
+	if err := a.Send([]byte{4}, a.target4); !errors.Is(err, syscall.EAFNOSUPPORT) {
+		t.Errorf("Send to IPv4 endpoint = %v; want EAFNOSUPPORT", err)
+	}
+	if err := a.Send([]byte{6}, a.target6); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	n, ep, err := fns[0](buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || buf[0] != 6 || ep != b.target6 {
+		t.Errorf("received %v from %v; want [6] from %v", buf[:n], ep, b.target6)
+	}
+}
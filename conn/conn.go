@@ -7,6 +7,7 @@
 package conn
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -20,9 +21,49 @@ import (
 // ep is the remote endpoint.
 type ReceiveFunc func(b []byte) (n int, ep Endpoint, err error)
 
+// CloseSafeReceiveFunc wraps fn, a ReceiveFunc of a Bind, so that it
+// follows the Bind contract around Close, given a channel that the Bind
+// closes when it is closed:
+//
+//   - once closed is closed, the returned function reports net.ErrClosed
+//     instead of calling fn or passing on fn's error;
+//   - a panic in fn after closed is closed, such as a send on a channel
+//     torn down by Close, is turned into net.ErrClosed.
+//
+// fn must still return promptly once the Bind is closed;
+// the wrapper cannot interrupt a blocked call.
+func CloseSafeReceiveFunc(fn ReceiveFunc, closed <-chan struct{}) ReceiveFunc {
+	isClosed := func() bool {
+		select {
+		case <-closed:
+			return true
+		default:
+			return false
+		}
+	}
+	return func(b []byte) (n int, ep Endpoint, err error) {
+		if isClosed() {
+			return 0, nil, net.ErrClosed
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				if !isClosed() {
+					panic(r)
+				}
+				n, ep, err = 0, nil, net.ErrClosed
+			}
+		}()
+		n, ep, err = fn(b)
+		if err != nil && isClosed() {
+			return 0, nil, net.ErrClosed
+		}
+		return n, ep, err
+	}
+}
+
 // A Bind listens on a port for both IPv6 and IPv4 UDP traffic.
 //
-// A Bind interface may also be a PeekLookAtSocketFd or BindSocketToInterface,
+// A Bind interface may also be a PeekLookAtSocketFd, BindSocketToInterface or BindSetDSCP,
 // depending on the platform-specific implementation.
 type Bind interface {
 	// Open puts the Bind into a listening state on a given port and reports the actual
@@ -52,6 +93,42 @@ type BindSocketToInterface interface {
 	BindSocketToInterface6(interfaceIndex uint32, blackhole bool) error
 }
 
+// BindSetDSCP is implemented by Bind objects that support setting the
+// Differentiated Services Code Point of the packets they send.
+type BindSetDSCP interface {
+	// SetDSCP sets the 6-bit DSCP value of outgoing packets, via IP_TOS
+	// for IPv4 and IPV6_TCLASS for IPv6.
+	SetDSCP(dscp uint8) error
+}
+
+// BindSendDSCP is implemented by Bind objects that can mark individual
+// packets with a DSCP value, overriding the one set with BindSetDSCP.
+type BindSendDSCP interface {
+	// SendDSCP is like Send, but marks the packet with the 6-bit dscp.
+	SendDSCP(b []byte, ep Endpoint, dscp uint8) error
+}
+
+// BindOpenContext is implemented by Bind objects whose Open can be
+// cancelled. OpenContext is like Open, but gives up and returns an error
+// once ctx is done.
+type BindOpenContext interface {
+	OpenContext(ctx context.Context, port uint16) (fns []ReceiveFunc, actualPort uint16, err error)
+}
+
+// OpenContext opens bind with its OpenContext method if it implements
+// BindOpenContext, so that opening gives up once ctx is done. Other binds
+// cannot be interrupted, and are opened with Open regardless of ctx,
+// unless ctx is done already.
+func OpenContext(ctx context.Context, bind Bind, port uint16) (fns []ReceiveFunc, actualPort uint16, err error) {
+	if bind, ok := bind.(BindOpenContext); ok {
+		return bind.OpenContext(ctx, port)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, 0, fmt.Errorf("opening bind: %w", err)
+	}
+	return bind.Open(port)
+}
+
 // PeekLookAtSocketFd is implemented by Bind objects that support having their
 // file descriptor peeked at. Used by wireguard-android.
 type PeekLookAtSocketFd interface {
@@ -72,6 +149,28 @@ type Endpoint interface {
 	SrcIP() net.IP
 }
 
+// An EndpointWithMetadata is an Endpoint that carries opaque data for the
+// Bind that created it, such as how to reach the peer through a relay.
+//
+// The device never inspects or rewrites endpoints: it keeps them as returned
+// by ParseEndpoint or a ReceiveFunc and hands them back to Send unchanged,
+// so the data survives roaming and reconfiguration. The only call that may
+// alter an endpoint is ClearSrc, which endpoints that manage their own
+// addressing may implement as a no-op.
+type EndpointWithMetadata interface {
+	Endpoint
+	Metadata() interface{}
+}
+
+// EndpointMetadata returns the metadata of ep,
+// or nil if ep does not implement EndpointWithMetadata.
+func EndpointMetadata(ep Endpoint) interface{} {
+	if ep, ok := ep.(EndpointWithMetadata); ok {
+		return ep.Metadata()
+	}
+	return nil
+}
+
 var (
 	ErrBindAlreadyOpen   = errors.New("bind is already open")
 	ErrWrongEndpointType = errors.New("endpoint type does not correspond with bind type")
@@ -149,3 +248,45 @@ func parseEndpoint(s string) (*net.UDPAddr, error) {
 	}
 	return addr, err
 }
+
+// ValidateEndpoint reports an error if s, in host:port form, names a
+// literal IP address that cannot be a WireGuard peer: a multicast address,
+// the IPv4 limited broadcast address, or an unspecified address.
+// Hostnames are not resolved and are always accepted.
+// Binds do not call it; callers may use it to reject bad configuration early.
+func ValidateEndpoint(s string) error {
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	if i := strings.LastIndexByte(host, '%'); i > 0 && strings.IndexByte(host, ':') >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return nil
+	case ip.IsMulticast():
+		return fmt.Errorf("endpoint %v is a multicast address", ip)
+	case ip.Equal(net.IPv4bcast):
+		return fmt.Errorf("endpoint %v is a broadcast address", ip)
+	case ip.IsUnspecified():
+		return fmt.Errorf("endpoint %v is an unspecified address", ip)
+	}
+	return nil
+}
+
+// IsPrivateEndpoint reports whether the destination of ep is on a private
+// network rather than the public internet: an RFC 1918 IPv4 address, an
+// IPv6 unique local address (fc00::/7), or an IPv4 or IPv6 link-local
+// address. It does not allocate beyond what ep.DstIP does.
+func IsPrivateEndpoint(ep Endpoint) bool {
+	ip := ep.DstIP()
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 ||
+			ip4[0] == 172 && ip4[1]&0xf0 == 16 ||
+			ip4[0] == 192 && ip4[1] == 168 ||
+			ip4[0] == 169 && ip4[1] == 254
+	}
+	return len(ip) == net.IPv6len && (ip[0]&0xfe == 0xfc || ip[0] == 0xfe && ip[1]&0xc0 == 0x80)
+}
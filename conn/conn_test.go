@@ -0,0 +1,218 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestValidateEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		ok       bool
+	}{
+		{"192.0.2.1:51820", true},
+		{"[2001:db8::1]:51820", true},
+		{"[fe80::1%eth0]:51820", true},
+		{"vpn.example.com:51820", true},
+		{"224.0.0.1:51820", false},
+		{"239.255.255.250:51820", false},
+		{"[ff02::1]:51820", false},
+		{"[ff02::1%eth0]:51820", false},
+		{"255.255.255.255:51820", false},
+		{"0.0.0.0:51820", false},
+		{"[::]:51820", false},
+		{"192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		err := ValidateEndpoint(tt.endpoint)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("ValidateEndpoint(%q) = %v; want ok=%v", tt.endpoint, err, tt.ok)
+		}
+	}
+}
+
+func TestIsPrivateEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		private  bool
+	}{
+		{"10.1.2.3:51820", true},
+		{"172.16.0.1:51820", true},
+		{"172.31.255.255:51820", true},
+		{"172.32.0.1:51820", false},
+		{"192.168.1.1:51820", true},
+		{"169.254.1.1:51820", true},
+		{"192.0.2.1:51820", false},
+		{"127.0.0.1:51820", false},
+		{"[fd00::1]:51820", true},
+		{"[fe80::1%1]:51820", true},
+		{"[2001:db8::1]:51820", false},
+		{"[::ffff:10.0.0.1]:51820", true},
+	}
+	bind := NewStdNetBind()
+	for _, tt := range tests {
+		ep, err := bind.ParseEndpoint(tt.endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := IsPrivateEndpoint(ep); got != tt.private {
+			t.Errorf("IsPrivateEndpoint(%s) = %v; want %v", tt.endpoint, got, tt.private)
+		}
+	}
+}
+
+func TestCloseSafeReceiveFunc(t *testing.T) {
+	closed := make(chan struct{})
+	errRead := errors.New("read failed")
+	var fail, explode bool
+	fn := CloseSafeReceiveFunc(func(b []byte) (int, Endpoint, error) {
+		if explode {
+			panic("send on closed channel")
+		}
+		if fail {
+			return 0, nil, errRead
+		}
+		return copy(b, "pkt"), nil, nil
+	}, closed)
+
+	buf := make([]byte, 8)
+	if n, _, err := fn(buf); n != 3 || err != nil {
+		t.Errorf("open receive = %d, %v; want 3, nil", n, err)
+	}
+	fail = true
+	if _, _, err := fn(buf); err != errRead {
+		t.Errorf("open receive error = %v; want %v", err, errRead)
+	}
+
+	explode = true
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("panic in open receive was swallowed")
+			}
+		}()
+		fn(buf)
+	}()
+
+	// The bind is closed while the call is underway, and the call panics.
+	racing := CloseSafeReceiveFunc(func(b []byte) (int, Endpoint, error) {
+		close(closed)
+		panic("send on closed channel")
+	}, closed)
+	if _, _, err := racing(buf); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receive panicking after close = %v; want net.ErrClosed", err)
+	}
+	if _, _, err := fn(buf); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receive after close = %v; want net.ErrClosed", err)
+	}
+}
+
+func TestStdNetEndpointStringRoundTrip(t *testing.T) {
+	bind := NewStdNetBind()
+	var endpoints []*StdNetEndpoint
+	for _, s := range []string{
+		"192.0.2.1:51820",
+		"0.0.0.0:0",
+		"[2001:db8::1]:65535",
+		"[::ffff:192.0.2.1]:1",
+		"[fe80::1%eth0]:51820",
+		"[fe80::1%7]:51820",
+	} {
+		ep, err := bind.ParseEndpoint(s)
+		if err != nil {
+			t.Fatalf("ParseEndpoint(%q): %v", s, err)
+		}
+		endpoints = append(endpoints, ep.(*StdNetEndpoint))
+	}
+	// Endpoints built from received packets rather than parsed strings.
+	endpoints = append(endpoints,
+		&StdNetEndpoint{IP: net.IPv4(192, 0, 2, 1), Port: 1234},
+		&StdNetEndpoint{IP: net.ParseIP("fe80::2"), Port: 1234, Zone: "wg0"},
+	)
+
+	for _, ep := range endpoints {
+		s := ep.DstToString()
+		parsed, err := bind.ParseEndpoint(s)
+		if err != nil {
+			t.Errorf("ParseEndpoint(%q): %v", s, err)
+			continue
+		}
+		got := parsed.(*StdNetEndpoint)
+		if !got.IP.Equal(ep.IP) || got.Port != ep.Port || got.Zone != ep.Zone {
+			t.Errorf("ParseEndpoint(%q) = %#v; want %#v", s, got, ep)
+		}
+		if !bytes.Equal(got.DstToBytes(), ep.DstToBytes()) {
+			t.Errorf("%q: DstToBytes = %x; want %x", s, got.DstToBytes(), ep.DstToBytes())
+		}
+		if got.DstToString() != s {
+			t.Errorf("DstToString after round trip = %q; want %q", got.DstToString(), s)
+		}
+	}
+}
+
+type metadataEndpoint struct {
+	StdNetEndpoint
+	meta string
+}
+
+func (e *metadataEndpoint) Metadata() interface{} { return e.meta }
+
+func TestEndpointMetadata(t *testing.T) {
+	if m := EndpointMetadata(&StdNetEndpoint{}); m != nil {
+		t.Errorf("metadata of plain endpoint = %v; want nil", m)
+	}
+	if m := EndpointMetadata(&metadataEndpoint{meta: "relay-1"}); m != "relay-1" {
+		t.Errorf("metadata = %v; want relay-1", m)
+	}
+}
+
+// stuckBind is a Bind whose Open blocks until release is closed, or until
+// ctx is done when opened with OpenContext.
+type stuckBind struct {
+	Bind
+	release chan struct{}
+}
+
+func (b *stuckBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	<-b.release
+	return nil, port, nil
+}
+
+func (b *stuckBind) OpenContext(ctx context.Context, port uint16) ([]ReceiveFunc, uint16, error) {
+	select {
+	case <-b.release:
+		return nil, port, nil
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+func TestOpenContext(t *testing.T) {
+	bind := &stuckBind{release: make(chan struct{})}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err := OpenContext(ctx, bind, 51820)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("OpenContext error = %v; want deadline exceeded", err)
+	}
+
+	// Binds that cannot be interrupted are only refused once ctx is done.
+	close(bind.release)
+	plain := struct{ Bind }{bind}
+	if _, _, err := OpenContext(ctx, plain, 51820); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("OpenContext with done ctx = %v; want deadline exceeded", err)
+	}
+	_, port, err := OpenContext(context.Background(), plain, 51820)
+	if err != nil || port != 51820 {
+		t.Errorf("OpenContext = %d, %v; want 51820, nil", port, err)
+	}
+}
@@ -0,0 +1,12 @@
+// +build !linux,!darwin,!freebsd,!openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+func (bind *StdNetBind) SetDSCP(dscp uint8) error {
+	return nil
+}
@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestLinuxSocketBindSetDSCP(t *testing.T) {
+	bind := NewLinuxSocketBind().(*LinuxSocketBind)
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	const dscp = 46 // expedited forwarding
+	if err := bind.SetDSCP(dscp); err != nil {
+		t.Fatal(err)
+	}
+	if bind.sock4 != -1 {
+		tos, err := unix.GetsockoptInt(bind.sock4, unix.IPPROTO_IP, unix.IP_TOS)
+		if err != nil || tos != dscp<<2 {
+			t.Errorf("IP_TOS = %d, %v; want %d", tos, err, dscp<<2)
+		}
+	}
+	if bind.sock6 != -1 {
+		tclass, err := unix.GetsockoptInt(bind.sock6, unix.IPPROTO_IPV6, unix.IPV6_TCLASS)
+		if err != nil || tclass != dscp<<2 {
+			t.Errorf("IPV6_TCLASS = %d, %v; want %d", tclass, err, dscp<<2)
+		}
+	}
+}
+
+func TestLinuxSocketBindSendDSCP(t *testing.T) {
+	bind := NewLinuxSocketBind().(*LinuxSocketBind)
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	if bind.sock4 == -1 {
+		t.Skip("no IPv4 socket")
+	}
+
+	dst, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	raw, err := dst.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	end, err := bind.ParseEndpoint(dst.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const dscp = 46 // expedited forwarding
+	if err := bind.SendDSCP([]byte("marked"), end, dscp); err != nil {
+		t.Fatal(err)
+	}
+	buf, oob := make([]byte, 16), make([]byte, 64)
+	_, oobn, _, _, err := dst.ReadMsgUDP(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tos := -1
+	for _, m := range msgs {
+		if m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TOS && len(m.Data) > 0 {
+			tos = int(m.Data[0])
+		}
+	}
+	if tos != dscp<<2 {
+		t.Errorf("received TOS %d; want %d", tos, dscp<<2)
+	}
+}
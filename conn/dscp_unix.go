@@ -0,0 +1,43 @@
+// +build linux darwin freebsd openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func (bind *StdNetBind) SetDSCP(dscp uint8) error {
+	bind.mu.Lock()
+	ipv4, ipv6 := bind.ipv4, bind.ipv6
+	bind.mu.Unlock()
+
+	if err := setDSCP(ipv4, unix.IPPROTO_IP, unix.IP_TOS, dscp); err != nil {
+		return err
+	}
+	return setDSCP(ipv6, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, dscp)
+}
+
+func setDSCP(conn *net.UDPConn, level, opt int, dscp uint8) error {
+	if conn == nil {
+		return nil
+	}
+	fd, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var operr error
+	err = fd.Control(func(fd uintptr) {
+		operr = unix.SetsockoptInt(int(fd), level, opt, int(dscp)<<2)
+	})
+	if err == nil {
+		err = operr
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Resolver looks up the IP addresses of a host.
+// *net.Resolver implements Resolver.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+const (
+	DefaultResolverTTL        = 5 * time.Minute
+	DefaultResolverMinBackoff = time.Second
+	DefaultResolverMaxBackoff = 5 * time.Minute
+)
+
+// CachingResolver is a Resolver that caches successful lookups for TTL and,
+// after a failed lookup, refuses to query the same host again until an
+// exponentially growing backoff has elapsed. This keeps periodic endpoint
+// re-resolution from flooding DNS while a hostname is unresolvable.
+// The zero value is ready to use with the defaults.
+type CachingResolver struct {
+	Resolver   Resolver      // underlying resolver; nil means net.DefaultResolver
+	TTL        time.Duration // how long results are cached; 0 means DefaultResolverTTL
+	MinBackoff time.Duration // delay after the first failure; 0 means DefaultResolverMinBackoff
+	MaxBackoff time.Duration // limit on the delay; 0 means DefaultResolverMaxBackoff
+
+	mu      sync.Mutex
+	entries map[string]*resolverEntry
+	now     func() time.Time // for tests
+}
+
+type resolverEntry struct {
+	ips      []net.IP
+	expires  time.Time // when ips become stale
+	err      error     // most recent failure
+	failures uint
+	retryAt  time.Time // no lookups before this time after a failure
+}
+
+var _ Resolver = (*CachingResolver)(nil)
+
+func (r *CachingResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	key := network + "/" + host
+
+	r.mu.Lock()
+	now := r.timeNow()
+	entry := r.entries[key]
+	if entry != nil {
+		if entry.ips != nil && now.Before(entry.expires) {
+			ips := copyIPs(entry.ips)
+			r.mu.Unlock()
+			return ips, nil
+		}
+		if entry.err != nil && now.Before(entry.retryAt) {
+			err := entry.err
+			r.mu.Unlock()
+			return nil, fmt.Errorf("not retrying lookup of %s until %v: %w", host, entry.retryAt.Format(time.RFC3339), err)
+		}
+	}
+	r.mu.Unlock()
+
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIP(ctx, network, host)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.entries == nil {
+		r.entries = make(map[string]*resolverEntry)
+	}
+	entry = r.entries[key]
+	if entry == nil {
+		entry = new(resolverEntry)
+		r.entries[key] = entry
+	}
+	now = r.timeNow()
+	if err != nil {
+		entry.ips = nil
+		entry.err = err
+		entry.failures++
+		entry.retryAt = now.Add(r.backoff(entry.failures))
+		return nil, err
+	}
+	// Callers may modify the slice they get, so the cache keeps its own.
+	entry.ips = copyIPs(ips)
+	entry.err = nil
+	entry.failures = 0
+	entry.expires = now.Add(orDefault(r.TTL, DefaultResolverTTL))
+	return ips, nil
+}
+
+// backoff returns the delay after the given number of consecutive failures.
+func (r *CachingResolver) backoff(failures uint) time.Duration {
+	min := orDefault(r.MinBackoff, DefaultResolverMinBackoff)
+	max := orDefault(r.MaxBackoff, DefaultResolverMaxBackoff)
+	d := min
+	for i := uint(1); i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (r *CachingResolver) timeNow() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// copyIPs returns a deep copy of ips.
+func copyIPs(ips []net.IP) []net.IP {
+	out := make([]net.IP, len(ips))
+	for i, ip := range ips {
+		out[i] = append(net.IP(nil), ip...)
+	}
+	return out
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
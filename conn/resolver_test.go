@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	queries int
+	ips     []net.IP
+	err     error
+}
+
+func (r *fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.queries++
+	return r.ips, r.err
+}
+
+func TestCachingResolver(t *testing.T) {
+	fake := &fakeResolver{ips: []net.IP{net.IPv4(192, 0, 2, 1)}}
+	now := time.Unix(1000, 0)
+	r := &CachingResolver{
+		Resolver:   fake,
+		TTL:        time.Minute,
+		MinBackoff: time.Second,
+		MaxBackoff: 4 * time.Second,
+		now:        func() time.Time { return now },
+	}
+	lookup := func() error {
+		_, err := r.LookupIP(context.Background(), "ip", "vpn.example.com")
+		return err
+	}
+
+	// Successful results are cached until the TTL expires.
+	lookup()
+	lookup()
+	if fake.queries != 1 {
+		t.Errorf("queries within TTL = %d; want 1", fake.queries)
+	}
+	now = now.Add(time.Minute)
+	lookup()
+	if fake.queries != 2 {
+		t.Errorf("queries after TTL = %d; want 2", fake.queries)
+	}
+
+	// Failures back off exponentially up to MaxBackoff.
+	now = now.Add(time.Minute)
+	fake.err = errors.New("no such host")
+	for _, wait := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		queries := fake.queries
+		if err := lookup(); err == nil {
+			t.Fatalf("lookup succeeded with a failing resolver")
+		}
+		if fake.queries != queries+1 {
+			t.Fatalf("failed lookup did not query the resolver")
+		}
+		now = now.Add(wait - time.Millisecond)
+		if err := lookup(); !errors.Is(err, fake.err) || fake.queries != queries+1 {
+			t.Errorf("lookup during %v backoff = %v after %d queries", wait, err, fake.queries-queries)
+		}
+		now = now.Add(time.Millisecond)
+	}
+
+	// Recovery resets the backoff.
+	fake.err = nil
+	if err := lookup(); err != nil {
+		t.Errorf("lookup after recovery: %v", err)
+	}
+
+	// Callers cannot modify the cached result.
+	ips, _ := r.LookupIP(context.Background(), "ip", "vpn.example.com")
+	ips[0][0] = 0
+	ips[0] = nil
+	ips, _ = r.LookupIP(context.Background(), "ip", "vpn.example.com")
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("cached result modified by a caller: %v", ips)
+	}
+}
@@ -62,4 +62,5 @@ func TestDeviceAlignment(t *testing.T) {
 		)
 	}
 	checkAlignment(t, "Device.rate.underLoadUntil", unsafe.Offsetof(d.rate)+unsafe.Offsetof(d.rate.underLoadUntil))
+	checkAlignment(t, "Device.drops", unsafe.Offsetof(d.drops))
 }
@@ -103,6 +103,36 @@ func (node *trieEntry) removeByPeer(p *Peer) *trieEntry {
 	return node.child[0]
 }
 
+// remove disassociates the prefix ip/cidr from p, where ip is masked, and
+// reports whether it was associated with p. Intermediate nodes left with a
+// single child are merged away.
+func (node *trieEntry) remove(ip net.IP, cidr uint, p *Peer) (*trieEntry, bool) {
+	if node == nil || node.cidr > cidr || commonBits(node.bits, ip) < node.cidr {
+		return node, false
+	}
+	var removed bool
+	if node.cidr == cidr {
+		if node.peer != p {
+			return node, false
+		}
+		node.removeFromPeerEntries()
+		node.peer = nil
+		removed = true
+	} else {
+		bit := node.choose(ip)
+		node.child[bit], removed = node.child[bit].remove(ip, cidr, p)
+	}
+	if removed && node.peer == nil {
+		if node.child[0] == nil {
+			return node.child[1], true
+		}
+		if node.child[1] == nil {
+			return node.child[0], true
+		}
+	}
+	return node, removed
+}
+
 func (node *trieEntry) choose(ip net.IP) byte {
 	return (ip[node.bit_at_byte] >> node.bit_at_shift) & 1
 }
@@ -202,6 +232,57 @@ func (node *trieEntry) lookup(ip net.IP) *Peer {
 	return found
 }
 
+// lookupPrefix is like lookup but also returns the length of the matching prefix.
+func (node *trieEntry) lookupPrefix(ip net.IP) (found *Peer, cidr uint) {
+	size := uint(len(ip))
+	for node != nil && commonBits(node.bits, ip) >= node.cidr {
+		if node.peer != nil {
+			found, cidr = node.peer, node.cidr
+		}
+		if node.bit_at_byte == size {
+			break
+		}
+		bit := node.choose(ip)
+		node = node.child[bit]
+	}
+	return found, cidr
+}
+
+// An AllowedIPsTable maps IP prefixes to peers for cryptokey routing.
+// The device consults it for every packet sent and received, so
+// implementations must be safe for concurrent use and should be fast.
+// AllowedIPs is the default implementation.
+type AllowedIPsTable interface {
+	// Insert associates ip/cidr with peer, replacing any previous association.
+	Insert(ip net.IP, cidr uint, peer *Peer)
+	// LookupIPv4 returns the peer with the longest prefix matching the
+	// 4-byte address, or nil.
+	LookupIPv4(address []byte) *Peer
+	// LookupIPv6 returns the peer with the longest prefix matching the
+	// 16-byte address, or nil.
+	LookupIPv6(address []byte) *Peer
+	// Remove disassociates ip/cidr from peer, leaving other prefixes in
+	// place, and reports whether the prefix was associated with peer.
+	// ip must be masked to cidr bits.
+	Remove(ip net.IP, cidr uint, peer *Peer) bool
+	// RemoveByPeer removes all prefixes associated with peer.
+	RemoveByPeer(peer *Peer)
+	// EntriesForPeer calls cb for each prefix associated with peer,
+	// stopping early if cb returns false.
+	EntriesForPeer(peer *Peer, cb func(ip net.IP, cidr uint) bool)
+}
+
+// An AllowedIPsSourceTable is an AllowedIPsTable that decides itself which
+// peers may send packets from an address, for instance because it maps
+// some addresses to several peers. For other tables, a received packet is
+// only accepted from the peer that its source address looks up to.
+type AllowedIPsSourceTable interface {
+	AllowedIPsTable
+	// AllowsSource reports whether peer may send packets with the
+	// 4- or 16-byte source address.
+	AllowsSource(peer *Peer, address []byte) bool
+}
+
 type AllowedIPs struct {
 	IPv4  *trieEntry
 	IPv6  *trieEntry
@@ -228,6 +309,23 @@ func (table *AllowedIPs) RemoveByPeer(peer *Peer) {
 	table.IPv6 = table.IPv6.removeByPeer(peer)
 }
 
+// Remove disassociates ip/cidr from peer, leaving other prefixes in place,
+// and reports whether the prefix was associated with peer.
+// ip must be masked to cidr bits.
+func (table *AllowedIPs) Remove(ip net.IP, cidr uint, peer *Peer) bool {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	var removed bool
+	switch len(ip) {
+	case net.IPv6len:
+		table.IPv6, removed = table.IPv6.remove(ip, cidr, peer)
+	case net.IPv4len:
+		table.IPv4, removed = table.IPv4.remove(ip, cidr, peer)
+	}
+	return removed
+}
+
 func (table *AllowedIPs) Insert(ip net.IP, cidr uint, peer *Peer) {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
@@ -7,6 +7,7 @@ package device
 
 import (
 	"math/rand"
+	"net"
 	"sort"
 	"testing"
 )
@@ -129,3 +130,66 @@ func TestTrieRandomIPv6(t *testing.T) {
 		}
 	}
 }
+
+func (r SlowRouter) Remove(addr []byte, cidr uint, peer *Peer) SlowRouter {
+	for i, t := range r {
+		if t.cidr == cidr && t.peer == peer && commonBits(t.bits, addr) >= cidr {
+			return append(r[:i], r[i+1:]...)
+		}
+	}
+	return r
+}
+
+func TestTrieRandomRemove(t *testing.T) {
+	for _, addressLength := range []int{4, 16} {
+		var trie *trieEntry
+		var slow SlowRouter
+		var peers []*Peer
+
+		rand.Seed(1)
+
+		for n := 0; n < NumberOfPeers; n++ {
+			peers = append(peers, &Peer{})
+		}
+
+		type prefix struct {
+			addr net.IP
+			cidr uint
+			peer *Peer
+		}
+		var inserted []prefix
+		for n := 0; n < NumberOfAddresses; n++ {
+			addr := make(net.IP, addressLength)
+			rand.Read(addr)
+			cidr := uint(rand.Uint32() % uint32(addressLength*8))
+			addr = addr.Mask(net.CIDRMask(int(cidr), addressLength*8))
+			peer := peers[rand.Int()%NumberOfPeers]
+			trie = trie.insert(append(net.IP(nil), addr...), cidr, peer)
+			slow = slow.Insert(addr, cidr, peer)
+			inserted = append(inserted, prefix{addr, cidr, peer})
+		}
+
+		for i, p := range inserted {
+			if i%2 != 0 {
+				continue
+			}
+			var removed bool
+			trie, removed = trie.remove(p.addr, p.cidr, p.peer)
+			before := len(slow)
+			slow = slow.Remove(p.addr, p.cidr, p.peer)
+			if removed != (len(slow) != before) {
+				t.Errorf("remove(%v/%d) = %v, naive implementation disagrees", p.addr, p.cidr, removed)
+			}
+		}
+
+		for n := 0; n < NumberOfTests; n++ {
+			addr := make([]byte, addressLength)
+			rand.Read(addr)
+			peer1 := slow.Lookup(addr)
+			peer2 := trie.lookup(addr)
+			if peer1 != peer2 {
+				t.Error("Trie did not match naive implementation after removal, for:", addr)
+			}
+		}
+	}
+}
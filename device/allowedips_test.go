@@ -9,6 +9,9 @@ import (
 	"math/rand"
 	"net"
 	"testing"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
 )
 
 /* Todo: More comprehensive
@@ -238,3 +241,115 @@ func TestTrieIPv6(t *testing.T) {
 	assertEQ(h, 0x24046800, 0x40040800, 0x10101010, 0x10101010)
 	assertEQ(a, 0x24046800, 0x40040800, 0xdeadbeef, 0xdeadbeef)
 }
+
+type countingTable struct {
+	AllowedIPs
+	inserts, removes int
+}
+
+func (table *countingTable) Insert(ip net.IP, cidr uint, peer *Peer) {
+	table.inserts++
+	table.AllowedIPs.Insert(ip, cidr, peer)
+}
+
+func (table *countingTable) RemoveByPeer(peer *Peer) {
+	table.removes++
+	table.AllowedIPs.RemoveByPeer(peer)
+}
+
+func TestCustomAllowedIPsTable(t *testing.T) {
+	table := new(countingTable)
+	dev, err := NewDeviceWithOptions(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""), DeviceOptions{AllowedIPs: table})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	cfg := uapiCfg(
+		"public_key", "ad8f5d4a22bd33f4e4f2e4ba10a56fa4d5f5f6cdd5a22a8cd6e6b1f1c2a3e4f5",
+		"replace_allowed_ips", "true",
+		"allowed_ip", "10.0.0.0/8",
+		"allowed_ip", "fd00::/64",
+	)
+	if err := dev.IpcSet(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if table.inserts != 2 || table.removes != 1 {
+		t.Errorf("inserts = %d, removes = %d; want 2, 1", table.inserts, table.removes)
+	}
+	peers := dev.Config().Peers
+	if len(peers) != 1 || len(peers[0].AllowedIPs) != 2 {
+		t.Fatalf("config does not reflect custom table: %+v", peers)
+	}
+	if table.LookupIPv4(net.IPv4(10, 1, 2, 3).To4()) == nil {
+		t.Errorf("lookup in custom table failed")
+	}
+}
+
+func TestWeightedAllowedIPs(t *testing.T) {
+	a, b, c := &Peer{}, &Peer{}, &Peer{}
+	table := new(WeightedAllowedIPs)
+	anycast := net.IPv4(192, 0, 2, 0).To4()
+	table.InsertWeighted(anycast, 24, a, 1)
+	table.InsertWeighted(anycast, 24, b, 3)
+	table.Insert(net.IPv4(192, 0, 2, 128).To4(), 25, c)
+	table.Insert(net.IPv4(192, 0, 0, 0).To4(), 16, c)
+
+	counts := make(map[*Peer]int)
+	for i := 0; i < 128; i++ {
+		addr := []byte{192, 0, 2, byte(i)}
+		peer := table.LookupIPv4(addr)
+		if peer != table.LookupIPv4(addr) {
+			t.Fatalf("lookup of %v is not stable", net.IP(addr))
+		}
+		counts[peer]++
+	}
+	if counts[c] != 0 || counts[a] == 0 || counts[b] <= counts[a] {
+		t.Errorf("unexpected distribution over the weighted prefix: a=%d b=%d c=%d", counts[a], counts[b], counts[c])
+	}
+	if peer := table.LookupIPv4([]byte{192, 0, 2, 200}); peer != c {
+		t.Errorf("longer ordinary prefix did not win over the group")
+	}
+	if peer := table.LookupIPv4([]byte{192, 0, 3, 1}); peer != c {
+		t.Errorf("address outside the group not routed by the trie")
+	}
+	for _, peer := range []*Peer{a, b} {
+		if !table.AllowsSource(peer, []byte{192, 0, 2, 1}) {
+			t.Errorf("group member %p not allowed as source", peer)
+		}
+	}
+	if table.AllowsSource(c, []byte{192, 0, 2, 1}) {
+		t.Errorf("peer outside the group allowed as source")
+	}
+	if !table.AllowsSource(c, []byte{192, 0, 2, 200}) || table.AllowsSource(a, []byte{192, 0, 2, 200}) {
+		t.Errorf("source check ignored the longer ordinary prefix")
+	}
+
+	var entries int
+	table.EntriesForPeer(b, func(ip net.IP, cidr uint) bool {
+		entries++
+		if !ip.Equal(anycast) || cidr != 24 {
+			t.Errorf("unexpected entry %v/%d", ip, cidr)
+		}
+		return true
+	})
+	if entries != 1 {
+		t.Errorf("peer has %d entries; want 1", entries)
+	}
+
+	if table.Remove(anycast, 24, c) {
+		t.Errorf("removed a group prefix from a peer outside the group")
+	}
+	if !table.Remove(anycast, 24, b) || table.Remove(anycast, 24, b) {
+		t.Errorf("group member not removed exactly once")
+	}
+	if peer := table.LookupIPv4([]byte{192, 0, 2, 1}); peer != a {
+		t.Errorf("after removing a member, group routes to %p; want %p", peer, a)
+	}
+
+	table.RemoveByPeer(b)
+	table.InsertWeighted(anycast, 24, a, 0)
+	if peer := table.LookupIPv4([]byte{192, 0, 2, 1}); peer != c {
+		t.Errorf("emptied group still routes to %p; want fallback to %p", peer, c)
+	}
+}
@@ -0,0 +1,254 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// WeightedAllowedIPs is an AllowedIPsTable in which several peers may
+// share a prefix, for instance peers advertising the same anycast network.
+// Prefixes added with Insert behave as in AllowedIPs, with a single peer
+// each. Prefixes added with InsertWeighted form groups of peers; when such
+// a group holds the longest matching prefix of an address, the address is
+// hashed to one of its peers in proportion to their weights. Each
+// destination address thus consistently maps to the same peer while the
+// group is unchanged. A group wins over an ordinary prefix of equal length.
+// Packets received from any peer of a group may carry a source address
+// within its prefix.
+//
+// WeightedAllowedIPs is meant to be passed to NewDeviceWithOptions in
+// DeviceOptions.AllowedIPs. Groups are scanned linearly, so it is suited to
+// a small number of them.
+type WeightedAllowedIPs struct {
+	AllowedIPs
+
+	groupsMu sync.RWMutex
+	groups   []*weightedGroup
+	ngroups  int32 // len(groups), accessed atomically so lookups skip groupsMu when 0
+}
+
+type weightedGroup struct {
+	prefix  net.IPNet
+	cidr    uint
+	members []weightedPeer
+	total   uint64 // sum of member weights
+}
+
+type weightedPeer struct {
+	peer   *Peer
+	weight uint32
+}
+
+var (
+	_ AllowedIPsTable       = (*WeightedAllowedIPs)(nil)
+	_ AllowedIPsSourceTable = (*WeightedAllowedIPs)(nil)
+)
+
+// InsertWeighted adds peer with the given weight to the group of peers
+// sharing ip/cidr, replacing its previous weight there, if any.
+// A weight of zero removes peer from the group.
+func (table *WeightedAllowedIPs) InsertWeighted(ip net.IP, cidr uint, peer *Peer, weight uint32) {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		panic(errors.New("inserting unknown address type"))
+	}
+	mask := net.CIDRMask(int(cidr), 8*len(ip))
+	prefix := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+
+	table.groupsMu.Lock()
+	defer table.groupsMu.Unlock()
+
+	var group *weightedGroup
+	for _, g := range table.groups {
+		if g.cidr == cidr && g.prefix.IP.Equal(prefix.IP) && len(g.prefix.IP) == len(prefix.IP) {
+			group = g
+			break
+		}
+	}
+	if group == nil {
+		if weight == 0 {
+			return
+		}
+		group = &weightedGroup{prefix: prefix, cidr: cidr}
+		table.groups = append(table.groups, group)
+	}
+	group.remove(peer)
+	if weight != 0 {
+		group.members = append(group.members, weightedPeer{peer, weight})
+		group.total += uint64(weight)
+	}
+	table.pruneLocked()
+}
+
+func (group *weightedGroup) remove(peer *Peer) {
+	for i, member := range group.members {
+		if member.peer == peer {
+			group.total -= uint64(member.weight)
+			group.members = append(group.members[:i], group.members[i+1:]...)
+			return
+		}
+	}
+}
+
+// pruneLocked drops empty groups. The caller must hold table.groupsMu.
+func (table *WeightedAllowedIPs) pruneLocked() {
+	groups := table.groups[:0]
+	for _, group := range table.groups {
+		if len(group.members) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	table.groups = groups
+	atomic.StoreInt32(&table.ngroups, int32(len(groups)))
+}
+
+// Remove disassociates ip/cidr from peer, whether peer holds it alone or
+// as a member of a group, and reports whether it was associated with peer.
+func (table *WeightedAllowedIPs) Remove(ip net.IP, cidr uint, peer *Peer) bool {
+	if table.AllowedIPs.Remove(ip, cidr, peer) {
+		return true
+	}
+
+	table.groupsMu.Lock()
+	defer table.groupsMu.Unlock()
+	for _, group := range table.groups {
+		if group.cidr != cidr || len(group.prefix.IP) != len(ip) || !group.prefix.IP.Equal(ip) {
+			continue
+		}
+		members := len(group.members)
+		group.remove(peer)
+		if len(group.members) == members {
+			return false
+		}
+		table.pruneLocked()
+		return true
+	}
+	return false
+}
+
+func (table *WeightedAllowedIPs) RemoveByPeer(peer *Peer) {
+	table.AllowedIPs.RemoveByPeer(peer)
+
+	table.groupsMu.Lock()
+	defer table.groupsMu.Unlock()
+	for _, group := range table.groups {
+		group.remove(peer)
+	}
+	table.pruneLocked()
+}
+
+func (table *WeightedAllowedIPs) EntriesForPeer(peer *Peer, cb func(ip net.IP, cidr uint) bool) {
+	stopped := false
+	table.AllowedIPs.EntriesForPeer(peer, func(ip net.IP, cidr uint) bool {
+		stopped = !cb(ip, cidr)
+		return !stopped
+	})
+	if stopped {
+		return
+	}
+
+	table.groupsMu.RLock()
+	defer table.groupsMu.RUnlock()
+	for _, group := range table.groups {
+		for _, member := range group.members {
+			if member.peer == peer && !cb(group.prefix.IP, group.cidr) {
+				return
+			}
+		}
+	}
+}
+
+func (table *WeightedAllowedIPs) LookupIPv4(address []byte) *Peer {
+	table.AllowedIPs.mutex.RLock()
+	peer, cidr := table.IPv4.lookupPrefix(address)
+	table.AllowedIPs.mutex.RUnlock()
+	return table.lookupGroup(address, peer, cidr)
+}
+
+func (table *WeightedAllowedIPs) LookupIPv6(address []byte) *Peer {
+	table.AllowedIPs.mutex.RLock()
+	peer, cidr := table.IPv6.lookupPrefix(address)
+	table.AllowedIPs.mutex.RUnlock()
+	return table.lookupGroup(address, peer, cidr)
+}
+
+// AllowsSource reports whether peer is the owner of the longest prefix
+// matching address or, if a group holds that prefix, a member of the group.
+func (table *WeightedAllowedIPs) AllowsSource(peer *Peer, address []byte) bool {
+	table.AllowedIPs.mutex.RLock()
+	var owner *Peer
+	var cidr uint
+	switch len(address) {
+	case net.IPv4len:
+		owner, cidr = table.IPv4.lookupPrefix(address)
+	case net.IPv6len:
+		owner, cidr = table.IPv6.lookupPrefix(address)
+	}
+	table.AllowedIPs.mutex.RUnlock()
+	if atomic.LoadInt32(&table.ngroups) == 0 {
+		return owner == peer
+	}
+
+	table.groupsMu.RLock()
+	defer table.groupsMu.RUnlock()
+	group := table.bestGroupLocked(address, owner, cidr)
+	if group == nil {
+		return owner == peer
+	}
+	for _, member := range group.members {
+		if member.peer == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupGroup returns the peer chosen from the group with the longest
+// prefix matching address, if that prefix is at least as long as cidr,
+// the length of the prefix that matched peer in the trie.
+func (table *WeightedAllowedIPs) lookupGroup(address []byte, peer *Peer, cidr uint) *Peer {
+	if atomic.LoadInt32(&table.ngroups) == 0 {
+		return peer
+	}
+
+	table.groupsMu.RLock()
+	defer table.groupsMu.RUnlock()
+
+	best := table.bestGroupLocked(address, peer, cidr)
+	if best == nil {
+		return peer
+	}
+	h := fnv.New64a()
+	h.Write(address)
+	point := h.Sum64() % best.total
+	for _, member := range best.members {
+		if point < uint64(member.weight) {
+			return member.peer
+		}
+		point -= uint64(member.weight)
+	}
+	return best.members[len(best.members)-1].peer
+}
+
+// bestGroupLocked returns the group with the longest prefix matching
+// address, if that prefix is at least as long as cidr, the length of the
+// prefix that matched peer in the trie. The caller must hold table.groupsMu.
+func (table *WeightedAllowedIPs) bestGroupLocked(address []byte, peer *Peer, cidr uint) *weightedGroup {
+	var best *weightedGroup
+	for _, group := range table.groups {
+		if len(group.prefix.IP) != len(address) || !group.prefix.Contains(address) {
+			continue
+		}
+		if (peer == nil || group.cidr >= cidr) && (best == nil || group.cidr > best.cidr) {
+			best = group
+		}
+	}
+	return best
+}
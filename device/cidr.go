@@ -0,0 +1,34 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+)
+
+// A CIDR is an IP prefix, such as an allowed IP of a peer, with the
+// prefix math that callers would otherwise reimplement on net.IPNet.
+type CIDR net.IPNet
+
+// Contains reports whether the prefix includes ip. An IPv4 address never
+// belongs to an IPv6 prefix, nor the other way around.
+func (c CIDR) Contains(ip net.IP) bool {
+	if (ip.To4() == nil) != c.IsIPv6() {
+		return false
+	}
+	return (*net.IPNet)(&c).Contains(ip)
+}
+
+// IsIPv6 reports whether c is an IPv6 prefix, as told by its mask.
+func (c CIDR) IsIPv6() bool {
+	_, bits := c.Mask.Size()
+	return bits == 8*net.IPv6len
+}
+
+// String returns c in CIDR notation, such as "192.0.2.0/24".
+func (c CIDR) String() string {
+	return (*net.IPNet)(&c).String()
+}
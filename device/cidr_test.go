@@ -0,0 +1,51 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCIDR(t *testing.T) {
+	parse := func(s string) CIDR {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return CIDR(*ipnet)
+	}
+	tests := []struct {
+		cidr     string
+		ip       string
+		contains bool
+		ipv6     bool
+	}{
+		{"0.0.0.0/0", "198.51.100.7", true, false},
+		{"0.0.0.0/0", "2001:db8::1", false, false},
+		{"::/0", "2001:db8::1", true, true},
+		{"::/0", "198.51.100.7", false, true},
+		{"192.0.2.1/32", "192.0.2.1", true, false},
+		{"192.0.2.1/32", "192.0.2.2", false, false},
+		{"2001:db8::/32", "2001:db8::1", true, true},
+		{"2001:db8::1/128", "2001:db8::1", true, true},
+		{"2001:db8::1/128", "2001:db8::2", false, true},
+		{"10.0.0.0/8", "10.255.255.255", true, false},
+		{"10.0.0.0/8", "11.0.0.0", false, false},
+	}
+	for _, tt := range tests {
+		c := parse(tt.cidr)
+		if got := c.Contains(net.ParseIP(tt.ip)); got != tt.contains {
+			t.Errorf("%s.Contains(%s) = %v; want %v", tt.cidr, tt.ip, got, tt.contains)
+		}
+		if got := c.String(); got != tt.cidr {
+			t.Errorf("String() = %q; want %q", got, tt.cidr)
+		}
+		if got := c.IsIPv6(); got != tt.ipv6 {
+			t.Errorf("%s.IsIPv6() = %v; want %v", tt.cidr, got, tt.ipv6)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// FromConf parses a configuration file in the INI-like format read by
+// wg(8) and wg-quick(8), with an [Interface] section followed by [Peer]
+// sections. Keys are case-insensitive, and "#" starts a comment.
+//
+// In [Interface], PrivateKey, ListenPort and FwMark are read, as are the
+// wg-quick settings Address, DNS and MTU. The other wg-quick settings, such
+// as Table and PostUp, concern the script alone and are skipped. In [Peer],
+// PublicKey, PresharedKey, AllowedIPs, Endpoint and PersistentKeepalive are
+// read. Any other key is an error, as are peers sharing a public key. Keys
+// are in base64, and allowed IPs and addresses without a prefix length are
+// single hosts.
+//
+// Endpoints given by host name are kept as such, without blocking on DNS;
+// the device looks them up with its DeviceOptions.Resolver once the
+// configuration is applied.
+func FromConf(r io.Reader) (*Config, error) {
+	cfg := new(Config)
+	var peer *PeerConfig // peer being parsed, nil in [Interface]
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+				peer = nil
+			case "peer":
+				cfg.Peers = append(cfg.Peers, PeerConfig{})
+				peer = &cfg.Peers[len(cfg.Peers)-1]
+			default:
+				return nil, fmt.Errorf("line %d: unknown section %q", n, line)
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key = value, got %q", n, line)
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+		var err error
+		switch section {
+		case "interface":
+			err = cfg.parseConfLine(key, value)
+		case "peer":
+			err = peer.parseConfLine(key, value)
+		default:
+			err = fmt.Errorf("%s outside of a section", parts[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, pc := range cfg.Peers {
+		if pc.PublicKey.IsZero() {
+			return nil, fmt.Errorf("peer %d has no PublicKey", i+1)
+		}
+	}
+	if err := validatePeers(cfg.Peers); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseConfLine parses a key of the [Interface] section.
+func (cfg *Config) parseConfLine(key, value string) error {
+	switch key {
+	case "privatekey":
+		if err := cfg.PrivateKey.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("invalid PrivateKey: %w", err)
+		}
+
+	case "listenport":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid ListenPort: %w", err)
+		}
+		cfg.ListenPort = uint16(port)
+
+	case "fwmark":
+		if value == "off" {
+			cfg.Fwmark = 0
+			break
+		}
+		mark, err := parseFwmark(value)
+		if err != nil {
+			return fmt.Errorf("invalid FwMark: %w", err)
+		}
+		cfg.Fwmark = uint32(mark)
+
+	case "address":
+		for _, s := range splitConfList(value) {
+			ip, ipnet, err := parseConfPrefix(s)
+			if err != nil {
+				return fmt.Errorf("invalid Address: %w", err)
+			}
+			cfg.Addresses = append(cfg.Addresses, net.IPNet{IP: ip, Mask: ipnet.Mask})
+		}
+
+	case "dns":
+		for _, s := range splitConfList(value) {
+			if ip := net.ParseIP(s); ip != nil {
+				cfg.DNS = append(cfg.DNS, ip)
+			} else {
+				cfg.DNSSearch = append(cfg.DNSSearch, s)
+			}
+		}
+
+	case "mtu":
+		mtu, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid MTU: %w", err)
+		}
+		cfg.MTU = int(mtu)
+
+	case "table", "preup", "postup", "predown", "postdown", "saveconfig":
+		// Used by wg-quick itself.
+
+	default:
+		return fmt.Errorf("unknown Interface key %q", key)
+	}
+	return nil
+}
+
+// parseConfLine parses a key of a [Peer] section.
+func (pc *PeerConfig) parseConfLine(key, value string) error {
+	switch key {
+	case "publickey":
+		if err := pc.PublicKey.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("invalid PublicKey: %w", err)
+		}
+
+	case "presharedkey":
+		if err := pc.PresharedKey.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("invalid PresharedKey: %w", err)
+		}
+
+	case "allowedips":
+		for _, s := range splitConfList(value) {
+			_, ipnet, err := parseConfPrefix(s)
+			if err != nil {
+				return fmt.Errorf("invalid AllowedIPs: %w", err)
+			}
+			pc.AllowedIPs = append(pc.AllowedIPs, *ipnet)
+		}
+
+	case "endpoint":
+		if err := checkConfEndpoint(value); err != nil {
+			return fmt.Errorf("invalid Endpoint: %w", err)
+		}
+		pc.Endpoint = value
+
+	case "persistentkeepalive":
+		if value == "off" {
+			pc.PersistentKeepalive = 0
+			break
+		}
+		secs, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid PersistentKeepalive: %w", err)
+		}
+		pc.PersistentKeepalive = uint16(secs)
+
+	default:
+		return fmt.Errorf("unknown Peer key %q", key)
+	}
+	return nil
+}
+
+// checkConfEndpoint checks that s is a host:port endpoint with a numeric
+// port. The host may be an IP address or a name.
+func checkConfEndpoint(s string) error {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host in %q", s)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// splitConfList splits a comma-separated list, ignoring surrounding spaces
+// and empty elements.
+func splitConfList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// parseConfPrefix is like net.ParseCIDR, but takes an address without
+// a prefix length to be a single host.
+func parseConfPrefix(s string) (net.IP, *net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return ip, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}, nil
+	}
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ipnet.IP) == net.IPv4len {
+		ip = ip.To4()
+	}
+	return ip, ipnet, nil
+}
@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFromConf(t *testing.T) {
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skText, _ := sk.MarshalText()
+	pk := peerKey.publicKey()
+	pkText, _ := pk.MarshalText()
+	psk := NoisePresharedKey{1, 2, 3}
+	pskText, _ := psk.MarshalText()
+
+	conf := `# wg-quick configuration
+[Interface]
+PrivateKey = ` + string(skText) + `
+ListenPort = 51820
+Address = 10.0.0.2/24, fd00::2/64
+DNS = 10.0.0.1, example.com
+MTU = 1420
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+
+[Peer]
+publickey = ` + string(pkText) + `
+PresharedKey = ` + string(pskText) + `
+AllowedIPs = 0.0.0.0/0, ::/0,10.1.2.3 # everything
+Endpoint = 192.0.2.1:51820
+PersistentKeepalive = 25
+`
+	cfg, err := FromConf(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{
+		PrivateKey: sk,
+		ListenPort: 51820,
+		Addresses: []net.IPNet{
+			{IP: net.IPv4(10, 0, 0, 2).To4(), Mask: net.CIDRMask(24, 32)},
+			{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)},
+		},
+		DNS:       []net.IP{net.ParseIP("10.0.0.1")},
+		DNSSearch: []string{"example.com"},
+		MTU:       1420,
+		Peers: []PeerConfig{{
+			PublicKey:    pk,
+			PresharedKey: psk,
+			AllowedIPs: []net.IPNet{
+				{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+				{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+				{IP: net.IPv4(10, 1, 2, 3).To4(), Mask: net.CIDRMask(32, 32)},
+			},
+			Endpoint:            "192.0.2.1:51820",
+			PersistentKeepalive: 25,
+		}},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("FromConf = %+v; want %+v", cfg, want)
+	}
+
+	for _, bad := range []string{
+		"PrivateKey = " + string(skText),
+		"[Interface]\nBogus = 1",
+		"[Interface]\nListenPort = 70000",
+		"[Interface]\nAddress = 10.0.0.300",
+		"[Peer]\nPublicKey = " + string(pkText) + "\nEndpoint = 192.0.2.1",
+		"[Peer]\nPublicKey = " + string(pkText) + "\nEndpoint = vpn.example.com:wg",
+		"[Peer]\nPublicKey = " + string(pkText) + "\nEndpoint = :51820",
+		"[Peer]\nPersistentKeepalive = 25",
+		"[Peer]\nPublicKey = " + string(pkText) + "\n[Peer]\nPublicKey = " + string(pkText),
+		"[Peers]",
+	} {
+		if _, err := FromConf(strings.NewReader(bad)); err == nil {
+			t.Errorf("FromConf(%q) succeeded", bad)
+		}
+	}
+
+	// Host names are left for the device to look up.
+	cfg, err = FromConf(strings.NewReader("[Peer]\nPublicKey = " + string(pkText) + "\nEndpoint = vpn.example.com:51820"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Peers[0].Endpoint; got != "vpn.example.com:51820" {
+		t.Errorf("host name endpoint parsed as %q; want vpn.example.com:51820", got)
+	}
+}
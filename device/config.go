@@ -0,0 +1,381 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// A Config is the configuration of a Device.
+type Config struct {
+	PrivateKey NoisePrivateKey
+	ListenPort uint16 // 0 lets the bind choose a port
+	Fwmark     uint32
+	Peers      []PeerConfig
+
+	// Addresses, DNS, DNSSearch and MTU are the interface settings of a
+	// wg-quick configuration file, as read by FromConf. The device does not
+	// use them, and Device.Config leaves them empty; they are for the
+	// application to set up the TUN device and the resolver with.
+	Addresses []net.IPNet `json:",omitempty"`
+	DNS       []net.IP    `json:",omitempty"`
+	DNSSearch []string    `json:",omitempty"`
+	MTU       int         `json:",omitempty"` // 0 if unspecified
+}
+
+// A PeerConfig is the configuration of a single peer of a Device.
+type PeerConfig struct {
+	PublicKey           NoisePublicKey
+	PresharedKey        NoisePresharedKey
+	Endpoint            string // host:port, the host possibly a name looked up by DeviceOptions.Resolver; empty if none
+	PersistentKeepalive uint16 // in seconds, 0 = disabled
+	AllowedIPs          []net.IPNet
+	ProtocolVersion     int // 0 if unspecified, which means CurrentProtocolVersion
+	Origin              PeerOrigin
+
+	// State, if not nil, is imported when the peer is created, so that it
+	// takes over a session exported by Peer.ExportState on another device.
+	// It is ignored for existing peers and never reported by Config.
+	State *PeerState `json:",omitempty"`
+}
+
+// A PeerOrigin records how a peer came to be configured.
+type PeerOrigin int
+
+const (
+	// PeerOriginConfig marks a peer that is part of the device's
+	// declarative configuration. It is the default.
+	PeerOriginConfig PeerOrigin = iota
+	// PeerOriginDynamic marks a peer added at runtime, for instance one
+	// discovered by the application. SetPeers leaves such peers in place.
+	PeerOriginDynamic
+)
+
+func (o PeerOrigin) String() string {
+	switch o {
+	case PeerOriginConfig:
+		return "config"
+	case PeerOriginDynamic:
+		return "dynamic"
+	}
+	return fmt.Sprintf("PeerOrigin(%d)", int(o))
+}
+
+// Config returns a snapshot of the running configuration of the device.
+// The returned Config shares no memory with the device.
+func (device *Device) Config() *Config {
+	device.net.RLock()
+	defer device.net.RUnlock()
+
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	cfg := &Config{
+		PrivateKey: device.staticIdentity.privateKey,
+		ListenPort: device.net.port,
+		Fwmark:     device.net.fwmark,
+		Peers:      make([]PeerConfig, 0, len(device.peers.keyMap)),
+	}
+
+	for _, peer := range device.peers.keyMap {
+		cfg.Peers = append(cfg.Peers, peer.config())
+	}
+	return cfg
+}
+
+// SetPeers makes the device's peers match peers. Peers that are not listed
+// are removed unless their origin is PeerOriginDynamic, new ones are added
+// as by AddPeer, and existing ones are updated in place, including their
+// origin. Existing peers keep their sessions, and a peer whose
+// configuration is unchanged is not disturbed at all. An empty Endpoint
+// leaves an existing peer's current endpoint in place.
+// All of peers is validated before any change is made, and should adding a
+// peer still fail, for instance because MaxPeers is reached, the device's
+// peers are left as they were.
+func (device *Device) SetPeers(peers []PeerConfig) error {
+	if err := validatePeers(peers); err != nil {
+		return err
+	}
+	endpoints := make([]conn.Endpoint, len(peers))
+	allowedIPs := make([][]net.IPNet, len(peers))
+	for i, pc := range peers {
+		var err error
+		endpoints[i], allowedIPs[i], err = device.parsePeerConfig(pc)
+		if err != nil {
+			return err
+		}
+	}
+
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	// Add new peers first, so that a failure leaves the previous peers in
+	// place; the peers added so far are removed again.
+	existing := make([]*Peer, len(peers))
+	var added []*Peer
+	for i, pc := range peers {
+		if existing[i] = device.LookupPeer(pc.PublicKey); existing[i] != nil {
+			continue
+		}
+		peer, err := device.addPeer(pc, endpoints[i], allowedIPs[i])
+		if err != nil {
+			for _, peer := range added {
+				device.RemovePeer(peer.handshake.remoteStatic)
+			}
+			return err
+		}
+		added = append(added, peer)
+	}
+	for i, peer := range existing {
+		if peer != nil {
+			peer.reconfigure(peers[i], endpoints[i], allowedIPs[i])
+		}
+	}
+
+	want := make(map[NoisePublicKey]bool, len(peers))
+	for _, pc := range peers {
+		want[pc.PublicKey] = true
+	}
+	var stale []NoisePublicKey
+	device.peers.RLock()
+	for key, peer := range device.peers.keyMap {
+		if !want[key] && peer.Origin() != PeerOriginDynamic {
+			stale = append(stale, key)
+		}
+	}
+	device.peers.RUnlock()
+	for _, key := range stale {
+		device.RemovePeer(key)
+	}
+	return nil
+}
+
+// reconfigure applies the parts of cfg that differ from the peer's
+// current configuration, leaving its keypairs and handshake untouched.
+// endpoint and allowedIPs must have been produced by parsePeerConfig.
+func (peer *Peer) reconfigure(cfg PeerConfig, endpoint conn.Endpoint, allowedIPs []net.IPNet) {
+	device := peer.device
+
+	peer.handshake.mutex.Lock()
+	peer.handshake.presharedKey = cfg.PresharedKey
+	peer.handshake.mutex.Unlock()
+
+	peer.Lock()
+	peer.protocolVersion = cfg.ProtocolVersion
+	peer.origin = cfg.Origin
+	peer.Unlock()
+
+	if endpoint != nil {
+		peer.RLock()
+		changed := peer.endpoint == nil || peer.endpoint.DstToString() != endpoint.DstToString()
+		peer.RUnlock()
+		if changed {
+			peer.SetEndpoints([]conn.Endpoint{endpoint})
+		}
+	}
+
+	old := atomic.SwapUint32(&peer.persistentKeepaliveInterval, uint32(cfg.PersistentKeepalive))
+	if old == 0 && cfg.PersistentKeepalive != 0 && device.isUp() {
+		peer.sendKeepalive()
+	}
+
+	current := make(map[string]bool)
+	device.allowedips.EntriesForPeer(peer, func(ip net.IP, cidr uint) bool {
+		current[(&net.IPNet{IP: ip, Mask: net.CIDRMask(int(cidr), 8*len(ip))}).String()] = true
+		return true
+	})
+	same := len(current) == len(allowedIPs)
+	for i := 0; same && i < len(allowedIPs); i++ {
+		same = current[allowedIPs[i].String()]
+	}
+	if !same {
+		device.allowedips.RemoveByPeer(peer)
+		for _, ipnet := range allowedIPs {
+			ones, _ := ipnet.Mask.Size()
+			device.allowedips.Insert(ipnet.IP, uint(ones), peer)
+		}
+	}
+}
+
+// AddAllowedIP routes ipnet to the peer, in addition to its other allowed
+// IPs. It fails if another peer already has exactly ipnet; a peer with a
+// shorter or longer prefix overlapping it is no obstacle, as usual.
+func (peer *Peer) AddAllowedIP(ipnet net.IPNet) error {
+	ipnet, err := normalizeAllowedIP(ipnet)
+	if err != nil {
+		return err
+	}
+	device := peer.device
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	// Holding the peers lock keeps the peer from being removed, and its
+	// allowed IPs with it, before the prefix is inserted.
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	if device.peers.keyMap[peer.handshake.remoteStatic] != peer {
+		return ErrPeerClosed
+	}
+	if owner := device.allowedIPOwnerLocked(ipnet); owner != nil && owner != peer {
+		return fmt.Errorf("allowed IP %v already belongs to %v", ipnet.String(), owner)
+	}
+	ones, _ := ipnet.Mask.Size()
+	device.allowedips.Insert(ipnet.IP, uint(ones), peer)
+	return nil
+}
+
+// RemoveAllowedIP stops routing ipnet to the peer, leaving its other
+// allowed IPs in place. It fails if ipnet is not one of the peer's
+// allowed IPs; prefixes are compared exactly.
+func (peer *Peer) RemoveAllowedIP(ipnet net.IPNet) error {
+	ipnet, err := normalizeAllowedIP(ipnet)
+	if err != nil {
+		return err
+	}
+	device := peer.device
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	ones, _ := ipnet.Mask.Size()
+	if !device.allowedips.Remove(ipnet.IP, uint(ones), peer) {
+		return fmt.Errorf("allowed IP %v does not belong to %v", ipnet.String(), peer)
+	}
+	return nil
+}
+
+// ForEachAllowedIP calls fn for each allowed IP of each peer of the device,
+// which together make up its cryptokey routing table. Peers cannot be added
+// or removed until ForEachAllowedIP returns, and fn is called with the
+// allowed IPs locked, so it must be fast and must not call methods that
+// change the device's peers or allowed IPs.
+func (device *Device) ForEachAllowedIP(fn func(ipnet net.IPNet, peer *Peer)) {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		device.allowedips.EntriesForPeer(peer, func(ip net.IP, cidr uint) bool {
+			fn(net.IPNet{IP: append(net.IP(nil), ip...), Mask: net.CIDRMask(int(cidr), 8*len(ip))}, peer)
+			return true
+		})
+	}
+}
+
+// allowedIPOwnerLocked returns the peer that has exactly ipnet as an
+// allowed IP, or nil. ipnet must be normalized. The caller must hold
+// device.peers.RLock.
+func (device *Device) allowedIPOwnerLocked(ipnet net.IPNet) *Peer {
+	ones, _ := ipnet.Mask.Size()
+	for _, peer := range device.peers.keyMap {
+		var found bool
+		device.allowedips.EntriesForPeer(peer, func(ip net.IP, cidr uint) bool {
+			found = cidr == uint(ones) && bytes.Equal(ip, ipnet.IP)
+			return !found
+		})
+		if found {
+			return peer
+		}
+	}
+	return nil
+}
+
+// Validate reports an error if cfg cannot be applied to a device,
+// such as when it has no private key or two peers share a public key.
+// It does not touch the network, so it cannot tell whether ListenPort is
+// available; every uint16 port is acceptable.
+func (cfg *Config) Validate() error {
+	if cfg.PrivateKey.IsZero() {
+		return errors.New("no private key")
+	}
+	return validatePeers(cfg.Peers)
+}
+
+// ValidateConfig reports the first error that applying cfg to the device
+// would run into, without changing anything: besides the checks of
+// cfg.Validate, endpoints must be accepted by the device's bind and
+// endpoint allowlist, allowed IPs must be valid and no two peers may have
+// the same one, and no peer may have the public key of cfg.PrivateKey.
+// Checking first lets an application refuse a configuration as a whole
+// instead of leaving it half-applied.
+func (device *Device) ValidateConfig(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if len(cfg.Peers) > MaxPeers {
+		return fmt.Errorf("too many peers: %d, maximum %d", len(cfg.Peers), MaxPeers)
+	}
+	self := cfg.PrivateKey.publicKey()
+	owners := make(map[string]NoisePublicKey)
+	for _, pc := range cfg.Peers {
+		key, _ := pc.PublicKey.MarshalText()
+		if pc.PublicKey.Equals(self) {
+			return fmt.Errorf("peer %s: %w", key, ErrPeerIsSelf)
+		}
+		_, allowedIPs, err := device.parsePeerConfig(pc)
+		if err != nil {
+			return fmt.Errorf("peer %s: %w", key, err)
+		}
+		for _, ipnet := range allowedIPs {
+			if owner, ok := owners[ipnet.String()]; ok && owner != pc.PublicKey {
+				ownerKey, _ := owner.MarshalText()
+				return fmt.Errorf("peer %s: allowed IP %v already belongs to peer %s", key, ipnet.String(), ownerKey)
+			}
+			owners[ipnet.String()] = pc.PublicKey
+		}
+	}
+	return nil
+}
+
+// validatePeers reports an error if two of peers share a public key.
+func validatePeers(peers []PeerConfig) error {
+	seen := make(map[NoisePublicKey]bool, len(peers))
+	for _, pc := range peers {
+		if seen[pc.PublicKey] {
+			key, _ := pc.PublicKey.MarshalText()
+			return fmt.Errorf("duplicate peer public key %s", key)
+		}
+		seen[pc.PublicKey] = true
+	}
+	return nil
+}
+
+// config returns the configuration of peer.
+// The caller must hold device.peers.RLock.
+func (peer *Peer) config() PeerConfig {
+	pc := PeerConfig{
+		PublicKey:           peer.handshake.remoteStatic,
+		PersistentKeepalive: uint16(atomic.LoadUint32(&peer.persistentKeepaliveInterval)),
+	}
+
+	peer.handshake.mutex.RLock()
+	pc.PresharedKey = peer.handshake.presharedKey
+	peer.handshake.mutex.RUnlock()
+
+	peer.RLock()
+	if peer.endpoint != nil {
+		pc.Endpoint = peer.endpoint.DstToString()
+	}
+	pc.ProtocolVersion = peer.protocolVersion
+	pc.Origin = peer.origin
+	peer.RUnlock()
+
+	peer.device.allowedips.EntriesForPeer(peer, func(ip net.IP, cidr uint) bool {
+		bits := 8 * len(ip)
+		pc.AllowedIPs = append(pc.AllowedIPs, net.IPNet{
+			IP:   append(net.IP(nil), ip...),
+			Mask: net.CIDRMask(int(cidr), bits),
+		})
+		return true
+	})
+	return pc
+}
@@ -0,0 +1,562 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestConfigSnapshot(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+
+	cfg := dev.Config()
+	if !cfg.PrivateKey.Equals(dev.staticIdentity.privateKey) {
+		t.Errorf("private key mismatch")
+	}
+	if cfg.ListenPort != dev.net.port {
+		t.Errorf("listen port = %d; want %d", cfg.ListenPort, dev.net.port)
+	}
+	if len(cfg.Peers) != 1 {
+		t.Fatalf("got %d peers; want 1", len(cfg.Peers))
+	}
+	pc := cfg.Peers[0]
+	if !pc.PublicKey.Equals(pair[1].dev.staticIdentity.publicKey) {
+		t.Errorf("peer public key mismatch")
+	}
+	if pc.Endpoint == "" {
+		t.Errorf("peer endpoint is empty")
+	}
+	if len(pc.AllowedIPs) != 1 || pc.AllowedIPs[0].String() != "1.0.0.2/32" {
+		t.Errorf("allowed ips = %v; want [1.0.0.2/32]", pc.AllowedIPs)
+	}
+	if pc.ProtocolVersion != 1 {
+		t.Errorf("protocol version = %d; want 1", pc.ProtocolVersion)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	sk1, _ := newPrivateKey()
+	sk2, _ := newPrivateKey()
+	cfg := Config{Peers: []PeerConfig{
+		{PublicKey: sk1.publicKey()},
+		{PublicKey: sk2.publicKey()},
+	}}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("config without private key accepted")
+	}
+	cfg.PrivateKey = sk1
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("valid config rejected: %v", err)
+	}
+
+	cfg.Peers = append(cfg.Peers, PeerConfig{PublicKey: sk1.publicKey()})
+	err := cfg.Validate()
+	key, _ := sk1.publicKey().MarshalText()
+	if err == nil || !strings.Contains(err.Error(), string(key)) {
+		t.Errorf("duplicate key error = %v; want it to name %s", err, key)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, _ := newPrivateKey()
+	sk1, _ := newPrivateKey()
+	sk2, _ := newPrivateKey()
+	cidr := func(s string) net.IPNet {
+		_, ipnet, _ := net.ParseCIDR(s)
+		return *ipnet
+	}
+	valid := func() *Config {
+		return &Config{PrivateKey: sk, Peers: []PeerConfig{
+			{PublicKey: sk1.publicKey(), Endpoint: "192.0.2.1:51820", AllowedIPs: []net.IPNet{cidr("10.0.0.0/8")}},
+			{PublicKey: sk2.publicKey(), AllowedIPs: []net.IPNet{cidr("10.1.0.0/16")}},
+		}}
+	}
+	if err := dev.ValidateConfig(valid()); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+	}{
+		{"no private key", func(cfg *Config) { cfg.PrivateKey = NoisePrivateKey{} }},
+		{"peer is self", func(cfg *Config) { cfg.Peers[1].PublicKey = sk.publicKey() }},
+		{"bad endpoint", func(cfg *Config) { cfg.Peers[0].Endpoint = "192.0.2.1" }},
+		{"bad allowed IP", func(cfg *Config) { cfg.Peers[1].AllowedIPs[0].Mask = net.IPMask{0xff, 0, 0xff, 0} }},
+		{"shared allowed IP", func(cfg *Config) { cfg.Peers[1].AllowedIPs[0] = cidr("10.0.0.0/8") }},
+		{"bad protocol version", func(cfg *Config) { cfg.Peers[0].ProtocolVersion = 2 }},
+	}
+	for _, tt := range tests {
+		cfg := valid()
+		tt.modify(cfg)
+		if err := dev.ValidateConfig(cfg); err == nil {
+			t.Errorf("%s: config accepted", tt.name)
+		}
+	}
+	if n := len(dev.Config().Peers); n != 0 {
+		t.Errorf("ValidateConfig added %d peers", n)
+	}
+}
+
+func TestAddPeer(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var psk NoisePresharedKey
+	psk[0] = 1
+	want := PeerConfig{
+		PublicKey:           sk.publicKey(),
+		PresharedKey:        psk,
+		Endpoint:            "192.0.2.1:51820",
+		PersistentKeepalive: 25,
+		AllowedIPs: []net.IPNet{
+			{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+			{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(64, 128)},
+		},
+	}
+	peer, err := dev.AddPeer(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.PublicKey() != want.PublicKey {
+		t.Errorf("PublicKey = %v; want %v", peer.PublicKey(), want.PublicKey)
+	}
+	dev.peers.RLock()
+	got := peer.config()
+	dev.peers.RUnlock()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("peer config mismatch:\n got %+v\nwant %+v", got, want)
+	}
+
+	if _, err := dev.AddPeer(want); err == nil {
+		t.Errorf("AddPeer accepted a duplicate peer")
+	}
+
+	sk, _ = newPrivateKey()
+	bad := PeerConfig{
+		PublicKey:  sk.publicKey(),
+		AllowedIPs: []net.IPNet{{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(8, 32)}},
+	}
+	if _, err := dev.AddPeer(bad); err == nil {
+		t.Errorf("AddPeer accepted a mismatched allowed IP")
+	}
+	if dev.LookupPeer(bad.PublicKey) != nil {
+		t.Errorf("failed AddPeer left a peer behind")
+	}
+
+	bad = PeerConfig{PublicKey: sk.publicKey(), ProtocolVersion: 2}
+	if _, err := dev.AddPeer(bad); err == nil {
+		t.Errorf("AddPeer accepted protocol version 2")
+	}
+
+	if _, err := dev.AddPeer(PeerConfig{PublicKey: dev.PublicKey()}); !errors.Is(err, ErrPeerIsSelf) {
+		t.Errorf("AddPeer with the device's own key: err = %v; want %v", err, ErrPeerIsSelf)
+	}
+}
+
+func TestSetPeers(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+
+	existing := dev.Config().Peers[0]
+	peer := dev.LookupPeer(existing.PublicKey)
+	keypair := peer.keypairs.Current()
+
+	sk, _ := newPrivateKey()
+	added := PeerConfig{
+		PublicKey:  sk.publicKey(),
+		AllowedIPs: []net.IPNet{{IP: net.IPv4(10, 9, 0, 0).To4(), Mask: net.CIDRMask(16, 32)}},
+	}
+	if err := dev.SetPeers([]PeerConfig{existing, added}); err != nil {
+		t.Fatal(err)
+	}
+	if dev.LookupPeer(existing.PublicKey) != peer || peer.keypairs.Current() != keypair {
+		t.Errorf("unchanged peer was disturbed")
+	}
+	if dev.LookupPeer(added.PublicKey) == nil {
+		t.Errorf("new peer was not added")
+	}
+	pair.Send(t, Ping, nil)
+
+	added.AllowedIPs[0].Mask = net.CIDRMask(24, 32)
+	added.PersistentKeepalive = 10
+	if err := dev.SetPeers([]PeerConfig{added}); err != nil {
+		t.Fatal(err)
+	}
+	if dev.LookupPeer(existing.PublicKey) != nil {
+		t.Errorf("unlisted peer was not removed")
+	}
+	cfg := dev.Config()
+	if len(cfg.Peers) != 1 || !reflect.DeepEqual(cfg.Peers[0], added) {
+		t.Errorf("peers = %+v; want [%+v]", cfg.Peers, added)
+	}
+
+	if err := dev.SetPeers([]PeerConfig{added, added}); err == nil {
+		t.Errorf("duplicate peers accepted")
+	}
+	if len(dev.Config().Peers) != 1 {
+		t.Errorf("failed SetPeers changed the peer set")
+	}
+
+	// A peer failing only once it is added rolls back the peers added
+	// before it, and removes none.
+	sk2, _ := newPrivateKey()
+	other := PeerConfig{PublicKey: sk2.publicKey()}
+	self := PeerConfig{PublicKey: dev.PublicKey()}
+	if err := dev.SetPeers([]PeerConfig{other, self}); !errors.Is(err, ErrPeerIsSelf) {
+		t.Errorf("SetPeers with the device's own key: err = %v; want ErrPeerIsSelf", err)
+	}
+	if dev.LookupPeer(other.PublicKey) != nil || dev.LookupPeer(added.PublicKey) == nil {
+		t.Errorf("failed SetPeers was not rolled back: peers = %+v", dev.Config().Peers)
+	}
+}
+
+func TestAddRemoveAllowedIP(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk1, _ := newPrivateKey()
+	sk2, _ := newPrivateKey()
+	a, err := dev.AddPeer(PeerConfig{PublicKey: sk1.publicKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := dev.AddPeer(PeerConfig{PublicKey: sk2.publicKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wide := net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}
+	narrow := net.IPNet{IP: net.IPv4(10, 1, 0, 0), Mask: net.CIDRMask(16, 32)}
+
+	if err := a.AddAllowedIP(wide); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddAllowedIP(wide); err == nil {
+		t.Errorf("AddAllowedIP took a prefix owned by another peer")
+	}
+	if err := b.AddAllowedIP(narrow); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.allowedips.LookupIPv4(net.IPv4(10, 1, 2, 3).To4()); got != b {
+		t.Errorf("10.1.2.3 routed to %v; want %v", got, b)
+	}
+	if got := dev.allowedips.LookupIPv4(net.IPv4(10, 2, 2, 3).To4()); got != a {
+		t.Errorf("10.2.2.3 routed to %v; want %v", got, a)
+	}
+
+	if err := a.RemoveAllowedIP(narrow); err == nil {
+		t.Errorf("RemoveAllowedIP removed another peer's prefix")
+	}
+	if err := b.RemoveAllowedIP(narrow); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.allowedips.LookupIPv4(net.IPv4(10, 1, 2, 3).To4()); got != a {
+		t.Errorf("after removal, 10.1.2.3 routed to %v; want %v", got, a)
+	}
+	if err := a.RemoveAllowedIP(wide); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.allowedips.LookupIPv4(net.IPv4(10, 2, 2, 3).To4()); got != nil {
+		t.Errorf("after removal, 10.2.2.3 routed to %v; want none", got)
+	}
+
+	b.Close()
+	if err := b.AddAllowedIP(narrow); !errors.Is(err, ErrPeerClosed) {
+		t.Errorf("AddAllowedIP on a removed peer: err = %v; want ErrPeerClosed", err)
+	}
+	if got := dev.allowedips.LookupIPv4(net.IPv4(10, 1, 2, 3).To4()); got != nil {
+		t.Errorf("removed peer's prefix routed to %v", got)
+	}
+}
+
+func TestForEachAllowedIP(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk1, _ := newPrivateKey()
+	sk2, _ := newPrivateKey()
+	want := map[string]NoisePublicKey{
+		"10.0.0.0/8":  sk1.publicKey(),
+		"fd00::/64":   sk1.publicKey(),
+		"10.1.0.0/16": sk2.publicKey(),
+	}
+	for prefix, pk := range want {
+		peer := dev.LookupPeer(pk)
+		if peer == nil {
+			var err error
+			if peer, err = dev.AddPeer(PeerConfig{PublicKey: pk}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, ipnet, _ := net.ParseCIDR(prefix)
+		if err := peer.AddAllowedIP(*ipnet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make(map[string]NoisePublicKey)
+	dev.ForEachAllowedIP(func(ipnet net.IPNet, peer *Peer) {
+		got[ipnet.String()] = peer.PublicKey()
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("allowed IPs = %v; want %v", got, want)
+	}
+}
+
+func TestPeerOrigin(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk1, _ := newPrivateKey()
+	sk2, _ := newPrivateKey()
+	static := PeerConfig{PublicKey: sk1.publicKey()}
+	dynamic := PeerConfig{PublicKey: sk2.publicKey(), Origin: PeerOriginDynamic}
+	for _, pc := range []PeerConfig{static, dynamic} {
+		if _, err := dev.AddPeer(pc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := dev.LookupPeer(static.PublicKey).Origin(); got != PeerOriginConfig {
+		t.Errorf("static peer origin = %v; want %v", got, PeerOriginConfig)
+	}
+	if got := dev.LookupPeer(dynamic.PublicKey).Origin(); got != PeerOriginDynamic {
+		t.Errorf("dynamic peer origin = %v; want %v", got, PeerOriginDynamic)
+	}
+
+	if err := dev.SetPeers(nil); err != nil {
+		t.Fatal(err)
+	}
+	if dev.LookupPeer(static.PublicKey) != nil {
+		t.Errorf("SetPeers kept an unlisted config peer")
+	}
+	if dev.LookupPeer(dynamic.PublicKey) == nil {
+		t.Errorf("SetPeers removed a dynamic peer")
+	}
+
+	// Listing a dynamic peer in SetPeers adopts it into the configuration.
+	dynamic.Origin = PeerOriginConfig
+	if err := dev.SetPeers([]PeerConfig{dynamic}); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.LookupPeer(dynamic.PublicKey).Origin(); got != PeerOriginConfig {
+		t.Errorf("adopted peer origin = %v; want %v", got, PeerOriginConfig)
+	}
+}
+
+func TestKeyJSONRoundTrip(t *testing.T) {
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var psk NoisePresharedKey
+	psk[0] = 0x42
+
+	want := Config{
+		PrivateKey: sk,
+		ListenPort: 51820,
+		Peers: []PeerConfig{{
+			PublicKey:    sk.publicKey(),
+			PresharedKey: psk,
+			Endpoint:     "192.0.2.1:51820",
+		}},
+	}
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := want.Peers[0].PublicKey.MarshalText()
+	if !strings.Contains(string(b), `"PublicKey":"`+string(pub)+`"`) {
+		t.Errorf("public key not base64 encoded: %s", b)
+	}
+
+	var got Config
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip mismatch:\n got %+v\nwant %+v", got, want)
+	}
+
+	if s := fmt.Sprint(sk, psk); s != "(redacted) (redacted)" {
+		t.Errorf("secret keys not redacted: %s", s)
+	}
+
+	var pk NoisePublicKey
+	if err := pk.UnmarshalText([]byte("AAAA")); err == nil {
+		t.Errorf("short key accepted")
+	}
+}
+
+func TestEndpointAllowlist(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	_, allowed, _ := net.ParseCIDR("192.0.2.0/24")
+	dev.SetEndpointAllowlist([]net.IPNet{*allowed})
+
+	newKey := func() NoisePublicKey {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sk.publicKey()
+	}
+	_, err := dev.AddPeer(PeerConfig{PublicKey: newKey(), Endpoint: "198.51.100.1:51820"})
+	if !errors.Is(err, ErrEndpointNotAllowed) {
+		t.Errorf("AddPeer with disallowed endpoint: got %v; want ErrEndpointNotAllowed", err)
+	}
+	peer, err := dev.AddPeer(PeerConfig{PublicKey: newKey(), Endpoint: "192.0.2.1:51820"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pk := peer.handshake.remoteStatic
+	cfg := uapiCfg("public_key", hex.EncodeToString(pk[:]), "endpoint", "198.51.100.1:51820")
+	if err := dev.IpcSet(cfg); err == nil {
+		t.Errorf("UAPI accepted a disallowed endpoint")
+	}
+
+	roamed, err := dev.net.bind.ParseEndpoint("198.51.100.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.SetEndpointFromPacket(roamed)
+	if got, _ := peer.Endpoint(); got != "192.0.2.1:51820" {
+		t.Errorf("peer roamed to disallowed endpoint %q", got)
+	}
+
+	_, other, _ := net.ParseCIDR("203.0.113.0/24")
+	dev.SetEndpointAllowlist([]net.IPNet{*other})
+	if err := peer.SendBuffer([]byte{0}); !errors.Is(err, ErrEndpointNotAllowed) {
+		t.Errorf("SendBuffer to endpoint outside allowlist: got %v; want ErrEndpointNotAllowed", err)
+	}
+	dev.SetEndpointAllowlist(nil)
+	peer.SetEndpointFromPacket(roamed)
+	if got, _ := peer.Endpoint(); got != "198.51.100.1:51820" {
+		t.Errorf("peer did not roam after allowlist was lifted: %q", got)
+	}
+
+	// A packet from the same address leaves the endpoint alone.
+	again, err := dev.net.bind.ParseEndpoint("198.51.100.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.SetEndpointFromPacket(again)
+	peer.RLock()
+	replaced := peer.endpoint != roamed
+	peer.RUnlock()
+	if replaced {
+		t.Errorf("endpoint replaced by an identical one")
+	}
+}
+
+func TestProtocolVersionRetained(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	pub := hex.EncodeToString(pk[:])
+
+	version := func() int {
+		peers := dev.Config().Peers
+		if len(peers) != 1 {
+			t.Fatalf("%d peers configured; want 1", len(peers))
+		}
+		return peers[0].ProtocolVersion
+	}
+	if err := dev.IpcSet(uapiCfg("public_key", pub)); err != nil {
+		t.Fatal(err)
+	}
+	if got := version(); got != 0 {
+		t.Errorf("protocol version = %d without one configured; want 0", got)
+	}
+	if err := dev.IpcSet(uapiCfg("public_key", pub, "protocol_version", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.IpcSet(uapiCfg("public_key", pub, "persistent_keepalive_interval", "25")); err != nil {
+		t.Fatal(err)
+	}
+	if got := version(); got != CurrentProtocolVersion {
+		t.Errorf("protocol version = %d after a later set; want %d", got, CurrentProtocolVersion)
+	}
+	if err := dev.IpcSet(uapiCfg("public_key", pub, "protocol_version", "2")); err == nil {
+		t.Errorf("UAPI accepted protocol version 2")
+	}
+	if got := version(); got != CurrentProtocolVersion {
+		t.Errorf("protocol version = %d after a rejected set; want %d", got, CurrentProtocolVersion)
+	}
+}
+
+// fakeResolver resolves every host name to ips, counting lookups.
+type fakeResolver struct {
+	lookups int
+	ips     []net.IP
+}
+
+func (r *fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.lookups++
+	if strings.HasSuffix(host, ".invalid") {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return r.ips, nil
+}
+
+func TestEndpointHostName(t *testing.T) {
+	resolver := &fakeResolver{ips: []net.IP{net.IPv4(192, 0, 2, 1)}}
+	dev, err := NewDeviceWithOptions(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, ""), DeviceOptions{Resolver: resolver})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	newKey := func() NoisePublicKey {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sk.publicKey()
+	}
+
+	peer, err := dev.AddPeer(PeerConfig{PublicKey: newKey(), Endpoint: "vpn.example.com:51820"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := peer.Endpoint(); got != "192.0.2.1:51820" {
+		t.Errorf("endpoint = %q; want 192.0.2.1:51820", got)
+	}
+	if _, err := dev.AddPeer(PeerConfig{PublicKey: newKey(), Endpoint: "vpn.invalid:51820"}); err == nil {
+		t.Errorf("AddPeer accepted an endpoint that does not resolve")
+	}
+
+	// Addresses are not looked up.
+	lookups := resolver.lookups
+	if _, err := dev.AddPeer(PeerConfig{PublicKey: newKey(), Endpoint: "[fe80::1%lo]:51820"}); err != nil {
+		t.Fatal(err)
+	}
+	if resolver.lookups != lookups {
+		t.Errorf("endpoint address looked up")
+	}
+}
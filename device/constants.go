@@ -32,9 +32,32 @@ const (
 	MaxContentSize = MaxSegmentSize - MessageTransportSize // maximum size of transport message content
 )
 
+// CurrentProtocolVersion is the only WireGuard protocol version supported.
+const CurrentProtocolVersion = 1
+
 /* Implementation constants */
 
 const (
-	UnderLoadAfterTime = time.Second // how long does the device remain under load after detected
-	MaxPeers           = 1 << 16     // maximum number of configured peers
+	UnderLoadAfterTime   = time.Second  // how long does the device remain under load after detected
+	MaxPeers             = 1 << 16      // maximum number of configured peers
+	MinUnprivilegedPort  = 1024         // ports below are privileged, see SetRejectPrivilegedPorts
+	MinCookieRefreshTime = RekeyTimeout // minimum configurable cookie secret rotation interval
+
+	MaxKeepaliveJitterPercent = 50  // maximum configurable persistent keepalive jitter
+	MaxJunkPackets            = 128 // maximum junk packets sent before a handshake initiation
+
+	KeypairExpiringNotice = RekeyTimeout * 6 // how long before RejectAfterTime the keypair expiring callback runs
+
+	DefaultSendRetries      = 3                     // times a packet is resent after a transient send error
+	DefaultSendRetryBackoff = time.Millisecond      // wait before the first resend, doubled for each further one
+	MaxSendRetries          = 10                    // maximum configurable send retries
+	MaxSendRetryBackoff     = 10 * time.Millisecond // maximum wait before a resend
+
+	SourcePortRotationInterval = 30 * time.Second // minimum time between source port rotations, see SetSourcePortRotation
+
+	EventQueueSize = 256 // events buffered by Device.Events before the oldest are dropped
+
+	RateLimitBurstTime = 100 * time.Millisecond // how far traffic may run ahead of Peer.SetRateLimit
 )
+
+const waitIdlePollInterval = 10 * time.Millisecond // how often WaitIdle checks the peer queues
@@ -23,8 +23,11 @@ type CookieChecker struct {
 	mac2 struct {
 		secret        [blake2s.Size]byte
 		secretSet     time.Time
+		secretRefresh time.Duration // rotation interval of secret, 0 = CookieRefreshTime
 		encryptionKey [chacha20poly1305.KeySize]byte
 	}
+
+	clock func() time.Time // source of the current time, nil = time.Now
 }
 
 type CookieGenerator struct {
@@ -39,6 +42,8 @@ type CookieGenerator struct {
 		lastMAC1      [blake2s.Size128]byte
 		encryptionKey [chacha20poly1305.KeySize]byte
 	}
+
+	clock func() time.Time // source of the current time, nil = time.Now
 }
 
 func (st *CookieChecker) Init(pk NoisePublicKey) {
@@ -66,6 +71,42 @@ func (st *CookieChecker) Init(pk NoisePublicKey) {
 	st.mac2.secretSet = time.Time{}
 }
 
+// SetRefreshTime sets the interval after which the secret used
+// to derive cookies is rotated. Zero selects CookieRefreshTime.
+func (st *CookieChecker) SetRefreshTime(d time.Duration) {
+	st.Lock()
+	defer st.Unlock()
+	st.mac2.secretRefresh = d
+}
+
+// SetClock makes st read the current time from now instead of time.Now,
+// so that tests can move it across secret rotations. A nil now restores
+// time.Now.
+func (st *CookieChecker) SetClock(now func() time.Time) {
+	st.Lock()
+	defer st.Unlock()
+	st.clock = now
+}
+
+// clockNow returns the current time according to clock, or time.Now if
+// clock is nil.
+func clockNow(clock func() time.Time) time.Time {
+	if clock != nil {
+		return clock()
+	}
+	return time.Now()
+}
+
+// secretExpired reports whether the cookie secret is due for rotation.
+// The caller must hold st.RLock.
+func (st *CookieChecker) secretExpired() bool {
+	refresh := st.mac2.secretRefresh
+	if refresh == 0 {
+		refresh = CookieRefreshTime
+	}
+	return clockNow(st.clock).Sub(st.mac2.secretSet) > refresh
+}
+
 func (st *CookieChecker) CheckMAC1(msg []byte) bool {
 	st.RLock()
 	defer st.RUnlock()
@@ -87,7 +128,7 @@ func (st *CookieChecker) CheckMAC2(msg []byte, src []byte) bool {
 	st.RLock()
 	defer st.RUnlock()
 
-	if time.Since(st.mac2.secretSet) > CookieRefreshTime {
+	if st.secretExpired() {
 		return false
 	}
 
@@ -124,7 +165,7 @@ func (st *CookieChecker) CreateReply(
 
 	// refresh cookie secret
 
-	if time.Since(st.mac2.secretSet) > CookieRefreshTime {
+	if st.secretExpired() {
 		st.RUnlock()
 		st.Lock()
 		_, err := rand.Read(st.mac2.secret[:])
@@ -132,7 +173,7 @@ func (st *CookieChecker) CreateReply(
 			st.Unlock()
 			return nil, err
 		}
-		st.mac2.secretSet = time.Now()
+		st.mac2.secretSet = clockNow(st.clock)
 		st.Unlock()
 		st.RLock()
 	}
@@ -192,6 +233,15 @@ func (st *CookieGenerator) Init(pk NoisePublicKey) {
 	st.mac2.cookieSet = time.Time{}
 }
 
+// SetClock makes st read the current time from now instead of time.Now,
+// so that tests can expire the cookies it holds. A nil now restores
+// time.Now.
+func (st *CookieGenerator) SetClock(now func() time.Time) {
+	st.Lock()
+	defer st.Unlock()
+	st.clock = now
+}
+
 func (st *CookieGenerator) ConsumeReply(msg *MessageCookieReply) bool {
 	st.Lock()
 	defer st.Unlock()
@@ -209,11 +259,19 @@ func (st *CookieGenerator) ConsumeReply(msg *MessageCookieReply) bool {
 		return false
 	}
 
-	st.mac2.cookieSet = time.Now()
+	st.mac2.cookieSet = clockNow(st.clock)
 	st.mac2.cookie = cookie
 	return true
 }
 
+// HasCookie reports whether st holds a cookie received from the remote
+// that is still fresh enough to be included as mac2 in outgoing messages.
+func (st *CookieGenerator) HasCookie() bool {
+	st.RLock()
+	defer st.RUnlock()
+	return clockNow(st.clock).Sub(st.mac2.cookieSet) <= CookieRefreshTime
+}
+
 func (st *CookieGenerator) AddMacs(msg []byte) {
 
 	size := len(msg)
@@ -239,7 +297,7 @@ func (st *CookieGenerator) AddMacs(msg []byte) {
 
 	// set mac2
 
-	if time.Since(st.mac2.cookieSet) > CookieRefreshTime {
+	if clockNow(st.clock).Sub(st.mac2.cookieSet) > CookieRefreshTime {
 		return
 	}
 
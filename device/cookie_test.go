@@ -6,7 +6,14 @@
 package device
 
 import (
+	"bytes"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
 )
 
 func TestCookieMAC1(t *testing.T) {
@@ -104,9 +111,15 @@ func TestCookieMAC1(t *testing.T) {
 		if err != nil {
 			t.Fatal("Failed to create cookie reply:", err)
 		}
+		if generator.HasCookie() {
+			t.Fatal("Generator has a cookie before consuming a reply")
+		}
 		if !generator.ConsumeReply(reply) {
 			t.Fatal("Failed to consume cookie reply")
 		}
+		if !generator.HasCookie() {
+			t.Fatal("Generator has no cookie after consuming a reply")
+		}
 	}()
 
 	// check mac2
@@ -189,3 +202,145 @@ func TestCookieMAC1(t *testing.T) {
 		0x7d, 0xa1, 0xd5, 0x85, 0x6d, 0xf0, 0x1b, 0xaa,
 	})
 }
+
+func TestCookieClock(t *testing.T) {
+	var (
+		generator CookieGenerator
+		checker   CookieChecker
+	)
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	generator.Init(pk)
+	checker.Init(pk)
+	now := time.Unix(1600000000, 0)
+	clock := func() time.Time { return now }
+	generator.SetClock(clock)
+	checker.SetClock(clock)
+
+	src := []byte{192, 168, 13, 37, 10, 10, 10}
+	msg := make([]byte, 64)
+	generator.AddMacs(msg)
+	reply, err := checker.CreateReply(msg, 1377, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !generator.ConsumeReply(reply) {
+		t.Fatal("failed to consume cookie reply")
+	}
+	generator.AddMacs(msg)
+	if !checker.CheckMAC2(msg, src) {
+		t.Fatal("MAC2 rejected right after the cookie was issued")
+	}
+
+	now = now.Add(CookieRefreshTime - time.Second)
+	if !generator.HasCookie() || !checker.CheckMAC2(msg, src) {
+		t.Errorf("cookie expired before CookieRefreshTime")
+	}
+	now = now.Add(2 * time.Second)
+	if generator.HasCookie() {
+		t.Errorf("generator still has a cookie after CookieRefreshTime")
+	}
+	if checker.CheckMAC2(msg, src) {
+		t.Errorf("MAC2 accepted after the secret was due for rotation")
+	}
+}
+
+func TestDeviceCookieClock(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	now := time.Unix(1600000000, 0)
+	dev.SetCookieClock(func() time.Time { return now })
+
+	atomic.StoreInt64(&dev.rate.underLoadUntil, now.Add(UnderLoadAfterTime).UnixNano())
+	if !dev.IsUnderLoad() {
+		t.Errorf("not under load within UnderLoadAfterTime")
+	}
+	now = now.Add(UnderLoadAfterTime + time.Second)
+	if dev.IsUnderLoad() {
+		t.Errorf("still under load after UnderLoadAfterTime")
+	}
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.cookieGenerator.RLock()
+	hasClock := peer.cookieGenerator.clock != nil
+	peer.cookieGenerator.RUnlock()
+	if !hasClock {
+		t.Errorf("new peer does not use the cookie clock")
+	}
+}
+
+func TestCookieRefreshTime(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	if err := dev.SetCookieRefreshTime(MinCookieRefreshTime - time.Second); err == nil {
+		t.Errorf("cookie refresh time below the minimum accepted")
+	}
+	if err := dev.SetCookieRefreshTime(MinCookieRefreshTime); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1600000000, 0)
+	dev.SetCookieClock(func() time.Time { return now })
+	checker := &dev.cookieChecker
+	src := []byte{192, 168, 13, 37, 10, 10, 10}
+	msg := make([]byte, 64)
+	var generator CookieGenerator
+	generator.Init(dev.staticIdentity.publicKey)
+	generator.AddMacs(msg)
+	reply, err := checker.CreateReply(msg, 1377, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !generator.ConsumeReply(reply) {
+		t.Fatal("failed to consume cookie reply")
+	}
+	generator.AddMacs(msg)
+
+	now = now.Add(MinCookieRefreshTime - time.Second)
+	if !checker.CheckMAC2(msg, src) {
+		t.Errorf("MAC2 rejected before the refresh time")
+	}
+	now = now.Add(2 * time.Second)
+	if checker.CheckMAC2(msg, src) {
+		t.Errorf("MAC2 accepted after the refresh time of %v", MinCookieRefreshTime)
+	}
+}
+
+func TestCookieEcho(t *testing.T) {
+	pair := genTestPair(t, false)
+	var peer *Peer
+	for _, p := range pair[1].dev.peers.keyMap {
+		peer = p
+	}
+	if peer.UnderCookieLoad() {
+		t.Fatal("peer under cookie load before any handshake")
+	}
+
+	// pair[0] answers the initiation of pair[1] with a cookie reply.
+	atomic.StoreInt64(&pair[0].dev.rate.underLoadUntil, time.Now().Add(time.Hour).UnixNano())
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	deadline := time.Now().Add(5 * time.Second)
+	for !peer.UnderCookieLoad() {
+		if time.Now().After(deadline) {
+			t.Fatal("peer not under cookie load after a cookie reply")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Further handshake messages echo the cookie as mac2.
+	msg := make([]byte, MessageInitiationSize)
+	peer.cookieGenerator.AddMacs(msg)
+	if bytes.Equal(msg[len(msg)-blake2s.Size128:], make([]byte, blake2s.Size128)) {
+		t.Errorf("handshake message does not echo the cookie")
+	}
+}
@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+// CryptoInfo describes the cryptography a device uses, for audits.
+type CryptoInfo struct {
+	Construction    string // Noise protocol name, NoiseConstruction
+	Identifier      string // protocol identifier mixed into the handshake, WGIdentifier
+	ProtocolVersion int    // CurrentProtocolVersion
+
+	KeyExchange string // "Curve25519"
+	Cipher      string // AEAD of handshakes and transport data, "ChaCha20Poly1305"
+	Hash        string // "BLAKE2s"
+	CookieAEAD  string // AEAD of cookie replies, "XChaCha20Poly1305"
+
+	// PresharedKeyPeers is the number of peers that mix a preshared key
+	// into their handshakes, out of Peers.
+	PresharedKeyPeers int
+	Peers             int
+
+	// Experimental lists the experimental features in use that change
+	// what the device sends on the wire, such as "junk-packets" when a peer
+	// sends junk packets before handshake initiations and
+	// "source-port-rotation"; it is empty if none are.
+	Experimental []string
+}
+
+// CryptoInfo returns the cryptography the device uses. The handshake and
+// ciphers are fixed by the protocol version; the rest reflects the current
+// configuration of the device and its peers.
+func (device *Device) CryptoInfo() CryptoInfo {
+	info := CryptoInfo{
+		Construction:    NoiseConstruction,
+		Identifier:      WGIdentifier,
+		ProtocolVersion: CurrentProtocolVersion,
+		KeyExchange:     "Curve25519",
+		Cipher:          "ChaCha20Poly1305",
+		Hash:            "BLAKE2s",
+		CookieAEAD:      "XChaCha20Poly1305",
+	}
+
+	var junk bool
+	device.peers.RLock()
+	info.Peers = len(device.peers.keyMap)
+	for _, peer := range device.peers.keyMap {
+		peer.handshake.mutex.RLock()
+		if !isZero(peer.handshake.presharedKey[:]) {
+			info.PresharedKeyPeers++
+		}
+		peer.handshake.mutex.RUnlock()
+		peer.RLock()
+		junk = junk || peer.junk.count > 0
+		peer.RUnlock()
+	}
+	device.peers.RUnlock()
+
+	if junk {
+		info.Experimental = append(info.Experimental, "junk-packets")
+	}
+	if device.net.rotatePort.Get() {
+		info.Experimental = append(info.Experimental, "source-port-rotation")
+	}
+	return info
+}
@@ -6,6 +6,11 @@
 package device
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -13,6 +18,7 @@ import (
 
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/ratelimiter"
+	"golang.zx2c4.com/wireguard/replay"
 	"golang.zx2c4.com/wireguard/rwcancel"
 	"golang.zx2c4.com/wireguard/tun"
 )
@@ -35,6 +41,8 @@ type Device struct {
 		stopping sync.WaitGroup
 		// mu protects state changes.
 		sync.Mutex
+		// paused is set between Pause and Resume.
+		paused AtomicBool
 	}
 
 	net struct {
@@ -42,8 +50,15 @@ type Device struct {
 		sync.RWMutex
 		bind          conn.Bind // bind interface
 		netlinkCancel *rwcancel.RWCancel
-		port          uint16 // listening port
-		fwmark        uint32 // mark value (0 = disabled)
+		port          uint16        // listening port
+		fwmark        uint32        // mark value (0 = disabled)
+		dscp          uint8         // DSCP value of outgoing packets (0 = unchanged)
+		openTimeout   time.Duration // bound on bind.Open (0 = unbounded)
+		rotatePort    AtomicBool    // see SetSourcePortRotation
+		rotating      AtomicBool    // a port rotation is in progress
+		rotatedAt     time.Time     // start of the last port rotation, owned by whoever sets rotating
+		sendRetries   int           // resends after a transient send error, see SetSendRetries
+		sendBackoff   time.Duration // wait before the first resend
 	}
 
 	staticIdentity struct {
@@ -57,12 +72,15 @@ type Device struct {
 		limiter        ratelimiter.Ratelimiter
 	}
 
+	drops InboundDrops // accessed atomically
+
 	peers struct {
 		sync.RWMutex // protects keyMap
 		keyMap       map[NoisePublicKey]*Peer
 	}
 
-	allowedips    AllowedIPs
+	allowedips    AllowedIPsTable
+	sourceTable   AllowedIPsSourceTable // allowedips, if it checks sources itself
 	indexTable    IndexTable
 	cookieChecker CookieChecker
 
@@ -78,9 +96,65 @@ type Device struct {
 		handshake  *handshakeQueue
 	}
 
+	numWorkers int           // of each of RoutineEncryption, RoutineDecryption and RoutineHandshake
+	resolver   conn.Resolver // looks up host names in PeerConfig.Endpoint
+
+	replayRingSize int32      // accessed atomically
+	exportSessions AtomicBool // see SetSessionExport
+	ipcBase64Keys  AtomicBool // see SetIpcBase64Keys
+	rejectPrivPort AtomicBool // see SetRejectPrivilegedPorts
+	logRTT         AtomicBool // see SetLogHandshakeRTT
+
 	tun struct {
-		device tun.Device
-		mtu    int32
+		device  tun.Device
+		mtu     int32
+		padding int32 // padding multiple for data packets, accessed atomically
+	}
+
+	// callbacks are read on the data path, so they are kept in
+	// atomic.Values rather than behind a lock.
+	callbacks struct {
+		handshakeGiveUp   atomic.Value // func(peer *Peer)
+		inboundInspector  atomic.Value // func(peer *Peer, packet []byte) bool
+		outboundInspector atomic.Value // func(peer *Peer, packet []byte) bool
+		keypairExpiring   atomic.Value // func(peer *Peer, remaining time.Duration)
+		tunBackpressure   atomic.Value // *tunBackpressureHook
+	}
+
+	events struct {
+		sync.Mutex
+		c       chan Event // created by the first call to Events
+		enabled AtomicBool // c is open
+	}
+
+	initialHandshake struct {
+		sync.RWMutex
+		timeout time.Duration // 0 = limited only by MaxTimerHandshakes
+	}
+
+	logEndpoints struct {
+		sync.RWMutex
+		hash bool   // log endpoints as keyed hashes, see SetLogEndpointHashing
+		key  []byte // hash key, generated when hashing is first enabled
+	}
+
+	// endpointAllowlist holds the []net.IPNet set by SetEndpointAllowlist,
+	// empty if any endpoint is allowed. It is read for every packet
+	// received, so it is an atomic.Value rather than behind a lock.
+	endpointAllowlist atomic.Value
+
+	// cookieClock, if non-nil, replaces time.Now for cookies and load
+	// assessment. See SetCookieClock.
+	cookieClock struct {
+		sync.RWMutex
+		now func() time.Time
+	}
+
+	// handshakeRand, if non-nil, replaces crypto/rand as the source
+	// of ephemeral keys. Only tests set it.
+	handshakeRand struct {
+		sync.Mutex
+		reader io.Reader
 	}
 
 	ipcMutex sync.RWMutex
@@ -123,6 +197,14 @@ func (device *Device) isUp() bool {
 	return device.deviceState() == deviceStateUp
 }
 
+// IsUp reports whether the device is up, or is in the process of coming up.
+// Peers added while the device is up are started immediately.
+// The result is only a snapshot: the state may change concurrently,
+// for instance when the TUN device goes down.
+func (device *Device) IsUp() bool {
+	return device.isUp()
+}
+
 // Must hold device.peers.Lock()
 func removePeerLocked(device *Device, peer *Peer, key NoisePublicKey) {
 	// stop routing and processing of packets
@@ -176,7 +258,7 @@ func (device *Device) upLocked() error {
 	for _, peer := range device.peers.keyMap {
 		peer.Start()
 		if atomic.LoadUint32(&peer.persistentKeepaliveInterval) > 0 {
-			peer.SendKeepalive()
+			peer.sendKeepalive()
 		}
 	}
 	device.peers.RUnlock()
@@ -207,9 +289,34 @@ func (device *Device) Down() error {
 	return device.changeState(deviceStateDown)
 }
 
+// Pause makes the device drop every packet it reads from the TUN device
+// or receives from the bind, until Resume is called. Timers send neither
+// keepalives nor handshake initiations meanwhile; those that are due are
+// postponed until after Resume. Unlike Down, it keeps
+// the bind open and leaves peers, keypairs and running routines in place,
+// so that Resume picks up where Pause left off, provided the current
+// keypairs have not expired in the meantime.
+func (device *Device) Pause() {
+	if !device.state.paused.Swap(true) {
+		device.log.Verbosef("Device paused")
+	}
+}
+
+// Resume undoes Pause.
+func (device *Device) Resume() {
+	if device.state.paused.Swap(false) {
+		device.log.Verbosef("Device resumed")
+	}
+}
+
+// IsPaused reports whether the device is paused by Pause.
+func (device *Device) IsPaused() bool {
+	return device.state.paused.Get()
+}
+
 func (device *Device) IsUnderLoad() bool {
 	// check if currently under load
-	now := time.Now()
+	now := device.cookieNow()
 	underLoad := len(device.queue.handshake.c) >= QueueHandshakeSize/8
 	if underLoad {
 		atomic.StoreInt64(&device.rate.underLoadUntil, now.Add(UnderLoadAfterTime).UnixNano())
@@ -219,6 +326,90 @@ func (device *Device) IsUnderLoad() bool {
 	return atomic.LoadInt64(&device.rate.underLoadUntil) > now.UnixNano()
 }
 
+// SetPaddingMultiple sets the boundary to which the plaintext of data packets
+// is padded before encryption. Larger values obscure packet lengths further
+// at the cost of bandwidth. The multiple must be a power of two no smaller
+// than PaddingMultiple and no larger than the MTU of the TUN device.
+// Padding never causes a packet to exceed the MTU.
+func (device *Device) SetPaddingMultiple(multiple int) error {
+	if multiple < PaddingMultiple || multiple&(multiple-1) != 0 {
+		return fmt.Errorf("padding multiple %d is not a power of two of at least %d", multiple, PaddingMultiple)
+	}
+	if mtu := int(atomic.LoadInt32(&device.tun.mtu)); mtu != 0 && multiple > mtu {
+		return fmt.Errorf("padding multiple %d exceeds MTU %d", multiple, mtu)
+	}
+	atomic.StoreInt32(&device.tun.padding, int32(multiple))
+	return nil
+}
+
+// SetCookieRefreshTime sets how often the secret used to generate cookies
+// for cookie replies is rotated. Faster rotation shortens the window in
+// which a cookie reply can be replayed while the device is under load.
+// The default is CookieRefreshTime; the minimum is MinCookieRefreshTime.
+func (device *Device) SetCookieRefreshTime(d time.Duration) error {
+	if d < MinCookieRefreshTime {
+		return fmt.Errorf("cookie refresh time %v is below the minimum of %v", d, MinCookieRefreshTime)
+	}
+	device.cookieChecker.SetRefreshTime(d)
+	return nil
+}
+
+// SetCookieClock makes the cookie machinery of the device and its peers,
+// and the assessment of whether the device is under load that decides
+// when cookie replies are sent, read the current time from now instead of
+// time.Now. This lets tests step through cookie secret rotations and load
+// periods without waiting for them. A nil now restores time.Now.
+func (device *Device) SetCookieClock(now func() time.Time) {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	device.cookieClock.Lock()
+	device.cookieClock.now = now
+	device.cookieClock.Unlock()
+	device.cookieChecker.SetClock(now)
+	for _, peer := range device.peers.keyMap {
+		peer.cookieGenerator.SetClock(now)
+	}
+}
+
+// cookieNow returns the current time according to the clock set with
+// SetCookieClock.
+func (device *Device) cookieNow() time.Time {
+	device.cookieClock.RLock()
+	defer device.cookieClock.RUnlock()
+	return clockNow(device.cookieClock.now)
+}
+
+// SetReplayWindowSize sets the number of message counters tracked by the
+// replay filter of each new keypair. Messages arriving up to size-64
+// counters behind the newest accepted one are still accepted, so larger
+// sizes tolerate more reordering by fast, parallel senders, at the cost of
+// size/8 bytes per keypair. size must be a power of two between
+// replay.MinRingSize and replay.MaxRingSize; the default is
+// replay.DefaultRingSize. Existing keypairs are not affected.
+func (device *Device) SetReplayWindowSize(size int) error {
+	if err := replay.CheckRingSize(size); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&device.replayRingSize, int32(size))
+	return nil
+}
+
+// PublicKey returns the public key corresponding to the device's private key.
+// It is derived once, when the private key is set, so calling it is cheap.
+// It is the zero key if no private key has been set.
+func (device *Device) PublicKey() NoisePublicKey {
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
+	return device.staticIdentity.publicKey
+}
+
+// SetPrivateKey replaces the device's static private key, as setting
+// private_key over UAPI does. Peers whose public key equals the new public
+// key are removed. Every other peer's static-static secret is recomputed,
+// its handshake is cleared and its keypairs are expired, all while the
+// static identity is locked, so no handshake mixes the old and new keys.
+// If the device is up, peers that had a session initiate a new handshake
+// after a short random delay rather than waiting for the next packet.
 func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	// lock required resources
 
@@ -267,19 +458,66 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	for _, peer := range lockedPeers {
 		peer.handshake.mutex.RUnlock()
 	}
+	up := device.isUp()
 	for _, peer := range expiredPeers {
+		hadSession := peer.keypairs.Current() != nil
 		peer.ExpireCurrentKeypairs()
+		if up && hadSession {
+			peer.sendHandshakeInitiationAfterJitter()
+		}
 	}
 
 	return nil
 }
 
 func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
+	device, _ := NewDeviceWithOptions(tunDevice, bind, logger, DeviceOptions{})
+	return device
+}
+
+// DeviceOptions holds settings that can only be chosen when a device is
+// created. The zero value selects the defaults used by NewDevice.
+type DeviceOptions struct {
+	// AllowedIPs routes packets to peers. Nil selects the built-in trie.
+	AllowedIPs AllowedIPsTable
+
+	// NumWorkers is the number of goroutines started for each of
+	// encryption, decryption and handshake processing.
+	// Zero selects runtime.NumCPU().
+	NumWorkers int
+
+	// Resolver looks up host names given as PeerConfig.Endpoint.
+	// Nil selects a conn.CachingResolver with its defaults.
+	Resolver conn.Resolver
+}
+
+// NewDeviceWithOptions is like NewDevice but applies opts.
+// It reports an error if opts is invalid.
+func NewDeviceWithOptions(tunDevice tun.Device, bind conn.Bind, logger *Logger, opts DeviceOptions) (*Device, error) {
+	if opts.NumWorkers < 0 {
+		return nil, fmt.Errorf("number of workers %d is not at least 1", opts.NumWorkers)
+	}
+	if opts.NumWorkers == 0 {
+		opts.NumWorkers = runtime.NumCPU()
+	}
+	table := opts.AllowedIPs
+	if table == nil {
+		table = new(AllowedIPs)
+	}
+	if opts.Resolver == nil {
+		opts.Resolver = new(conn.CachingResolver)
+	}
 	device := new(Device)
+	device.numWorkers = opts.NumWorkers
+	device.resolver = opts.Resolver
+	device.allowedips = table
+	device.sourceTable, _ = table.(AllowedIPsSourceTable)
 	device.state.state = uint32(deviceStateDown)
 	device.closed = make(chan struct{})
 	device.log = logger
 	device.net.bind = bind
+	device.net.sendRetries = DefaultSendRetries
+	device.net.sendBackoff = DefaultSendRetryBackoff
 	device.tun.device = tunDevice
 	mtu, err := device.tun.device.MTU()
 	if err != nil {
@@ -287,6 +525,8 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 		mtu = DefaultMTU
 	}
 	device.tun.mtu = int32(mtu)
+	device.tun.padding = PaddingMultiple
+	device.replayRingSize = replay.DefaultRingSize
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 	device.rate.limiter.Init()
 	device.indexTable.Init()
@@ -300,10 +540,10 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 
 	// start workers
 
-	cpus := runtime.NumCPU()
+	workers := device.numWorkers
 	device.state.stopping.Wait()
-	device.queue.encryption.wg.Add(cpus) // One for each RoutineHandshake
-	for i := 0; i < cpus; i++ {
+	device.queue.encryption.wg.Add(workers) // One for each RoutineHandshake
+	for i := 0; i < workers; i++ {
 		go device.RoutineEncryption(i + 1)
 		go device.RoutineDecryption(i + 1)
 		go device.RoutineHandshake(i + 1)
@@ -314,7 +554,14 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	go device.RoutineReadFromTUN()
 	go device.RoutineTUNEventReader()
 
-	return device
+	device.log.Verbosef("Using %s, protocol version %d", NoiseConstruction, CurrentProtocolVersion)
+	return device, nil
+}
+
+// NumWorkers returns the number of goroutines the device runs for each of
+// encryption, decryption and handshake processing.
+func (device *Device) NumWorkers() int {
+	return device.numWorkers
 }
 
 func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
@@ -371,6 +618,7 @@ func (device *Device) Close() {
 	device.state.stopping.Wait()
 
 	device.rate.limiter.Close()
+	device.closeEvents()
 
 	device.log.Verbosef("Device closed")
 	close(device.closed)
@@ -380,6 +628,34 @@ func (device *Device) Wait() chan struct{} {
 	return device.closed
 }
 
+// WaitIdle blocks until no peer has packets queued for sending or
+// delivery and no handshake is being retransmitted, or until ctx is done.
+// It does not prevent new traffic, so callers that want a final drain
+// before Close should stop feeding packets to the device first.
+func (device *Device) WaitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(waitIdlePollInterval)
+	defer ticker.Stop()
+	for !device.isIdle() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (device *Device) isIdle() bool {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		if !peer.isIdle() {
+			return false
+		}
+	}
+	return true
+}
+
 func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 	if !device.isUp() {
 		return
@@ -391,12 +667,196 @@ func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(RejectAfterTime).Before(time.Now())
 		peer.keypairs.RUnlock()
 		if sendKeepalive {
-			peer.SendKeepalive()
+			peer.sendKeepalive()
 		}
 	}
 	device.peers.RUnlock()
 }
 
+// RekeyAll forces every peer to rekey immediately.
+// The current keypairs of each peer are expired and a new handshake is initiated.
+// Initiations are staggered by a random jitter to avoid a burst of handshakes.
+func (device *Device) RekeyAll() {
+	if !device.isUp() {
+		return
+	}
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for _, peer := range device.peers.keyMap {
+		peer.ExpireCurrentKeypairs()
+		peer.sendHandshakeInitiationAfterJitter()
+	}
+}
+
+// sendHandshakeInitiationAfterJitter initiates a handshake with peer after
+// a random delay of up to RekeyTimeoutJitterMaxMs, if it is still running,
+// so that rekeying many peers at once does not cause a burst of handshakes.
+func (peer *Peer) sendHandshakeInitiationAfterJitter() {
+	jitter := time.Millisecond * time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs))
+	time.AfterFunc(jitter, func() {
+		if peer.isRunning.Get() {
+			peer.SendHandshakeInitiation(false)
+		}
+	})
+}
+
+// SetHandshakeRandForTesting makes the device read handshake ephemeral keys
+// from r instead of crypto/rand, so that tests can replay a known handshake.
+// It must never be used outside of tests: a predictable r completely
+// defeats the forward secrecy of every session. A nil r restores crypto/rand.
+func (device *Device) SetHandshakeRandForTesting(r io.Reader) {
+	device.handshakeRand.Lock()
+	device.handshakeRand.reader = r
+	device.handshakeRand.Unlock()
+}
+
+// newEphemeralKey generates a private key for a new handshake.
+func (device *Device) newEphemeralKey() (NoisePrivateKey, error) {
+	device.handshakeRand.Lock()
+	defer device.handshakeRand.Unlock()
+	if device.handshakeRand.reader != nil {
+		return newPrivateKeyFrom(device.handshakeRand.reader)
+	}
+	return newPrivateKey()
+}
+
+// SetHandshakeGiveUpCallback sets fn to be called when a peer stops
+// retransmitting handshake initiations after MaxTimerHandshakes attempts.
+// fn is called on its own goroutine, so it may block or call back into the device.
+// Passing nil removes the callback.
+func (device *Device) SetHandshakeGiveUpCallback(fn func(peer *Peer)) {
+	device.callbacks.handshakeGiveUp.Store(fn)
+}
+
+// SetKeypairExpiringCallback sets fn to be called KeypairExpiringNotice
+// before the peer's current keypair reaches RejectAfterTime, with the time
+// it has left. This only happens when no handshake has replaced the keypair
+// by then, typically because the peer has been idle, so fn can warm up a
+// new session, for instance with Peer.SendHandshakeInitiation, before the
+// next packet would have to wait for one. fn is called on its own
+// goroutine. Passing nil removes the callback.
+func (device *Device) SetKeypairExpiringCallback(fn func(peer *Peer, remaining time.Duration)) {
+	device.callbacks.keypairExpiring.Store(fn)
+}
+
+func (device *Device) handshakeGiveUpCallback() func(peer *Peer) {
+	fn, _ := device.callbacks.handshakeGiveUp.Load().(func(peer *Peer))
+	return fn
+}
+
+func (device *Device) keypairExpiringCallback() func(peer *Peer, remaining time.Duration) {
+	fn, _ := device.callbacks.keypairExpiring.Load().(func(peer *Peer, remaining time.Duration))
+	return fn
+}
+
+// SetInitialHandshakeTimeout bounds how long a peer that has never completed
+// a handshake keeps retrying its first one. When d elapses, the peer gives up
+// as it would after MaxTimerHandshakes attempts, including calling the
+// handshake give-up callback. Peers that have completed a handshake before are
+// not affected. A d of 0, the default, removes the bound.
+func (device *Device) SetInitialHandshakeTimeout(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("invalid initial handshake timeout %v", d)
+	}
+	device.initialHandshake.Lock()
+	defer device.initialHandshake.Unlock()
+	device.initialHandshake.timeout = d
+	return nil
+}
+
+func (device *Device) initialHandshakeTimeout() time.Duration {
+	device.initialHandshake.RLock()
+	defer device.initialHandshake.RUnlock()
+	return device.initialHandshake.timeout
+}
+
+// SetInboundInspector sets fn to be called with every decrypted inbound
+// IP packet that passed the allowed IPs check, just before it is written
+// to the TUN device. If fn returns false, the packet is dropped.
+//
+// fn runs on the peer's receive goroutine, so it delays all further
+// traffic from that peer while it runs and must be fast and non-blocking.
+// packet is only valid for the duration of the call; fn must not retain
+// it, and may modify it only in place without changing its length.
+// Passing nil removes the inspector.
+func (device *Device) SetInboundInspector(fn func(peer *Peer, packet []byte) bool) {
+	device.callbacks.inboundInspector.Store(fn)
+}
+
+func (device *Device) inboundInspector() func(peer *Peer, packet []byte) bool {
+	fn, _ := device.callbacks.inboundInspector.Load().(func(peer *Peer, packet []byte) bool)
+	return fn
+}
+
+// SetOutboundInspector sets fn to be called with every IP packet read from
+// the TUN device and routed to a peer, before it is queued for encryption.
+// If fn returns false, the packet is dropped.
+//
+// fn runs on the goroutine reading from the TUN device, so it delays all
+// outbound traffic while it runs. The performance and buffer-lifetime
+// requirements are the same as for SetInboundInspector.
+// Passing nil removes the inspector.
+func (device *Device) SetOutboundInspector(fn func(peer *Peer, packet []byte) bool) {
+	device.callbacks.outboundInspector.Store(fn)
+}
+
+func (device *Device) outboundInspector() func(peer *Peer, packet []byte) bool {
+	fn, _ := device.callbacks.outboundInspector.Load().(func(peer *Peer, packet []byte) bool)
+	return fn
+}
+
+// SetTUNBackpressureCallback sets fn to be called when writing a decrypted
+// packet from peer to the TUN device fails, with the error, or blocks for
+// longer than threshold, with a nil error. Either means that whatever reads
+// from the TUN device, such as a userspace network stack, cannot keep up
+// with inbound traffic. blocked is how long the write took.
+//
+// fn runs on the peer's receive goroutine and must be fast and
+// non-blocking. Write failures are also counted in DeviceMetrics.Drops,
+// whether or not a callback is set. Passing nil removes the callback.
+func (device *Device) SetTUNBackpressureCallback(threshold time.Duration, fn func(peer *Peer, blocked time.Duration, err error)) {
+	device.callbacks.tunBackpressure.Store(&tunBackpressureHook{fn, threshold})
+}
+
+// tunBackpressureHook is set by SetTUNBackpressureCallback.
+type tunBackpressureHook struct {
+	fn        func(peer *Peer, blocked time.Duration, err error)
+	threshold time.Duration
+}
+
+func (device *Device) tunBackpressure() (func(peer *Peer, blocked time.Duration, err error), time.Duration) {
+	hook, _ := device.callbacks.tunBackpressure.Load().(*tunBackpressureHook)
+	if hook == nil {
+		return nil, 0
+	}
+	return hook.fn, hook.threshold
+}
+
+// SetEndpointAllowlist restricts peer endpoints to addresses within nets.
+// Endpoints outside of nets are rejected when configured, are not roamed to,
+// and are never sent to, even if they were set before the allowlist.
+// A nil or empty nets allows any endpoint, which is the default.
+func (device *Device) SetEndpointAllowlist(nets []net.IPNet) {
+	device.endpointAllowlist.Store(append([]net.IPNet(nil), nets...))
+}
+
+// endpointAllowed reports whether endpoint is permitted by the endpoint allowlist.
+func (device *Device) endpointAllowed(endpoint conn.Endpoint) bool {
+	nets, _ := device.endpointAllowlist.Load().([]net.IPNet)
+	if len(nets) == 0 {
+		return true
+	}
+	ip := endpoint.DstIP()
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // closeBindLocked closes the device's net.bind.
 // The caller must hold the net mutex.
 func closeBindLocked(device *Device) error {
@@ -449,6 +909,127 @@ func (device *Device) BindSetMark(mark uint32) error {
 	return nil
 }
 
+// BindSetDSCP sets the DSCP value that the bind applies to outgoing
+// packets, if it implements conn.BindSetDSCP. It is a no-op otherwise.
+// The default of 0 leaves the sockets' setting unchanged.
+func (device *Device) BindSetDSCP(dscp uint8) error {
+	if dscp > 63 {
+		return fmt.Errorf("invalid DSCP value %d", dscp)
+	}
+
+	device.net.Lock()
+	defer device.net.Unlock()
+
+	if device.net.dscp == dscp {
+		return nil
+	}
+	device.net.dscp = dscp
+	if device.isUp() && device.net.bind != nil {
+		if bind, ok := device.net.bind.(conn.BindSetDSCP); ok {
+			return bind.SetDSCP(dscp)
+		}
+	}
+	return nil
+}
+
+// SetBindOpenTimeout bounds how long bringing the device up, or any other
+// BindUpdate, waits for the bind to open. If d elapses first, the update
+// fails with an error wrapping context.DeadlineExceeded and the device
+// stays down. Binds that do not implement conn.BindOpenContext cannot be
+// interrupted, so the bound does not apply to them. A d of 0, the default,
+// removes the bound.
+func (device *Device) SetBindOpenTimeout(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("invalid bind open timeout %v", d)
+	}
+	device.net.Lock()
+	defer device.net.Unlock()
+	device.net.openTimeout = d
+	return nil
+}
+
+// SetSendRetries sets how many times a packet is resent when the bind fails
+// to send it with a transient error, such as ENOBUFS or EAGAIN when the
+// socket buffer of a busy host is momentarily full, before it is dropped.
+// The first resend happens after backoff, and each further one after twice
+// the previous wait, up to MaxSendRetryBackoff. Other errors are never
+// retried. The default is DefaultSendRetries resends after
+// DefaultSendRetryBackoff; retries may be at most MaxSendRetries, and 0
+// disables them.
+func (device *Device) SetSendRetries(retries int, backoff time.Duration) error {
+	if retries < 0 || retries > MaxSendRetries {
+		return fmt.Errorf("invalid send retries %d", retries)
+	}
+	if backoff < 0 || backoff > MaxSendRetryBackoff {
+		return fmt.Errorf("invalid send retry backoff %v", backoff)
+	}
+	device.net.Lock()
+	defer device.net.Unlock()
+	device.net.sendRetries = retries
+	device.net.sendBackoff = backoff
+	return nil
+}
+
+// SetSourcePortRotation controls whether new handshakes the device
+// initiates, as opposed to retransmissions, are sent from a fresh random
+// port, at most once per SourcePortRotationInterval. The bind is reopened
+// on the new port before the initiation is sent, so the configured listen
+// port is given up; should the new port fail to open, the bind is reopened
+// on the previous one. This makes handshakes
+// harder to link to each other and to a NAT mapping, which helps against
+// traffic analysis and censorship, but it is off by default: all peers
+// share the bind, so their traffic moves to the new port as well and
+// packets still in flight to the old one are lost, and firewalls that
+// expect a stable address and port for the tunnel will block it.
+func (device *Device) SetSourcePortRotation(enabled bool) {
+	device.net.rotatePort.Set(enabled)
+}
+
+// SetLogHandshakeRTT controls whether the round trip time of each handshake
+// initiated by the device is included in the verbose log line about its
+// response. The time is recorded in PeerStats.LastHandshakeRTT either way.
+// It is off by default.
+func (device *Device) SetLogHandshakeRTT(enabled bool) {
+	device.logRTT.Set(enabled)
+}
+
+// rotateSourcePort starts moving the bind to a new random port, after which
+// peer's handshake initiation is sent, and reports whether it did so.
+// The bind is updated on a separate goroutine because the caller may be
+// one that BindUpdate waits for.
+func (device *Device) rotateSourcePort(peer *Peer) bool {
+	if !device.net.rotatePort.Get() || device.net.rotating.Swap(true) {
+		return false
+	}
+	if time.Since(device.net.rotatedAt) < SourcePortRotationInterval {
+		device.net.rotating.Set(false)
+		return false
+	}
+	device.net.rotatedAt = time.Now()
+	go func() {
+		defer device.net.rotating.Set(false)
+		device.net.Lock()
+		old := device.net.port
+		device.net.port = 0
+		device.net.Unlock()
+		if err := device.BindUpdate(); err != nil {
+			device.log.Errorf("Unable to move to a new source port: %v", err)
+			device.net.Lock()
+			device.net.port = old
+			device.net.Unlock()
+			if err := device.BindUpdate(); err != nil {
+				device.log.Errorf("Unable to reopen source port %d: %v", old, err)
+			}
+		}
+		device.net.RLock()
+		port := device.net.port
+		device.net.RUnlock()
+		device.log.Verbosef("%v - Sending handshake from source port %d", peer, port)
+		peer.SendHandshakeInitiation(true)
+	}()
+	return true
+}
+
 func (device *Device) BindUpdate() error {
 	device.net.Lock()
 	defer device.net.Unlock()
@@ -467,7 +1048,13 @@ func (device *Device) BindUpdate() error {
 	var err error
 	var recvFns []conn.ReceiveFunc
 	netc := &device.net
-	recvFns, netc.port, err = netc.bind.Open(netc.port)
+	ctx := context.Background()
+	if netc.openTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, netc.openTimeout)
+		defer cancel()
+	}
+	recvFns, netc.port, err = conn.OpenContext(ctx, netc.bind, netc.port)
 	if err != nil {
 		netc.port = 0
 		return err
@@ -487,6 +1074,14 @@ func (device *Device) BindUpdate() error {
 		}
 	}
 
+	// set DSCP
+	if bind, ok := netc.bind.(conn.BindSetDSCP); ok && netc.dscp != 0 {
+		err = bind.SetDSCP(netc.dscp)
+		if err != nil {
+			return err
+		}
+	}
+
 	// clear cached source addresses
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
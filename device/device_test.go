@@ -7,20 +7,29 @@ package device
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"os"
+	"reflect"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/replay"
+	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/tun/tuntest"
 )
 
@@ -147,7 +156,13 @@ func (pair *testPair) Send(tb testing.TB, ping SendDirection, done chan struct{}
 }
 
 // genTestPair creates a testPair.
-func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
+func genTestPair(tb testing.TB, realSocket bool) testPair {
+	return genTestPairWithLoggers(tb, realSocket, [2]*Logger{})
+}
+
+// genTestPairWithLoggers creates a testPair whose devices log to loggers,
+// or to stdout where a logger is nil.
+func genTestPairWithLoggers(tb testing.TB, realSocket bool, loggers [2]*Logger) (pair testPair) {
 	cfg, endpointCfg := genConfigs(tb)
 	var binds [2]conn.Bind
 	if realSocket {
@@ -160,11 +175,15 @@ func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
 		p := &pair[i]
 		p.tun = tuntest.NewChannelTUN()
 		p.ip = net.IPv4(1, 0, 0, byte(i+1))
-		level := LogLevelVerbose
-		if _, ok := tb.(*testing.B); ok && !testing.Verbose() {
-			level = LogLevelError
+		logger := loggers[i]
+		if logger == nil {
+			level := LogLevelVerbose
+			if _, ok := tb.(*testing.B); ok && !testing.Verbose() {
+				level = LogLevelError
+			}
+			logger = NewLogger(level, fmt.Sprintf("dev%d: ", i))
 		}
-		p.dev = NewDevice(p.tun.TUN(), binds[i], NewLogger(level, fmt.Sprintf("dev%d: ", i)))
+		p.dev = NewDevice(p.tun.TUN(), binds[i], logger)
 		if err := p.dev.IpcSet(cfg[i]); err != nil {
 			tb.Errorf("failed to configure device %d: %v", i, err)
 			p.dev.Close()
@@ -238,6 +257,465 @@ func TestUpDown(t *testing.T) {
 	}
 }
 
+func TestRekeyAll(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	var peer *Peer
+	for _, p := range pair[0].dev.peers.keyMap {
+		peer = p
+	}
+	old := peer.keypairs.Current()
+	handshakes := peer.Handshakes()
+	pair[0].dev.RekeyAll()
+
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if peer.keypairs.Current() == old {
+		t.Errorf("keypair was not replaced after RekeyAll")
+	}
+	if peer.Handshakes() != handshakes+1 {
+		t.Errorf("handshakes = %d; want %d", peer.Handshakes(), handshakes+1)
+	}
+}
+
+func TestSetPrivateKeyRekeys(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	var peer *Peer
+	for _, p := range pair[0].dev.peers.keyMap {
+		peer = p
+	}
+	old := peer.keypairs.Current()
+	handshakes := peer.Handshakes()
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pair[0].dev.SetPrivateKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	if peer.keypairs.Current() != old || atomic.LoadUint64(&old.sendNonce) != RejectAfterMessages {
+		t.Errorf("current keypair was not expired")
+	}
+
+	// Tell the other side about the new key; the session resumes
+	// through the handshake initiated by SetPrivateKey.
+	remote := pair[1].dev.Config().Peers[0]
+	remote.PublicKey = sk.publicKey()
+	if err := pair[1].dev.SetPeers([]PeerConfig{remote}); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if peer.keypairs.Current() == old {
+		t.Errorf("keypair was not replaced after SetPrivateKey")
+	}
+	if peer.Handshakes() <= handshakes {
+		t.Errorf("handshakes = %d; want more than %d", peer.Handshakes(), handshakes)
+	}
+}
+
+func TestSetPresharedKey(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	var psk NoisePresharedKey
+	psk[0] = 0x42
+	var peers [2]*Peer
+	for i := range pair {
+		for _, p := range pair[i].dev.peers.keyMap {
+			peers[i] = p
+		}
+	}
+	old := peers[0].keypairs.Current()
+	for _, peer := range peers {
+		peer.SetPresharedKey(psk)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if peers[0].keypairs.Current() == old {
+		t.Errorf("keypair was not replaced after SetPresharedKey")
+	}
+	if got := pair[0].dev.Config().Peers[0].PresharedKey; got != psk {
+		t.Errorf("configured preshared key was not updated")
+	}
+
+	// Setting the same key again leaves the session alone.
+	current := peers[0].keypairs.Current()
+	peers[0].SetPresharedKey(psk)
+	if peers[0].keypairs.Current() != current || atomic.LoadUint64(&current.sendNonce) >= RejectAfterMessages {
+		t.Errorf("setting an unchanged preshared key disturbed the session")
+	}
+}
+
+func TestWaitIdle(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := pair[0].dev.WaitIdle(ctx); err != nil {
+		t.Fatalf("WaitIdle after traffic: %v", err)
+	}
+
+	var peer *Peer
+	for _, p := range pair[0].dev.peers.keyMap {
+		peer = p
+	}
+	peer.queue.staged <- pair[0].dev.NewOutboundElement()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := pair[0].dev.WaitIdle(ctx); err != context.DeadlineExceeded {
+		t.Errorf("WaitIdle with a staged packet = %v; want %v", err, context.DeadlineExceeded)
+	}
+	peer.FlushStagedPackets()
+}
+
+func TestInboundInspector(t *testing.T) {
+	pair := genTestPair(t, false)
+	var inspected int32
+	pair[0].dev.SetInboundInspector(func(peer *Peer, packet []byte) bool {
+		atomic.AddInt32(&inspected, 1)
+		return true
+	})
+	pair.Send(t, Ping, nil)
+	if atomic.LoadInt32(&inspected) != 1 {
+		t.Errorf("inspector saw %d packets; want 1", inspected)
+	}
+
+	pair[0].dev.SetInboundInspector(func(peer *Peer, packet []byte) bool {
+		return false
+	})
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Errorf("packet rejected by inspector was delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pair[0].dev.SetInboundInspector(nil)
+	pair.Send(t, Ping, nil)
+}
+
+func TestOutboundInspector(t *testing.T) {
+	pair := genTestPair(t, false)
+	var inspected int32
+	pair[1].dev.SetOutboundInspector(func(peer *Peer, packet []byte) bool {
+		atomic.AddInt32(&inspected, 1)
+		return true
+	})
+	pair.Send(t, Ping, nil)
+	if atomic.LoadInt32(&inspected) != 1 {
+		t.Errorf("inspector saw %d packets; want 1", inspected)
+	}
+
+	pair[1].dev.SetOutboundInspector(func(peer *Peer, packet []byte) bool {
+		return false
+	})
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Errorf("packet rejected by inspector was delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pair[1].dev.SetOutboundInspector(nil)
+	pair.Send(t, Ping, nil)
+}
+
+func TestDeviceMetrics(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	var initiated uint64
+	for i := range pair {
+		m := pair[i].dev.Metrics()
+		if m.Peers != 1 || m.TxBytes == 0 || m.RxBytes == 0 {
+			t.Errorf("dev%d: unexpected metrics %+v", i, m)
+		}
+		if m.HandshakesCompleted == 0 || m.IndexTableSize == 0 {
+			t.Errorf("dev%d: no handshake recorded in %+v", i, m)
+		}
+		if m.SendErrors != 0 || m.ReceiveErrors != 0 {
+			t.Errorf("dev%d: unexpected errors in %+v", i, m)
+		}
+		initiated += m.HandshakesInitiated
+	}
+	if initiated == 0 {
+		t.Errorf("no handshake initiations recorded")
+	}
+}
+
+func TestInboundDrops(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	if drops := pair[0].dev.Metrics().Drops; drops != (InboundDrops{}) {
+		t.Errorf("drops = %+v after clean traffic; want none", drops)
+	}
+
+	// pair[1] may route to pair[0], but not from a source outside
+	// the allowed IPs pair[0] has for it.
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, net.IPv4(1, 0, 0, 9))
+	deadline := time.Now().Add(5 * time.Second)
+	for pair[0].dev.Metrics().Drops.DisallowedSource == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("packet with disallowed source not counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Errorf("packet with disallowed source was delivered")
+	default:
+	}
+}
+
+func TestInitialHandshakeTimeout(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, _ := newPrivateKey()
+	peer, err := dev.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.SetInitialHandshakeTimeout(-time.Second); err == nil {
+		t.Errorf("negative timeout accepted")
+	}
+	if peer.initialHandshakeExpired() {
+		t.Errorf("expired without a timeout set")
+	}
+	dev.SetInitialHandshakeTimeout(3 * RekeyTimeout)
+	if peer.initialHandshakeExpired() {
+		t.Errorf("expired before any initiation was sent")
+	}
+	for _, tt := range []struct {
+		elapsed time.Duration
+		want    bool
+	}{
+		{0, false},
+		{2 * RekeyTimeout, false},
+		{3*RekeyTimeout - time.Second, false},
+		{3 * RekeyTimeout, true},
+	} {
+		atomic.StoreInt64(&peer.stats.firstAttemptMono, monotime()-int64(tt.elapsed))
+		if got := peer.initialHandshakeExpired(); got != tt.want {
+			t.Errorf("after %v: expired = %v; want %v", tt.elapsed, got, tt.want)
+		}
+	}
+	// An initiation that is not a retry, such as one triggered by a new
+	// packet, must not restart the timeout.
+	peer.SendHandshakeInitiation(false)
+	if !peer.initialHandshakeExpired() {
+		t.Errorf("new initiation restarted the initial handshake timeout")
+	}
+	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().UnixNano())
+	if peer.initialHandshakeExpired() {
+		t.Errorf("expired for a peer that has completed a handshake")
+	}
+}
+
+func TestInitialHandshakeTimeoutDeadline(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.AddPeer(PeerConfig{PublicKey: sk.publicKey(), Endpoint: "192.0.2.1:51820"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	const timeout = 300 * time.Millisecond
+	dev.SetInitialHandshakeTimeout(timeout)
+	gaveUp := make(chan time.Time, 1)
+	dev.SetHandshakeGiveUpCallback(func(*Peer) {
+		gaveUp <- time.Now()
+	})
+
+	start := time.Now()
+	peer.SendHandshakeInitiation(false)
+	select {
+	case at := <-gaveUp:
+		if d := at.Sub(start); d < timeout {
+			t.Errorf("gave up after %v; want no earlier than %v", d, timeout)
+		}
+	case <-time.After(RekeyTimeout):
+		t.Fatal("did not give up at the initial handshake timeout")
+	}
+}
+
+func TestHandshakeGiveUpCallback(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := make(chan *Peer, 1)
+	dev.SetHandshakeGiveUpCallback(func(peer *Peer) {
+		calls <- peer
+	})
+
+	// A retry that is not the last does not give up.
+	expiredRetransmitHandshake(peer)
+	select {
+	case <-calls:
+		t.Errorf("callback called before the last attempt")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	atomic.StoreUint32(&peer.timers.handshakeAttempts, MaxTimerHandshakes+1)
+	expiredRetransmitHandshake(peer)
+	select {
+	case got := <-calls:
+		if got != peer {
+			t.Errorf("callback called with peer %v; want %v", got, peer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake give-up callback not called")
+	}
+
+	dev.SetHandshakeGiveUpCallback(nil)
+	atomic.StoreUint32(&peer.timers.handshakeAttempts, MaxTimerHandshakes+1)
+	expiredRetransmitHandshake(peer)
+	select {
+	case <-calls:
+		t.Errorf("callback called after it was removed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestKeypairExpiringCallback(t *testing.T) {
+	pair := genTestPair(t, false)
+	type call struct {
+		peer      *Peer
+		remaining time.Duration
+	}
+	calls := make(chan call, 1)
+	pair[0].dev.SetKeypairExpiringCallback(func(peer *Peer, remaining time.Duration) {
+		calls <- call{peer, remaining}
+	})
+	pair.Send(t, Ping, nil)
+
+	var peer *Peer
+	for _, p := range pair[0].dev.peers.keyMap {
+		peer = p
+	}
+	if !peer.timers.keypairExpiring.IsPending() {
+		t.Fatal("keypair expiring timer not armed after handshake")
+	}
+	expiredKeypairExpiring(peer)
+	select {
+	case c := <-calls:
+		if c.peer != peer {
+			t.Errorf("callback called with peer %v; want %v", c.peer, peer)
+		}
+		if c.remaining <= RejectAfterTime-time.Minute || c.remaining > RejectAfterTime {
+			t.Errorf("remaining = %v; want just under %v", c.remaining, RejectAfterTime)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("keypair expiring callback not called")
+	}
+}
+
+func TestStagedPacketMaxAge(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	var peer *Peer
+	for _, p := range pair[1].dev.peers.keyMap {
+		peer = p
+	}
+	if err := peer.SetStagedPacketMaxAge(-time.Second); err == nil {
+		t.Errorf("negative age accepted")
+	}
+	if err := peer.SetStagedPacketMaxAge(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	keypair := peer.keypairs.Current()
+
+	stale := pair[1].dev.NewOutboundElement()
+	stale.staged = time.Now().Add(-time.Hour)
+	peer.StagePacket(stale)
+	nonce := atomic.LoadUint64(&keypair.sendNonce)
+	peer.SendStagedPackets()
+	if len(peer.queue.staged) != 0 {
+		t.Fatalf("stale packet left staged")
+	}
+	if got := atomic.LoadUint64(&keypair.sendNonce); got != nonce {
+		t.Errorf("stale packet was sent")
+	}
+
+	peer.StagePacket(pair[1].dev.NewOutboundElement())
+	peer.SendStagedPackets()
+	if got := atomic.LoadUint64(&keypair.sendNonce); got != nonce+1 {
+		t.Errorf("fresh packet was not sent")
+	}
+}
+
+func TestManualKeepalive(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	var peer *Peer
+	for _, p := range pair[0].dev.peers.keyMap {
+		peer = p
+	}
+	atomic.StoreUint32(&peer.persistentKeepaliveInterval, 25)
+
+	peer.SetManualKeepalive(true)
+	peer.timers.persistentKeepalive.Del()
+	peer.timersAnyAuthenticatedPacketTraversal()
+	if peer.timers.persistentKeepalive.IsPending() {
+		t.Errorf("persistent keepalive timer armed in manual mode")
+	}
+
+	peer.SetManualKeepalive(false)
+	if !peer.timers.persistentKeepalive.IsPending() {
+		t.Errorf("persistent keepalive timer not rearmed after leaving manual mode")
+	}
+}
+
+func TestSendKeepalive(t *testing.T) {
+	pair := genTestPair(t, false)
+	var peer *Peer
+	for _, p := range pair[0].dev.peers.keyMap {
+		peer = p
+	}
+	if err := peer.SendKeepalive(); err != ErrNoKeypair {
+		t.Errorf("SendKeepalive before handshake = %v; want %v", err, ErrNoKeypair)
+	}
+
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	before := pair[1].dev.Metrics().RxBytes
+	if err := peer.SendKeepalive(); err != nil {
+		t.Fatalf("SendKeepalive with a session: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pair[1].dev.Metrics().RxBytes == before {
+		if time.Now().After(deadline) {
+			t.Fatalf("keepalive was not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 // TestConcurrencySafety does other things concurrently with tunnel use.
 // It is intended to be used with the race detector to catch data races.
 func TestConcurrencySafety(t *testing.T) {
@@ -311,7 +789,17 @@ func TestConcurrencySafety(t *testing.T) {
 }
 
 func BenchmarkLatency(b *testing.B) {
-	pair := genTestPair(b, true)
+	benchmarkLatency(b, true)
+}
+
+// BenchmarkLatencyInMemory is like BenchmarkLatency,
+// but uses in-memory binds instead of real sockets.
+func BenchmarkLatencyInMemory(b *testing.B) {
+	benchmarkLatency(b, false)
+}
+
+func benchmarkLatency(b *testing.B, realSocket bool) {
+	pair := genTestPair(b, realSocket)
 
 	// Establish a connection.
 	pair.Send(b, Ping, nil)
@@ -325,7 +813,17 @@ func BenchmarkLatency(b *testing.B) {
 }
 
 func BenchmarkThroughput(b *testing.B) {
-	pair := genTestPair(b, true)
+	benchmarkThroughput(b, true)
+}
+
+// BenchmarkThroughputInMemory is like BenchmarkThroughput,
+// but uses in-memory binds instead of real sockets.
+func BenchmarkThroughputInMemory(b *testing.B) {
+	benchmarkThroughput(b, false)
+}
+
+func benchmarkThroughput(b *testing.B, realSocket bool) {
+	pair := genTestPair(b, realSocket)
 
 	// Establish a connection.
 	pair.Send(b, Ping, nil)
@@ -405,3 +903,1474 @@ func goroutineLeakCheck(t *testing.T) {
 		t.Fatalf("expected %d goroutines, got %d, leak?", startGoroutines, endGoroutines)
 	})
 }
+
+func TestNumWorkers(t *testing.T) {
+	newDev := func(n int) (*Device, error) {
+		return NewDeviceWithOptions(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""), DeviceOptions{NumWorkers: n})
+	}
+	if _, err := newDev(-1); err == nil {
+		t.Errorf("negative number of workers accepted")
+	}
+	dev, err := newDev(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.NumWorkers(); got != runtime.NumCPU() {
+		t.Errorf("default NumWorkers = %d; want %d", got, runtime.NumCPU())
+	}
+	dev.Close()
+
+	dev, err = newDev(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if got := dev.NumWorkers(); got != 1 {
+		t.Errorf("NumWorkers = %d; want 1", got)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.IsUp() {
+		t.Errorf("device not up after Up")
+	}
+}
+
+func TestPause(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+
+	for i := range pair {
+		pair[i].dev.Pause()
+		if !pair[i].dev.IsPaused() {
+			t.Fatalf("device %d not paused", i)
+		}
+		pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+		select {
+		case <-pair[0].tun.Inbound:
+			t.Errorf("packet delivered while device %d was paused", i)
+		case <-time.After(100 * time.Millisecond):
+		}
+		pair[i].dev.Resume()
+	}
+
+	// Timers that fall due while paused send nothing and fire again later.
+	dev := pair[0].dev
+	dev.peers.RLock()
+	var peer *Peer
+	for _, p := range dev.peers.keyMap {
+		peer = p
+	}
+	dev.peers.RUnlock()
+	dev.Pause()
+	sent := atomic.LoadUint64(&peer.stats.txBytes)
+	expiredRetransmitHandshake(peer)
+	expiredNewHandshake(peer)
+	if got := atomic.LoadUint64(&peer.stats.txBytes); got != sent {
+		t.Errorf("%d bytes sent by timers while paused", got-sent)
+	}
+	if atomic.LoadUint32(&peer.timers.handshakeAttempts) != 0 {
+		t.Errorf("handshake attempt counted while paused")
+	}
+	if !peer.timers.retransmitHandshake.IsPending() || !peer.timers.newHandshake.IsPending() {
+		t.Errorf("timers not postponed while paused")
+	}
+	peer.timers.retransmitHandshake.Del()
+	peer.timers.newHandshake.Del()
+	dev.Resume()
+
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+}
+
+func TestKeepaliveJitter(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := peer.persistentKeepaliveDelay(25); got != 25*time.Second {
+		t.Errorf("delay without jitter = %v; want 25s", got)
+	}
+	for _, bad := range []int{-1, MaxKeepaliveJitterPercent + 1} {
+		if err := peer.SetKeepaliveJitter(bad); err == nil {
+			t.Errorf("jitter of %d%% accepted", bad)
+		}
+	}
+	if err := peer.SetKeepaliveJitter(20); err != nil {
+		t.Fatal(err)
+	}
+	varied := false
+	for i := 0; i < 100; i++ {
+		got := peer.persistentKeepaliveDelay(25)
+		if got < 20*time.Second || got > 25*time.Second {
+			t.Fatalf("delay with 20%% jitter = %v; want within [20s, 25s]", got)
+		}
+		varied = varied || got != 25*time.Second
+	}
+	if !varied {
+		t.Errorf("jitter never shortened the interval")
+	}
+}
+
+func TestLastReceive(t *testing.T) {
+	pair := genTestPair(t, false)
+	var peer *Peer
+	for _, p := range pair[0].dev.peers.keyMap {
+		peer = p
+	}
+	if last := peer.Stats().LastReceive; !last.IsZero() {
+		t.Errorf("LastReceive = %v before any data; want zero", last)
+	}
+	start := time.Now()
+	pair.Send(t, Ping, nil)
+	last := peer.Stats().LastReceive
+	if last.Before(start) || last.After(time.Now()) {
+		t.Errorf("LastReceive = %v; want between %v and now", last, start)
+	}
+}
+
+func TestOutboundQueueDepth(t *testing.T) {
+	pair := genTestPair(t, false)
+	var peer *Peer
+	for _, p := range pair[1].dev.peers.keyMap {
+		peer = p
+	}
+	if _, peak := peer.OutboundQueueDepth(); peak != 0 {
+		t.Errorf("peak = %d before sending; want 0", peak)
+	}
+	pair.Send(t, Ping, nil)
+	stats := peer.Stats()
+	if stats.OutboundQueuePeak < 1 || stats.OutboundQueuePeak > QueueOutboundSize {
+		t.Errorf("OutboundQueuePeak = %d after sending; want between 1 and %d", stats.OutboundQueuePeak, QueueOutboundSize)
+	}
+	if stats.OutboundQueueLen > stats.OutboundQueuePeak {
+		t.Errorf("OutboundQueueLen = %d exceeds peak %d", stats.OutboundQueueLen, stats.OutboundQueuePeak)
+	}
+}
+
+func TestReplayWindowSize(t *testing.T) {
+	pair := genTestPair(t, false)
+	dev := pair[0].dev
+	if err := dev.SetReplayWindowSize(1000); err == nil {
+		t.Errorf("replay window size that is not a power of two accepted")
+	}
+	if err := dev.SetReplayWindowSize(replay.MaxRingSize); err != nil {
+		t.Fatal(err)
+	}
+	var peer *Peer
+	for _, p := range dev.peers.keyMap {
+		peer = p
+	}
+	peer.ExpireCurrentKeypairs()
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	// Counters far behind the newest are still accepted by the new keypair.
+	keypair := peer.keypairs.Current()
+	if keypair == nil {
+		t.Fatal("no current keypair")
+	}
+	const newest = replay.MaxRingSize - 64
+	if !keypair.replayFilter.ValidateCounter(newest, RejectAfterMessages) ||
+		!keypair.replayFilter.ValidateCounter(newest-(replay.DefaultRingSize+64), RejectAfterMessages) {
+		t.Errorf("replay filter of new keypair does not use the configured window")
+	}
+}
+
+func TestKeypairCount(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	for i := range pair {
+		dev := pair[i].dev
+		if n := dev.KeypairCount(); n == 0 {
+			t.Errorf("dev%d: no keypairs after exchanging packets", i)
+		}
+		dev.RemoveAllPeers()
+		if n := dev.KeypairCount(); n != 0 {
+			t.Errorf("dev%d: %d keypairs left after removing all peers", i, n)
+		}
+		if n := dev.Metrics().IndexTableSize; n != 0 {
+			t.Errorf("dev%d: %d index table entries left after removing all peers", i, n)
+		}
+	}
+}
+
+func TestEndpointFailover(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var endpoints []conn.Endpoint
+	for _, s := range []string{"192.0.2.1:51820", "192.0.2.2:51820"} {
+		ep, err := dev.net.bind.ParseEndpoint(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints = append(endpoints, ep)
+	}
+	peer.SetEndpoints(endpoints)
+
+	giveUp := func() {
+		atomic.StoreUint32(&peer.timers.handshakeAttempts, MaxTimerHandshakes+1)
+		expiredRetransmitHandshake(peer)
+	}
+	giveUp()
+	if got, _ := peer.Endpoint(); got != "192.0.2.1:51820" {
+		t.Errorf("endpoint changed to %s without failover enabled", got)
+	}
+
+	peer.SetEndpointFailover(true)
+	giveUp()
+	if got, _ := peer.Endpoint(); got != "192.0.2.2:51820" {
+		t.Errorf("endpoint after failover = %s; want 192.0.2.2:51820", got)
+	}
+	if n := atomic.LoadUint32(&peer.timers.handshakeAttempts); n != 0 {
+		t.Errorf("handshake attempts after failover = %d; want 0", n)
+	}
+	giveUp()
+	if got, _ := peer.Endpoint(); got != "192.0.2.2:51820" {
+		t.Errorf("failover continued past the last candidate to %s", got)
+	}
+
+	peer.timersHandshakeComplete()
+	giveUp()
+	if got, _ := peer.Endpoint(); got != "192.0.2.1:51820" {
+		t.Errorf("endpoint after failover following a handshake = %s; want 192.0.2.1:51820", got)
+	}
+}
+
+// destBind is a Bind that records the destinations of the datagrams it sends.
+type destBind struct {
+	conn.Bind
+	mu    sync.Mutex
+	dests []string
+}
+
+func (b *destBind) Send(buf []byte, ep conn.Endpoint) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dests = append(b.dests, ep.DstToString())
+	return nil
+}
+
+func TestEndpointProbing(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	bind := &destBind{Bind: dev.net.bind}
+	dev.net.Lock()
+	dev.net.bind = bind
+	dev.net.Unlock()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	peer, err := dev.NewPeer(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", "192.0.2.1:51820,192.0.2.2:51820",
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	probes := func() []string {
+		bind.mu.Lock()
+		bind.dests = nil
+		bind.mu.Unlock()
+		peer.sendProbes([]byte{1})
+		bind.mu.Lock()
+		defer bind.mu.Unlock()
+		return bind.dests
+	}
+	if got := probes(); len(got) != 0 {
+		t.Errorf("probed %v without probing enabled", got)
+	}
+	peer.SetEndpointProbing(true)
+	if got := probes(); len(got) != 1 || got[0] != "192.0.2.2:51820" {
+		t.Errorf("probed %v; want [192.0.2.2:51820]", got)
+	}
+	peer.Lock()
+	peer.disableRoaming = true
+	peer.Unlock()
+	if got := probes(); len(got) != 0 {
+		t.Errorf("probed %v with roaming disabled", got)
+	}
+}
+
+// mtuBind is a Bind that rejects datagrams larger than max with EMSGSIZE.
+type mtuBind struct {
+	conn.Bind
+	max int
+}
+
+func (b *mtuBind) Send(buf []byte, ep conn.Endpoint) error {
+	if len(buf) > b.max {
+		return syscall.EMSGSIZE
+	}
+	return nil
+}
+
+func TestPathMTU(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	dev.net.Lock()
+	dev.net.bind = &mtuBind{Bind: dev.net.bind, max: 1000}
+	dev.net.Unlock()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.AddPeer(PeerConfig{PublicKey: sk.publicKey(), Endpoint: "192.0.2.1:51820"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := peer.SendBuffer(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if mtu := peer.PathMTU(); mtu != 0 {
+		t.Errorf("PathMTU = %d before any oversized send; want 0", mtu)
+	}
+	for _, size := range []int{1400, 1200, 1300} {
+		if err := peer.SendBuffer(make([]byte, size)); !errors.Is(err, syscall.EMSGSIZE) {
+			t.Fatalf("SendBuffer(%d bytes) = %v; want EMSGSIZE", size, err)
+		}
+	}
+	if mtu, want := peer.PathMTU(), 1200-MessageTransportSize-1; mtu != want {
+		t.Errorf("PathMTU = %d; want %d", mtu, want)
+	}
+
+	ep, err := dev.net.bind.ParseEndpoint("192.0.2.2:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.SetEndpoints([]conn.Endpoint{ep})
+	if mtu := peer.PathMTU(); mtu != 0 {
+		t.Errorf("PathMTU = %d after endpoint change; want 0", mtu)
+	}
+}
+
+func TestHandshakeRTT(t *testing.T) {
+	pair := genTestPair(t, false)
+	start := time.Now()
+	pair.Send(t, Ping, nil)
+	elapsed := time.Since(start)
+
+	var total time.Duration
+	for i := range pair {
+		for _, peer := range pair[i].dev.peers.keyMap {
+			rtt := peer.Stats().LastHandshakeRTT
+			if rtt < 0 || rtt > elapsed {
+				t.Errorf("dev%d: handshake RTT %v outside [0, %v]", i, rtt, elapsed)
+			}
+			total += rtt
+		}
+	}
+	if total == 0 {
+		t.Errorf("no handshake RTT recorded by the initiator")
+	}
+}
+
+func TestLogHandshakeRTT(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			var mu sync.Mutex
+			var responses []string
+			logger := &Logger{
+				Verbosef: func(format string, args ...interface{}) {
+					line := fmt.Sprintf(format, args...)
+					if strings.Contains(line, "Received handshake response") {
+						mu.Lock()
+						responses = append(responses, line)
+						mu.Unlock()
+					}
+				},
+				Errorf: DiscardLogf,
+			}
+			pair := genTestPairWithLoggers(t, false, [2]*Logger{logger, logger})
+			for i := range pair {
+				pair[i].dev.SetLogHandshakeRTT(enabled)
+			}
+			pair.Send(t, Ping, nil)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(responses) == 0 {
+				t.Fatal("no handshake response logged")
+			}
+			for _, line := range responses {
+				if got := strings.Contains(line, " after "); got != enabled {
+					t.Errorf("logged %q with RTT logging %v", line, enabled)
+				}
+			}
+		})
+	}
+}
+
+func TestLogEndpointHashing(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	ep, err := dev.net.bind.ParseEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := dev.net.bind.ParseEndpoint("192.0.2.2:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := dev.endpointString(ep); s != "192.0.2.1:51820" {
+		t.Errorf("endpoint logged as %q by default; want the address", s)
+	}
+	if err := dev.SetLogEndpointHashing(true); err != nil {
+		t.Fatal(err)
+	}
+	s := dev.endpointString(ep)
+	if strings.Contains(s, "192.0.2.1") {
+		t.Errorf("hashed endpoint %q reveals the address", s)
+	}
+	if s != dev.endpointString(ep) {
+		t.Errorf("endpoint hash is not stable")
+	}
+	if s == dev.endpointString(other) {
+		t.Errorf("different endpoints hash to %q", s)
+	}
+
+	sendErr := fmt.Errorf("send: %w", &net.OpError{
+		Op:   "write",
+		Net:  "udp",
+		Addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820},
+		Err:  syscall.ECONNREFUSED,
+	})
+	logged := dev.errorString(sendErr)
+	if strings.Contains(logged, "192.0.2.1") || !strings.Contains(logged, s) {
+		t.Errorf("send error logged as %q; want the address replaced by %q", logged, s)
+	}
+}
+
+func TestAllStats(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	for i := range pair {
+		stats := pair[i].dev.AllStats()
+		if len(stats) != 1 {
+			t.Fatalf("dev%d: AllStats has %d peers; want 1", i, len(stats))
+		}
+		for key, s := range stats {
+			peer := pair[i].dev.LookupPeer(key)
+			if peer == nil {
+				t.Fatalf("dev%d: AllStats reports unknown peer", i)
+			}
+			if s.TxBytes == 0 || s.TxBytes > peer.Stats().TxBytes {
+				t.Errorf("dev%d: AllStats TxBytes = %d; peer reports %d", i, s.TxBytes, peer.Stats().TxBytes)
+			}
+		}
+	}
+}
+
+// recordingBind is a Bind that records the sizes of the datagrams sent.
+type recordingBind struct {
+	conn.Bind
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (b *recordingBind) Send(buf []byte, ep conn.Endpoint) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sizes = append(b.sizes, len(buf))
+	return nil
+}
+
+func TestJunkPackets(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	bind := &recordingBind{Bind: dev.net.bind}
+	dev.net.Lock()
+	dev.net.bind = bind
+	dev.net.Unlock()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.AddPeer(PeerConfig{PublicKey: sk.publicKey(), Endpoint: "192.0.2.1:51820"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][3]int{{-1, 10, 20}, {MaxJunkPackets + 1, 10, 20}, {1, 0, 20}, {1, 30, 20}, {1, 10, MaxMessageSize + 1}} {
+		if err := peer.SetJunkPackets(bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("SetJunkPackets%v accepted", bad)
+		}
+	}
+	if err := peer.SetJunkPackets(3, 10, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.SendHandshakeInitiation(false); err != nil {
+		t.Fatal(err)
+	}
+
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	if len(bind.sizes) != 4 || bind.sizes[3] != MessageInitiationSize {
+		t.Fatalf("sent datagrams of sizes %v; want 3 junk packets and an initiation", bind.sizes)
+	}
+	for _, size := range bind.sizes[:3] {
+		if size < 10 || size > 20 {
+			t.Errorf("junk packet of %d bytes outside [10, 20]", size)
+		}
+	}
+}
+
+func TestPublicKey(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk := dev.Config().PrivateKey
+	if got, want := dev.PublicKey(), sk.publicKey(); !got.Equals(want) {
+		t.Errorf("PublicKey = %x; want %x", got, want)
+	}
+	sk2, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetPrivateKey(sk2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dev.PublicKey(), sk2.publicKey(); !got.Equals(want) {
+		t.Errorf("after SetPrivateKey, PublicKey = %x; want %x", got, want)
+	}
+}
+
+// stuckBind is a Bind whose Open blocks until release is closed, or until
+// ctx is done when opened with OpenContext.
+type stuckBind struct {
+	conn.Bind
+	release chan struct{}
+}
+
+func (b *stuckBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	<-b.release
+	return b.Bind.Open(port)
+}
+
+func (b *stuckBind) OpenContext(ctx context.Context, port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	select {
+	case <-b.release:
+		return b.Bind.Open(port)
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+func TestBindOpenTimeout(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	if err := dev.SetBindOpenTimeout(-time.Second); err == nil {
+		t.Errorf("negative timeout accepted")
+	}
+	bind := &stuckBind{release: make(chan struct{})}
+	defer close(bind.release)
+	dev.net.Lock()
+	bind.Bind = dev.net.bind
+	dev.net.bind = bind
+	dev.net.Unlock()
+	if err := dev.SetBindOpenTimeout(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Up error = %v; want deadline exceeded", err)
+	}
+	if dev.IsUp() {
+		t.Errorf("device is up after bind open timed out")
+	}
+}
+
+func TestExportState(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair[0].dev.SetSessionExport(true)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	var peer, remote *Peer
+	for _, p := range pair[0].dev.peers.keyMap {
+		peer = p
+	}
+	for _, p := range pair[1].dev.peers.keyMap {
+		remote = p
+	}
+	state := peer.ExportState()
+	if state.Session == nil {
+		t.Fatal("no session exported")
+	}
+	if again := peer.ExportState(); again.Session != nil {
+		t.Errorf("session exported twice")
+	}
+	peer.keypairs.RLock()
+	if keys := *peer.keypairs.current.keys; keys != (sessionKeys{}) {
+		t.Errorf("raw keys retained after export")
+	}
+	peer.keypairs.RUnlock()
+	if next := atomic.LoadUint64(&remote.keypairs.Current().receiveNext); next != 0 {
+		t.Errorf("receive counter tracked without session export: %d", next)
+	}
+	if s := fmt.Sprint(state.Session.SendKey); s != "(redacted)" {
+		t.Errorf("session key not redacted: %s", s)
+	}
+
+	// Move pair[0] to a new device on the same bind.
+	cfg := pair[0].dev.Config()
+	pair[0].dev.net.RLock()
+	bind := pair[0].dev.net.bind
+	pair[0].dev.net.RUnlock()
+	pair[0].dev.Close()
+
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), bind, NewLogger(LogLevelVerbose, "dev0': "))
+	t.Cleanup(dev.Close)
+	if err := dev.SetPrivateKey(cfg.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	pc := cfg.Peers[0]
+	pc.Endpoint = ""
+	pc.State = &state
+	if _, err := dev.AddPeer(pc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dev.AddPeer(PeerConfig{PublicKey: NoisePublicKey{1}, State: &state}); err == nil {
+		t.Errorf("session index imported twice")
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	pair[0].tun, pair[0].dev = tun, dev
+
+	handshakes := remote.Handshakes()
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if remote.Handshakes() != handshakes {
+		t.Errorf("migrated session needed a new handshake")
+	}
+}
+
+func TestSourcePortRotation(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[1].dev
+	dev.SetSourcePortRotation(true)
+	port := func() uint16 {
+		dev.net.RLock()
+		defer dev.net.RUnlock()
+		return dev.net.port
+	}
+	before := port()
+
+	// pair[1] initiates the handshake, from a new port.
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if port() == before {
+		t.Errorf("source port %d was not rotated for the handshake", before)
+	}
+
+	// Traffic keeps flowing on the new port, without further rotation.
+	after := port()
+	pair.Send(t, Ping, nil)
+	if port() != after {
+		t.Errorf("source port changed without a new handshake")
+	}
+}
+
+// portlessBind is a Bind that fails to open on a random port.
+type portlessBind struct {
+	conn.Bind
+}
+
+func (b portlessBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	if port == 0 {
+		return nil, 0, errors.New("no random port")
+	}
+	return b.Bind.Open(port)
+}
+
+func TestSourcePortRotationFailure(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[1].dev
+	dev.SetSourcePortRotation(true)
+	dev.net.Lock()
+	dev.net.bind = portlessBind{dev.net.bind}
+	before := dev.net.port
+	dev.net.Unlock()
+
+	// The handshake is sent from the previous port once the new one fails.
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	dev.net.RLock()
+	after := dev.net.port
+	dev.net.RUnlock()
+	if after != before {
+		t.Errorf("after failed rotation, port = %d; want %d", after, before)
+	}
+
+	// Further handshakes within the interval are not rotated.
+	var peer *Peer
+	for _, p := range dev.peers.keyMap {
+		peer = p
+	}
+	if dev.rotateSourcePort(peer) {
+		t.Errorf("source port rotated again within %v", SourcePortRotationInterval)
+	}
+}
+
+func TestPeerDiagnostics(t *testing.T) {
+	pair := genTestPair(t, false)
+	var peer *Peer
+	for _, p := range pair[1].dev.peers.keyMap {
+		peer = p
+	}
+	if diag := peer.Diagnostics(); diag.Current != nil || !diag.LastHandshake.IsZero() {
+		t.Errorf("diagnostics before handshake = %+v; want no keypair and no handshake", diag)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	diag := peer.Diagnostics()
+	if diag.Current == nil {
+		t.Fatal("no current keypair after handshake")
+	}
+	if diag.Current.SendNonce == 0 || diag.Current.Age < 0 || !diag.Current.IsInitiator {
+		t.Errorf("current keypair = %+v; want initiator keypair that has sent packets", *diag.Current)
+	}
+	if current := peer.keypairs.Current(); diag.Current.LocalIndex != current.localIndex {
+		t.Errorf("LocalIndex = %d; want %d", diag.Current.LocalIndex, current.localIndex)
+	}
+	if diag.LastHandshake.IsZero() {
+		t.Errorf("LastHandshake is zero after handshake")
+	}
+	if diag.HandshakeAttempts != 0 {
+		t.Errorf("HandshakeAttempts = %d; want 0", diag.HandshakeAttempts)
+	}
+}
+
+// mtuTun is a tun.Device whose MTU can be changed without it reporting so.
+type mtuTun struct {
+	tun.Device
+	mtu int32
+}
+
+func (t *mtuTun) MTU() (int, error) { return int(atomic.LoadInt32(&t.mtu)), nil }
+
+func TestMTUChanged(t *testing.T) {
+	tdev := &mtuTun{Device: tuntest.NewChannelTUN().TUN(), mtu: 1420}
+	dev := NewDevice(tdev, conn.NewDefaultBind(), NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	dev.net.Lock()
+	dev.net.bind = &mtuBind{Bind: dev.net.bind, max: 1000}
+	dev.net.Unlock()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.AddPeer(PeerConfig{PublicKey: sk.publicKey(), Endpoint: "192.0.2.1:51820"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.SendBuffer(make([]byte, 1200))
+	if peer.PathMTU() == 0 {
+		t.Fatal("no path MTU learned")
+	}
+
+	atomic.StoreInt32(&tdev.mtu, 1280)
+	dev.MTUChanged()
+	if mtu := atomic.LoadInt32(&dev.tun.mtu); mtu != 1280 {
+		t.Errorf("MTU = %d after MTUChanged; want 1280", mtu)
+	}
+	if mtu := peer.PathMTU(); mtu != 0 {
+		t.Errorf("PathMTU = %d after MTU change; want 0", mtu)
+	}
+}
+
+func TestSinceLastHandshake(t *testing.T) {
+	pair := genTestPair(t, false)
+	var peer *Peer
+	for _, p := range pair[0].dev.peers.keyMap {
+		peer = p
+	}
+	if since := peer.Stats().SinceLastHandshake; since != 0 {
+		t.Errorf("SinceLastHandshake = %v before handshake; want 0", since)
+	}
+	pair.Send(t, Ping, nil)
+	start := time.Now()
+
+	// Pretend the wall clock was stepped back by an hour after the handshake.
+	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().Add(time.Hour).UnixNano())
+	time.Sleep(time.Millisecond)
+	since := peer.Stats().SinceLastHandshake
+	if since <= 0 || since > time.Since(start)+time.Second {
+		t.Errorf("SinceLastHandshake = %v; want a small positive duration", since)
+	}
+}
+
+func TestEndpointSelector(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var endpoints []conn.Endpoint
+	for _, s := range []string{"192.0.2.1:51820", "192.0.2.2:51820", "192.0.2.3:51820"} {
+		ep, err := dev.net.bind.ParseEndpoint(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints = append(endpoints, ep)
+	}
+
+	// Prefer the last candidate.
+	var offered int
+	peer.SetEndpointSelector(func(candidates []conn.Endpoint) conn.Endpoint {
+		offered = len(candidates)
+		return candidates[len(candidates)-1]
+	})
+	peer.SetEndpoints(endpoints)
+	if got, _ := peer.Endpoint(); got != "192.0.2.3:51820" || offered != 3 {
+		t.Errorf("selected endpoint %s out of %d; want 192.0.2.3:51820 out of 3", got, offered)
+	}
+
+	peer.SetEndpointFailover(true)
+	atomic.StoreUint32(&peer.timers.handshakeAttempts, MaxTimerHandshakes+1)
+	expiredRetransmitHandshake(peer)
+	if got, _ := peer.Endpoint(); got != "192.0.2.2:51820" || offered != 2 {
+		t.Errorf("failed over to %s out of %d; want 192.0.2.2:51820 out of 2", got, offered)
+	}
+
+	peer.SetEndpointSelector(nil)
+	peer.SetEndpoints(endpoints)
+	if got, _ := peer.Endpoint(); got != "192.0.2.1:51820" {
+		t.Errorf("endpoint without selector = %s; want 192.0.2.1:51820", got)
+	}
+}
+
+func TestPeerID(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	peer, err := dev.NewPeer(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := pk.MarshalText()
+	if id := peer.ID(); id != string(want) {
+		t.Errorf("ID = %q; want %q", id, want)
+	}
+	var parsed NoisePublicKey
+	if err := parsed.UnmarshalText([]byte(peer.ID())); err != nil || !parsed.Equals(pk) {
+		t.Errorf("ID %q does not round-trip to the public key: %v", peer.ID(), err)
+	}
+}
+
+// dscpBind is a Bind that records the DSCP value of each packet sent,
+// 0 for packets sent without one.
+type dscpBind struct {
+	conn.Bind
+	mu    sync.Mutex
+	marks []uint8
+}
+
+func (b *dscpBind) Send(buf []byte, ep conn.Endpoint) error {
+	return b.SendDSCP(buf, ep, 0)
+}
+
+func (b *dscpBind) SendDSCP(buf []byte, ep conn.Endpoint, dscp uint8) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.marks = append(b.marks, dscp)
+	return nil
+}
+
+func TestPeerDSCP(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	bind := &dscpBind{Bind: dev.net.bind}
+	dev.net.Lock()
+	dev.net.bind = bind
+	dev.net.Unlock()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.AddPeer(PeerConfig{PublicKey: sk.publicKey(), Endpoint: "192.0.2.1:51820"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.SetDSCP(64); err == nil {
+		t.Errorf("DSCP value 64 accepted")
+	}
+
+	peer.SendBuffer([]byte{1})
+	if err := peer.SetDSCP(46); err != nil {
+		t.Fatal(err)
+	}
+	peer.SendBuffer([]byte{2})
+	peer.SetDSCP(0)
+	peer.SendBuffer([]byte{3})
+
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	if want := []uint8{0, 46, 0}; !bytes.Equal(bind.marks, want) {
+		t.Errorf("DSCP marks = %v; want %v", bind.marks, want)
+	}
+}
+
+// flakyBind is a Bind whose Send fails with err the next failures times.
+type flakyBind struct {
+	conn.Bind
+	mu       sync.Mutex
+	failures int
+	err      error
+	sends    int
+}
+
+func (b *flakyBind) Send(buf []byte, ep conn.Endpoint) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sends++
+	if b.failures > 0 {
+		b.failures--
+		return &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendmsg", b.err)}
+	}
+	return nil
+}
+
+func TestSendRetries(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	bind := &flakyBind{Bind: dev.net.bind}
+	dev.net.Lock()
+	dev.net.bind = bind
+	dev.net.Unlock()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.AddPeer(PeerConfig{PublicKey: sk.publicKey(), Endpoint: "192.0.2.1:51820"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetSendRetries(MaxSendRetries+1, 0); err == nil {
+		t.Errorf("%d send retries accepted", MaxSendRetries+1)
+	}
+	if err := dev.SetSendRetries(1, 2*MaxSendRetryBackoff); err == nil {
+		t.Errorf("send retry backoff %v accepted", 2*MaxSendRetryBackoff)
+	}
+	if err := dev.SetSendRetries(2, time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(failures int, errno syscall.Errno) (sends int, err error) {
+		bind.mu.Lock()
+		bind.failures, bind.err, bind.sends = failures, errno, 0
+		bind.mu.Unlock()
+		err = peer.SendBuffer([]byte{1})
+		bind.mu.Lock()
+		defer bind.mu.Unlock()
+		return bind.sends, err
+	}
+	if sends, err := send(2, syscall.ENOBUFS); err != nil || sends != 3 {
+		t.Errorf("after 2 transient errors: err = %v, sends = %d; want nil, 3", err, sends)
+	}
+	if sends, err := send(3, syscall.EAGAIN); !errors.Is(err, syscall.EAGAIN) || sends != 3 {
+		t.Errorf("after 3 transient errors: err = %v, sends = %d; want EAGAIN, 3", err, sends)
+	}
+	if sends, err := send(1, syscall.EHOSTUNREACH); !errors.Is(err, syscall.EHOSTUNREACH) || sends != 1 {
+		t.Errorf("after a permanent error: err = %v, sends = %d; want EHOSTUNREACH, 1", err, sends)
+	}
+
+	stats := peer.Stats()
+	if stats.SendRetried != 2 || stats.SendRetryDrops != 1 || stats.SendErrors != 2 {
+		t.Errorf("SendRetried, SendRetryDrops, SendErrors = %d, %d, %d; want 2, 1, 2", stats.SendRetried, stats.SendRetryDrops, stats.SendErrors)
+	}
+	if m := dev.Metrics(); m.SendRetried != 2 || m.SendRetryDrops != 1 {
+		t.Errorf("metrics SendRetried, SendRetryDrops = %d, %d; want 2, 1", m.SendRetried, m.SendRetryDrops)
+	}
+}
+
+func TestPeerClose(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	dev := pair[0].dev
+	var peer *Peer
+	for _, p := range dev.peers.keyMap {
+		peer = p
+	}
+
+	if err := peer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if dev.LookupPeer(peer.PublicKey()) != nil {
+		t.Errorf("peer still configured after Close")
+	}
+	if peer.isRunning.Get() {
+		t.Errorf("peer still running after Close")
+	}
+	if peer.keypairs.Current() != nil || peer.keypairs.loadNext() != nil {
+		t.Errorf("keypairs not cleared after Close")
+	}
+	if n := dev.indexTable.Len(); n != 0 {
+		t.Errorf("%d indices still in use after Close", n)
+	}
+	if err := peer.Close(); err != ErrPeerClosed {
+		t.Errorf("second Close = %v; want ErrPeerClosed", err)
+	}
+}
+
+func TestTUNBackpressureCallback(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+
+	type event struct {
+		peer    *Peer
+		blocked time.Duration
+		err     error
+	}
+	events := make(chan event, 10)
+	pair[0].dev.SetTUNBackpressureCallback(20*time.Millisecond, func(peer *Peer, blocked time.Duration, err error) {
+		events <- event{peer, blocked, err}
+	})
+
+	// A prompt reader causes no callback.
+	pair.Send(t, Ping, nil)
+	select {
+	case e := <-events:
+		t.Fatalf("callback for a prompt write: %+v", e)
+	default:
+	}
+
+	// A slow reader blocks the write.
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	time.Sleep(50 * time.Millisecond)
+	<-pair[0].tun.Inbound
+	select {
+	case e := <-events:
+		if e.err != nil || e.blocked < 20*time.Millisecond || e.peer.PublicKey() != pair[1].dev.PublicKey() {
+			t.Errorf("callback(%v, %v, %v); want pair[1]'s peer, at least 20ms and no error", e.peer, e.blocked, e.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no callback for a blocked write")
+	}
+	if drops := pair[0].dev.Metrics().Drops.TUNWrite; drops != 0 {
+		t.Errorf("TUNWrite drops = %d after a slow but successful write; want 0", drops)
+	}
+}
+
+func TestResponderOnly(t *testing.T) {
+	pair := genTestPair(t, false)
+	var peer *Peer
+	for _, p := range pair[1].dev.peers.keyMap {
+		peer = p
+	}
+	peer.SetResponderOnly(true)
+
+	// pair[1] has a packet for pair[0], but waits for pair[0] to initiate.
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	time.Sleep(100 * time.Millisecond)
+	if n := peer.Stats().HandshakesInitiated; n != 0 {
+		t.Fatalf("responder-only peer initiated %d handshakes", n)
+	}
+
+	pair.Send(t, Pong, nil)
+	select {
+	case <-pair[0].tun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("staged packet not sent after the peer initiated a handshake")
+	}
+	pair.Send(t, Ping, nil)
+	if n := peer.Stats().HandshakesInitiated; n != 0 {
+		t.Errorf("responder-only peer initiated %d handshakes", n)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	pair := genTestPair(t, false)
+	events := pair[0].dev.Events()
+	if pair[0].dev.Events() != events {
+		t.Errorf("Events returned a different channel on the second call")
+	}
+	pair.Send(t, Ping, nil)
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case ev := <-events:
+			done = ev.Type == EventHandshakeComplete && ev.Peer != nil
+		case <-timeout:
+			t.Fatal("no handshake complete event")
+		}
+	}
+	pair[0].dev.Close()
+	for range events {
+	}
+	if _, ok := <-pair[0].dev.Events(); ok {
+		t.Errorf("Events after Close returned an open channel")
+	}
+}
+
+func TestEventsDropOldest(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	events := dev.Events()
+	for i := 0; i < EventQueueSize+10; i++ {
+		dev.emitEvent(EventPeerRoamed, nil, strconv.Itoa(i))
+	}
+	if n := len(events); n != EventQueueSize {
+		t.Errorf("%d events buffered; want %d", n, EventQueueSize)
+	}
+	if ev := <-events; ev.Endpoint != "10" {
+		t.Errorf("oldest event kept = %q; want %q", ev.Endpoint, "10")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	var peer *Peer
+	for _, p := range pair[0].dev.peers.keyMap {
+		peer = p
+	}
+
+	// The first packet after the limit is set fits the burst,
+	// the next ones exceed a rate of one byte per second.
+	peer.SetRateLimit(0, 1)
+	pair.Send(t, Ping, nil)
+	for i := 0; i < 3; i++ {
+		pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for peer.Stats().RxRateLimited < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := peer.Stats().RxRateLimited; n != 3 {
+		t.Errorf("RxRateLimited = %d; want 3", n)
+	}
+	if n := pair[0].dev.Metrics().Drops.RateLimited; n != 3 {
+		t.Errorf("Drops.RateLimited = %d; want 3", n)
+	}
+
+	peer.SetRateLimit(0, 0)
+	pair.Send(t, Ping, nil)
+}
+
+func TestCryptoInfo(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	info := dev.CryptoInfo()
+	if info.Construction != NoiseConstruction || info.ProtocolVersion != CurrentProtocolVersion {
+		t.Errorf("construction %q version %d; want %q version %d", info.Construction, info.ProtocolVersion, NoiseConstruction, CurrentProtocolVersion)
+	}
+	if len(info.Experimental) != 0 {
+		t.Errorf("experimental features %v on a new device", info.Experimental)
+	}
+
+	sk1, _ := newPrivateKey()
+	sk2, _ := newPrivateKey()
+	if _, err := dev.AddPeer(PeerConfig{PublicKey: sk1.publicKey(), PresharedKey: NoisePresharedKey{1}}); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.AddPeer(PeerConfig{PublicKey: sk2.publicKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.SetJunkPackets(2, 10, 20); err != nil {
+		t.Fatal(err)
+	}
+	dev.SetSourcePortRotation(true)
+
+	info = dev.CryptoInfo()
+	if info.Peers != 2 || info.PresharedKeyPeers != 1 {
+		t.Errorf("Peers, PresharedKeyPeers = %d, %d; want 2, 1", info.Peers, info.PresharedKeyPeers)
+	}
+	if want := []string{"junk-packets", "source-port-rotation"}; !reflect.DeepEqual(info.Experimental, want) {
+		t.Errorf("Experimental = %v; want %v", info.Experimental, want)
+	}
+}
+
+func TestSendPacingStop(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	var peer *Peer
+	for _, p := range pair[1].dev.peers.keyMap {
+		peer = p
+	}
+
+	// At one byte per second, the second packet waits for minutes.
+	peer.SetSendPacing(0, 1)
+	for i := 0; i < 3; i++ {
+		pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	}
+	time.Sleep(10 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		pair[1].dev.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked by send pacing")
+	}
+}
+
+func TestRateLimitTx(t *testing.T) {
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+	var peer *Peer
+	for _, p := range pair[1].dev.peers.keyMap {
+		peer = p
+	}
+
+	// The first packet fits the burst, the second is held back.
+	peer.SetRateLimit(1, 0)
+	pair.Send(t, Ping, nil)
+	pair[1].tun.Outbound <- tuntest.Ping(pair[0].ip, pair[1].ip)
+	select {
+	case <-pair[0].tun.Inbound:
+		t.Error("packet beyond the send rate limit was not delayed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		pair[1].dev.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked by the send rate limit")
+	}
+}
+
+// panickyBind wraps a Bind whose receive functions panic once it is
+// closed, as a careless custom Bind might, with conn.CloseSafeReceiveFunc.
+type panickyBind struct {
+	conn.Bind
+	closed    chan struct{}
+	receiving chan struct{} // signaled whenever a receive function is called
+	panics    int32         // accessed atomically
+}
+
+func (b *panickyBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	closed := make(chan struct{})
+	b.closed = closed
+	for i, fn := range fns {
+		fn := fn
+		fns[i] = conn.CloseSafeReceiveFunc(func(buf []byte) (int, conn.Endpoint, error) {
+			select {
+			case b.receiving <- struct{}{}:
+			default:
+			}
+			n, ep, err := fn(buf)
+			if err != nil {
+				atomic.AddInt32(&b.panics, 1)
+				panic("send on closed channel")
+			}
+			return n, ep, err
+		}, closed)
+	}
+	return fns, actualPort, nil
+}
+
+func (b *panickyBind) Close() error {
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	return b.Bind.Close()
+}
+
+func TestCloseSafeReceiveFunc(t *testing.T) {
+	bind := &panickyBind{
+		Bind:      bindtest.NewChannelBinds()[0],
+		receiving: make(chan struct{}, 1),
+	}
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bind, NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+		// Close the bind while a receive function is blocked in it.
+		select {
+		case <-bind.receiving:
+		case <-time.After(5 * time.Second):
+			t.Fatal("receive functions not called")
+		}
+		if err := dev.Down(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.IsUp() {
+		t.Errorf("device not up after its receive functions panicked")
+	}
+	if atomic.LoadInt32(&bind.panics) == 0 {
+		t.Errorf("receive functions never panicked")
+	}
+}
+
+func TestPaddingMultiple(t *testing.T) {
+	for _, tt := range []struct {
+		size, mtu, multiple, want int
+	}{
+		{0, 1420, 16, 0},
+		{1, 1420, 16, 15},
+		{100, 1420, 256, 156},
+		{300, 1420, 256, 212},
+		{1300, 1420, 256, 120}, // clamped to the MTU
+		{100, 0, 64, 28},
+	} {
+		if got := calculatePaddingSize(tt.size, tt.mtu, tt.multiple); got != tt.want {
+			t.Errorf("padding of %d bytes to %d within MTU %d = %d; want %d", tt.size, tt.multiple, tt.mtu, got, tt.want)
+		}
+	}
+
+	pair := genTestPair(t, false)
+	dev := pair[1].dev
+	for _, bad := range []int{0, 8, 24, 4096} {
+		if err := dev.SetPaddingMultiple(bad); err == nil {
+			t.Errorf("padding multiple %d accepted", bad)
+		}
+	}
+	pair.Send(t, Ping, nil)
+
+	// The ping is sent by pair[1] as a single data packet.
+	if err := dev.SetPaddingMultiple(256); err != nil {
+		t.Fatal(err)
+	}
+	var peer *Peer
+	for _, p := range dev.peers.keyMap {
+		peer = p
+	}
+	sent := atomic.LoadUint64(&peer.stats.txBytes)
+	pair.Send(t, Ping, nil)
+	if got, want := atomic.LoadUint64(&peer.stats.txBytes)-sent, uint64(MessageTransportSize+256); got != want {
+		t.Errorf("data packet of %d bytes with a padding multiple of 256; want %d", got, want)
+	}
+}
+
+func TestSendBufferErrors(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := peer.SendBuffer([]byte{0}); !errors.Is(err, ErrNoEndpoint) {
+		t.Errorf("SendBuffer without endpoint = %v; want ErrNoEndpoint", err)
+	}
+
+	dev.net.Lock()
+	bind := dev.net.bind
+	dev.net.bind = nil
+	dev.net.Unlock()
+	err = peer.SendBuffer([]byte{0})
+	dev.net.Lock()
+	dev.net.bind = bind
+	dev.net.Unlock()
+	if !errors.Is(err, ErrNoBind) {
+		t.Errorf("SendBuffer without bind = %v; want ErrNoBind", err)
+	}
+}
+
+func TestPeerEndpoint(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := dev.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst, ok := peer.Endpoint(); ok || dst != "" {
+		t.Errorf("Endpoint of a new peer = %q, %v; want none", dst, ok)
+	}
+
+	pk := sk.publicKey()
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]), "endpoint", "[2001:db8::1]:51820")); err != nil {
+		t.Fatal(err)
+	}
+	if dst, ok := peer.Endpoint(); !ok || dst != "[2001:db8::1]:51820" {
+		t.Errorf("Endpoint after configuration = %q, %v; want [2001:db8::1]:51820", dst, ok)
+	}
+
+	roamed, err := dev.net.bind.ParseEndpoint("192.0.2.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.SetEndpointFromPacket(roamed)
+	if dst, ok := peer.Endpoint(); !ok || dst != "192.0.2.1:1234" {
+		t.Errorf("Endpoint after roaming = %q, %v; want 192.0.2.1:1234", dst, ok)
+	}
+}
+
+func TestPeerHandshakes(t *testing.T) {
+	pair := genTestPair(t, false)
+	var peers [2]*Peer
+	for i := range pair {
+		for _, p := range pair[i].dev.peers.keyMap {
+			peers[i] = p
+		}
+		if n := peers[i].Handshakes(); n != 0 {
+			t.Errorf("dev%d: %d handshakes before any traffic; want 0", i, n)
+		}
+	}
+
+	// Each side counts the handshake once, as initiator or responder.
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	for i, peer := range peers {
+		if n := peer.Handshakes(); n != 1 {
+			t.Errorf("dev%d: %d handshakes after one; want 1", i, n)
+		}
+		if n := peer.Stats().HandshakesCompleted; n != peer.Handshakes() {
+			t.Errorf("dev%d: Stats reports %d handshakes; Handshakes %d", i, n, peer.Handshakes())
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"time"
+)
+
+// An EventType identifies what happened in an Event.
+type EventType int
+
+const (
+	// EventHandshakeComplete reports that a handshake with the peer
+	// completed, as initiator or responder, and a new session is in use.
+	EventHandshakeComplete EventType = iota
+	// EventPeerRoamed reports that the peer's endpoint changed to Endpoint
+	// because an authenticated packet arrived from there.
+	EventPeerRoamed
+	// EventHandshakeFailed reports that a handshake initiation to the peer
+	// went unanswered. Another one is sent right away.
+	EventHandshakeFailed
+	// EventHandshakeGaveUp reports that handshakes with the peer went
+	// unanswered for too long, so the device stopped trying until there
+	// is new traffic for the peer. This is when the callback set with
+	// SetHandshakeGiveUpCallback runs.
+	EventHandshakeGaveUp
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventHandshakeComplete:
+		return "handshake complete"
+	case EventPeerRoamed:
+		return "peer roamed"
+	case EventHandshakeFailed:
+		return "handshake failed"
+	case EventHandshakeGaveUp:
+		return "handshake gave up"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// An Event is something that happened to the connectivity of a peer.
+type Event struct {
+	Type     EventType
+	Peer     *Peer
+	Time     time.Time
+	Endpoint string // the new endpoint for EventPeerRoamed, empty otherwise
+}
+
+// Events returns a channel on which the device reports handshakes and
+// roaming as they happen, from the first call to Events on. Every call
+// returns the same channel, so events are meant for a single consumer.
+//
+// The channel buffers EventQueueSize events. If the consumer falls behind
+// and the buffer is full, the oldest event is discarded to make room for
+// the newest, so that the device never waits for the consumer; a consumer
+// that must not miss a change should therefore check the current state,
+// such as Peer.Stats, whenever it receives an event. The channel is
+// closed by Device.Close.
+func (device *Device) Events() <-chan Event {
+	device.events.Lock()
+	defer device.events.Unlock()
+	if device.events.c == nil {
+		device.events.c = make(chan Event, EventQueueSize)
+		if device.isClosed() {
+			close(device.events.c)
+		} else {
+			device.events.enabled.Set(true)
+		}
+	}
+	return device.events.c
+}
+
+// emitEvent reports an event of type typ for peer, if Events has been
+// called, discarding the oldest buffered event if the buffer is full.
+func (device *Device) emitEvent(typ EventType, peer *Peer, endpoint string) {
+	if !device.events.enabled.Get() {
+		return
+	}
+	ev := Event{Type: typ, Peer: peer, Time: time.Now(), Endpoint: endpoint}
+	device.events.Lock()
+	defer device.events.Unlock()
+	if !device.events.enabled.Get() {
+		return // closed in the meantime
+	}
+	for {
+		select {
+		case device.events.c <- ev:
+			return
+		default:
+		}
+		select {
+		case <-device.events.c:
+		default:
+		}
+	}
+}
+
+// closeEvents closes the channel returned by Events, if any.
+func (device *Device) closeEvents() {
+	device.events.Lock()
+	defer device.events.Unlock()
+	if device.events.enabled.Swap(false) {
+		close(device.events.c)
+	}
+}
@@ -35,6 +35,13 @@ func (table *IndexTable) Init() {
 	table.table = make(map[uint32]IndexTableEntry)
 }
 
+// Len returns the number of handshakes and keypairs in the table.
+func (table *IndexTable) Len() int {
+	table.RLock()
+	defer table.RUnlock()
+	return len(table.table)
+}
+
 func (table *IndexTable) Delete(index uint32) {
 	table.Lock()
 	defer table.Unlock()
@@ -91,6 +98,21 @@ func (table *IndexTable) NewIndexForHandshake(peer *Peer, handshake *Handshake)
 	}
 }
 
+// InsertKeypair maps index to keypair, and reports whether it could,
+// which it cannot if index is already in use.
+func (table *IndexTable) InsertKeypair(index uint32, peer *Peer, keypair *Keypair) bool {
+	table.Lock()
+	defer table.Unlock()
+	if _, found := table.table[index]; found {
+		return false
+	}
+	table.table[index] = IndexTableEntry{
+		peer:    peer,
+		keypair: keypair,
+	}
+	return true
+}
+
 func (table *IndexTable) Lookup(id uint32) IndexTableEntry {
 	table.RLock()
 	defer table.RUnlock()
@@ -24,6 +24,7 @@ import (
 
 type Keypair struct {
 	sendNonce    uint64 // accessed atomically
+	receiveNext  uint64 // one more than the highest counter received, accessed atomically
 	send         cipher.AEAD
 	receive      cipher.AEAD
 	replayFilter replay.Filter
@@ -31,6 +32,7 @@ type Keypair struct {
 	created      time.Time
 	localIndex   uint32
 	remoteIndex  uint32
+	keys         *sessionKeys // raw keys, retained only if the device exports sessions; protected by the Keypairs lock
 }
 
 type Keypairs struct {
@@ -57,5 +59,37 @@ func (kp *Keypairs) Current() *Keypair {
 func (device *Device) DeleteKeypair(key *Keypair) {
 	if key != nil {
 		device.indexTable.Delete(key.localIndex)
+		key.zeroKeys()
 	}
 }
+
+// zeroKeys erases the raw keys retained for export, if any.
+// The peer's Keypairs lock must be held.
+func (key *Keypair) zeroKeys() {
+	if key.keys != nil {
+		setZero(key.keys.send[:])
+		setZero(key.keys.receive[:])
+	}
+}
+
+// KeypairCount returns the number of keypairs currently held by the
+// device's peers, counting previous, current and next keypairs.
+// It is meant for debugging and for tests that check that keypairs are
+// released, for instance together with the IndexTableSize of Metrics.
+func (device *Device) KeypairCount() int {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	count := 0
+	for _, peer := range device.peers.keyMap {
+		keypairs := &peer.keypairs
+		keypairs.RLock()
+		for _, keypair := range [...]*Keypair{keypairs.previous, keypairs.current, keypairs.loadNext()} {
+			if keypair != nil {
+				count++
+			}
+		}
+		keypairs.RUnlock()
+	}
+	return count
+}
@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/blake2s"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// SetLogEndpointHashing controls how endpoints appear in the device's logs.
+// When enabled, each endpoint is logged as a keyed hash of its address,
+// which is stable for the lifetime of the device, so that log lines about
+// the same endpoint can be correlated without revealing IP addresses.
+// The key is random and never logged. By default, addresses are logged as is.
+func (device *Device) SetLogEndpointHashing(enabled bool) error {
+	device.logEndpoints.Lock()
+	defer device.logEndpoints.Unlock()
+	device.logEndpoints.hash = enabled
+	if enabled && device.logEndpoints.key == nil {
+		key := make([]byte, blake2s.Size)
+		if _, err := rand.Read(key); err != nil {
+			device.logEndpoints.hash = false
+			return err
+		}
+		device.logEndpoints.key = key
+	}
+	return nil
+}
+
+// endpointString returns endpoint as it should appear in logs.
+func (device *Device) endpointString(endpoint conn.Endpoint) string {
+	if endpoint == nil {
+		return "(none)"
+	}
+	return device.addrString(endpoint.DstToString())
+}
+
+// addrString returns the address addr as it should appear in logs.
+func (device *Device) addrString(addr string) string {
+	device.logEndpoints.RLock()
+	defer device.logEndpoints.RUnlock()
+	if !device.logEndpoints.hash {
+		return addr
+	}
+	mac, _ := blake2s.New128(device.logEndpoints.key)
+	mac.Write([]byte(addr))
+	return "endpoint#" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// errorString returns err as it should appear in logs. Errors from
+// sending, such as a *net.OpError, may include the remote address, which
+// is then replaced as by endpointString.
+func (device *Device) errorString(err error) string {
+	s := err.Error()
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Addr != nil {
+		if addr := opErr.Addr.String(); addr != "" {
+			if redacted := device.addrString(addr); redacted != addr {
+				s = strings.ReplaceAll(s, addr, redacted)
+			}
+		}
+	}
+	return s
+}
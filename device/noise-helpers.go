@@ -10,6 +10,7 @@ import (
 	"crypto/rand"
 	"crypto/subtle"
 	"hash"
+	"io"
 
 	"golang.org/x/crypto/blake2s"
 	"golang.org/x/crypto/curve25519"
@@ -82,7 +83,11 @@ func (sk *NoisePrivateKey) clamp() {
 }
 
 func newPrivateKey() (sk NoisePrivateKey, err error) {
-	_, err = rand.Read(sk[:])
+	return newPrivateKeyFrom(rand.Reader)
+}
+
+func newPrivateKeyFrom(r io.Reader) (sk NoisePrivateKey, err error) {
+	_, err = io.ReadFull(r, sk[:])
 	sk.clamp()
 	return
 }
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/blake2s"
@@ -188,7 +189,7 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	var err error
 	handshake.hash = InitialHash
 	handshake.chainKey = InitialChainKey
-	handshake.localEphemeral, err = newPrivateKey()
+	handshake.localEphemeral, err = device.newEphemeralKey()
 	if err != nil {
 		return nil, err
 	}
@@ -376,7 +377,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 
 	// create ephemeral key
 
-	handshake.localEphemeral, err = newPrivateKey()
+	handshake.localEphemeral, err = device.newEphemeralKey()
 	if err != nil {
 		return nil, err
 	}
@@ -560,12 +561,15 @@ func (peer *Peer) BeginSymmetricSession() error {
 	keypair := new(Keypair)
 	keypair.send, _ = chacha20poly1305.New(sendKey[:])
 	keypair.receive, _ = chacha20poly1305.New(recvKey[:])
+	if device.exportSessions.Get() {
+		keypair.keys = &sessionKeys{send: sendKey, receive: recvKey}
+	}
 
 	setZero(sendKey[:])
 	setZero(recvKey[:])
 
 	keypair.created = time.Now()
-	keypair.replayFilter.Reset()
+	keypair.replayFilter.Init(int(atomic.LoadInt32(&device.replayRingSize)))
 	keypair.isInitiator = isInitiator
 	keypair.localIndex = peer.handshake.localIndex
 	keypair.remoteIndex = peer.handshake.remoteIndex
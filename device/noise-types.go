@@ -7,6 +7,7 @@ package device
 
 import (
 	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 )
@@ -36,6 +37,34 @@ func loadExactHex(dst []byte, src string) error {
 	return nil
 }
 
+func loadExactBase64(dst []byte, src []byte) error {
+	slice := make([]byte, base64.StdEncoding.DecodedLen(len(src)))
+	n, err := base64.StdEncoding.Decode(slice, src)
+	if err != nil {
+		return err
+	}
+	if n != len(dst) {
+		return errors.New("base64 string does not fit the slice")
+	}
+	copy(dst, slice)
+	return nil
+}
+
+// loadExactKey decodes a key given either in hex, as UAPI does, or in base64,
+// as WireGuard configuration files do. The two are told apart by length.
+func loadExactKey(dst []byte, src string) error {
+	if len(src) == base64.StdEncoding.EncodedLen(len(dst)) {
+		return loadExactBase64(dst, []byte(src))
+	}
+	return loadExactHex(dst, src)
+}
+
+func marshalBase64(src []byte) []byte {
+	dst := make([]byte, base64.StdEncoding.EncodedLen(len(src)))
+	base64.StdEncoding.Encode(dst, src)
+	return dst
+}
+
 func (key NoisePrivateKey) IsZero() bool {
 	var zero NoisePrivateKey
 	return key.Equals(zero)
@@ -60,6 +89,29 @@ func (key *NoisePrivateKey) FromMaybeZeroHex(src string) (err error) {
 	return
 }
 
+// String returns a placeholder so that private keys are not
+// accidentally logged. Use MarshalText to serialize the key.
+func (key NoisePrivateKey) String() string {
+	return "(redacted)"
+}
+
+// MarshalText encodes the key in the standard WireGuard base64 format.
+func (key NoisePrivateKey) MarshalText() ([]byte, error) {
+	return marshalBase64(key[:]), nil
+}
+
+func (key *NoisePrivateKey) UnmarshalText(text []byte) error {
+	var k NoisePrivateKey
+	if err := loadExactBase64(k[:], text); err != nil {
+		return err
+	}
+	if !k.IsZero() {
+		k.clamp()
+	}
+	*key = k
+	return nil
+}
+
 func (key *NoisePublicKey) FromHex(src string) error {
 	return loadExactHex(key[:], src)
 }
@@ -73,6 +125,30 @@ func (key NoisePublicKey) Equals(tar NoisePublicKey) bool {
 	return subtle.ConstantTimeCompare(key[:], tar[:]) == 1
 }
 
+// MarshalText encodes the key in the standard WireGuard base64 format.
+func (key NoisePublicKey) MarshalText() ([]byte, error) {
+	return marshalBase64(key[:]), nil
+}
+
+func (key *NoisePublicKey) UnmarshalText(text []byte) error {
+	return loadExactBase64(key[:], text)
+}
+
 func (key *NoisePresharedKey) FromHex(src string) error {
 	return loadExactHex(key[:], src)
 }
+
+// String returns a placeholder so that preshared keys are not
+// accidentally logged. Use MarshalText to serialize the key.
+func (key NoisePresharedKey) String() string {
+	return "(redacted)"
+}
+
+// MarshalText encodes the key in the standard WireGuard base64 format.
+func (key NoisePresharedKey) MarshalText() ([]byte, error) {
+	return marshalBase64(key[:]), nil
+}
+
+func (key *NoisePresharedKey) UnmarshalText(text []byte) error {
+	return loadExactBase64(key[:], text)
+}
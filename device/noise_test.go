@@ -175,3 +175,37 @@ func TestNoiseHandshake(t *testing.T) {
 		assertEqual(t, out, testMsg)
 	}()
 }
+
+func TestHandshakeRandForTesting(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer, err := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	assertNil(t, err)
+
+	seed := bytes.Repeat([]byte{0x5a}, NoisePrivateKeySize)
+	var ephemerals [2]NoisePublicKey
+	for i := range ephemerals {
+		dev1.SetHandshakeRandForTesting(bytes.NewReader(seed))
+		msg, err := dev1.CreateMessageInitiation(peer)
+		assertNil(t, err)
+		ephemerals[i] = msg.Ephemeral
+	}
+	if ephemerals[0] != ephemerals[1] {
+		t.Errorf("ephemeral keys differ with a fixed random source")
+	}
+
+	dev1.SetHandshakeRandForTesting(bytes.NewReader(nil))
+	if _, err := dev1.CreateMessageInitiation(peer); err == nil {
+		t.Errorf("exhausted random source did not fail the handshake")
+	}
+
+	dev1.SetHandshakeRandForTesting(nil)
+	msg, err := dev1.CreateMessageInitiation(peer)
+	assertNil(t, err)
+	if msg.Ephemeral == ephemerals[0] {
+		t.Errorf("ephemeral key still fixed after restoring crypto/rand")
+	}
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+// pacerBurstTime is how far a pacer lets events run ahead of its rate
+// after a period of inactivity.
+const pacerBurstTime = 5 * time.Millisecond
+
+// A pacer spaces out events so that they do not exceed a sustained rate.
+// The zero value is an unlimited pacer.
+type pacer struct {
+	mu    sync.Mutex
+	rate  uint64        // units per second, 0 = unlimited
+	burst time.Duration // how far events may run ahead of rate
+	next  time.Time     // earliest time at which the next event may proceed
+}
+
+func (p *pacer) setRate(rate uint64) {
+	p.setRateBurst(rate, pacerBurstTime)
+}
+
+// setRateBurst is like setRate, but lets events run ahead of the rate by
+// burst instead of pacerBurstTime.
+func (p *pacer) setRateBurst(rate uint64, burst time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rate = rate
+	p.burst = burst
+	p.next = time.Time{}
+}
+
+// delay reserves n units and reports how long the caller
+// must wait before the event may proceed.
+func (p *pacer) delay(n uint64) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	if earliest := now.Add(-p.burst); p.next.Before(earliest) {
+		p.next = earliest
+	}
+	wait := p.next.Sub(now)
+	p.next = p.next.Add(time.Duration(n * uint64(time.Second) / p.rate))
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// allow reserves n units and reports true if the event may proceed right
+// away. Otherwise it reserves nothing and reports false, so that the event
+// can be dropped instead of delayed.
+func (p *pacer) allow(n uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rate == 0 {
+		return true
+	}
+	now := time.Now()
+	if earliest := now.Add(-p.burst); p.next.Before(earliest) {
+		p.next = earliest
+	}
+	if p.next.After(now) {
+		return false
+	}
+	p.next = p.next.Add(time.Duration(n * uint64(time.Second) / p.rate))
+	return true
+}
@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	var p pacer
+	if d := p.delay(1000); d != 0 {
+		t.Fatalf("unlimited pacer delayed by %v", d)
+	}
+
+	p.setRate(1000)
+	var last time.Duration
+	for i := 0; i < 100; i++ {
+		last = p.delay(1)
+	}
+	// 100 events at 1000/s span 100ms, less the permitted burst.
+	want := 100*time.Millisecond - pacerBurstTime - time.Millisecond
+	if last < want-10*time.Millisecond || last > want {
+		t.Errorf("delay of last event = %v; want about %v", last, want)
+	}
+
+	p.setRate(0)
+	if d := p.delay(1); d != 0 {
+		t.Errorf("pacer delayed by %v after being disabled", d)
+	}
+}
+
+func TestPacerAllow(t *testing.T) {
+	var p pacer
+	if !p.allow(1 << 20) {
+		t.Fatal("unlimited pacer refused an event")
+	}
+
+	// At 1000/s with a burst of 10ms, 10 events of 1 pass right away,
+	// after which events are refused until time catches up.
+	p.setRateBurst(1000, 10*time.Millisecond)
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if p.allow(1) {
+			allowed++
+		}
+	}
+	if allowed < 10 || allowed > 15 {
+		t.Errorf("%d of 100 events allowed at once; want about 10", allowed)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !p.allow(1) {
+		t.Errorf("event refused after the pacer caught up")
+	}
+}
@@ -7,14 +7,39 @@ package device
 
 import (
 	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.zx2c4.com/wireguard/conn"
 )
 
+var (
+	ErrNoBind     = errors.New("no bind")
+	ErrNoEndpoint = errors.New("no known endpoint for peer")
+	ErrNoKeypair  = errors.New("no current keypair for peer")
+
+	ErrEndpointNotAllowed = errors.New("endpoint not permitted by allowlist")
+
+	// ErrPeerIsSelf is returned when adding a peer whose public key is the
+	// device's own, with which a handshake could never succeed.
+	ErrPeerIsSelf = errors.New("peer public key equals the device's own public key")
+
+	// ErrPeerClosed is returned by Peer.Close when the peer had already
+	// been removed from its device.
+	ErrPeerClosed = errors.New("peer already closed")
+)
+
 type Peer struct {
 	isRunning    AtomicBool
 	sync.RWMutex // Mostly protects endpoint, but is generally taken whenever we modify peer
@@ -24,6 +49,8 @@ type Peer struct {
 	endpoint     conn.Endpoint
 	stopping     sync.WaitGroup // routines pending stop
 
+	lastReceivedFrom conn.Endpoint // source of the most recent authenticated packet
+
 	// These fields are accessed with atomic operations, which must be
 	// 64-bit aligned even on 32-bit platforms. Go guarantees that an
 	// allocated struct will be 64-bit aligned. So we place
@@ -33,23 +60,55 @@ type Peer struct {
 		txBytes           uint64 // bytes send to peer (endpoint)
 		rxBytes           uint64 // bytes received from peer
 		lastHandshakeNano int64  // nano seconds since epoch
+		lastHandshakeMono int64  // monotime of the last handshake, valid if lastHandshakeNano is not 0
+		lastReceiveNano   int64  // nano seconds since epoch of the last data packet received
+		handshakeRTTNano  int64  // round trip time of the last handshake we initiated
+		firstAttemptMono  int64  // monotime of the first initiation of the current attempt, 0 if none
+
+		handshakesInitiated uint64 // handshake initiations sent
+		handshakesCompleted uint64 // handshakes completed, as initiator or responder
+		sendErrors          uint64 // packets the bind failed to send
+		sendRetried         uint64 // packets resent after a transient send error
+		sendRetryDrops      uint64 // packets still failing after all resends
+		receiveErrors       uint64 // packets that failed decryption or replay checks
+		rxRateLimited       uint64 // packets dropped by the receive rate limit
+		outboundPeak        uint32 // largest depth seen of queue.outbound
 	}
 
 	disableRoaming bool
 
+	junk struct {
+		count            int // junk packets sent before each handshake initiation
+		minSize, maxSize int // size range of junk packets, in bytes
+	} // protected by the peer mutex
+
+	endpoints struct {
+		candidates  []conn.Endpoint // candidate endpoints, protected by the peer mutex
+		probe       bool            // send handshake initiations to every candidate, see SetEndpointProbing
+		pendingHost net.IP          // endpoint host awaiting a port, see SetEndpointHost
+		failover    bool            // move to the next candidate when handshakes fail
+		failovers   uint32          // candidates moved to since the last handshake, accessed atomically
+
+		// selector picks the endpoint among candidates, see
+		// SetEndpointSelector. Protected by the peer mutex.
+		selector func(candidates []conn.Endpoint) conn.Endpoint
+	}
+
 	timers struct {
 		retransmitHandshake     *Timer
 		sendKeepalive           *Timer
 		newHandshake            *Timer
 		zeroKeyMaterial         *Timer
 		persistentKeepalive     *Timer
+		keypairExpiring         *Timer
 		handshakeAttempts       uint32
 		needAnotherKeepalive    AtomicBool
 		sentLastMinuteHandshake AtomicBool
 	}
 
 	state struct {
-		sync.Mutex // protects against concurrent Start/Stop
+		sync.Mutex               // protects against concurrent Start/Stop
+		stop       chan struct{} // closed by Stop to interrupt waits of the routines
 	}
 
 	queue struct {
@@ -58,16 +117,142 @@ type Peer struct {
 		inbound  *autodrainingInboundQueue  // sequential ordering of tun writing
 	}
 
+	pacing struct {
+		packets pacer // packets per second
+		bytes   pacer // bytes per second
+	}
+
+	rateLimit struct {
+		tx pacer // bytes per second sent, excess is delayed
+		rx pacer // bytes per second received, excess is dropped
+	}
+
 	cookieGenerator             CookieGenerator
 	trieEntries                 list.List
-	persistentKeepaliveInterval uint32 // accessed atomically
+	persistentKeepaliveInterval uint32        // accessed atomically
+	keepaliveJitter             uint32        // percent, accessed atomically
+	stagedMaxAge                time.Duration // see SetStagedPacketMaxAge; protected by the peer mutex
+	pathMTU                     int32         // learned from EMSGSIZE, 0 = unknown; accessed atomically
+	dscp                        uint8         // see SetDSCP; protected by the peer mutex
+	manualKeepalive             AtomicBool
+	responderOnly               AtomicBool
+	protocolVersion             int        // as configured, 0 if never specified; protected by the peer lock
+	origin                      PeerOrigin // protected by the peer lock
 }
 
 func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
+	return device.AddPeer(PeerConfig{PublicKey: pk})
+}
+
+// AddPeer creates a peer configured according to cfg.
+// Unlike NewPeer followed by separate configuration, the peer's preshared key,
+// endpoint, persistent keepalive and allowed IPs are all in place
+// before the data path can route to it and before its routines start.
+func (device *Device) AddPeer(cfg PeerConfig) (*Peer, error) {
 	if device.isClosed() {
 		return nil, errors.New("device closed")
 	}
 
+	// validate configuration before touching any state
+	endpoint, allowedIPs, err := device.parsePeerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return device.addPeer(cfg, endpoint, allowedIPs)
+}
+
+// parsePeerConfig parses cfg.Endpoint with the device's bind, falling back
+// to the endpoint of cfg.State, and validates and normalizes cfg.AllowedIPs.
+func (device *Device) parsePeerConfig(cfg PeerConfig) (endpoint conn.Endpoint, allowedIPs []net.IPNet, err error) {
+	if cfg.ProtocolVersion != 0 && cfg.ProtocolVersion != CurrentProtocolVersion {
+		return nil, nil, fmt.Errorf("unsupported protocol version %d", cfg.ProtocolVersion)
+	}
+	if cfg.Endpoint == "" && cfg.State != nil {
+		cfg.Endpoint = cfg.State.Endpoint
+	}
+	if cfg.Endpoint != "" {
+		resolved, err := device.resolveEndpoint(cfg.Endpoint)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid endpoint %q: %w", cfg.Endpoint, err)
+		}
+		device.net.RLock()
+		if device.net.bind == nil {
+			device.net.RUnlock()
+			return nil, nil, ErrNoBind
+		}
+		endpoint, err = device.net.bind.ParseEndpoint(resolved)
+		device.net.RUnlock()
+		if err == nil && !device.endpointAllowed(endpoint) {
+			err = ErrEndpointNotAllowed
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid endpoint %q: %w", cfg.Endpoint, err)
+		}
+	}
+	allowedIPs = make([]net.IPNet, 0, len(cfg.AllowedIPs))
+	for _, ipnet := range cfg.AllowedIPs {
+		ipnet, err := normalizeAllowedIP(ipnet)
+		if err != nil {
+			return nil, nil, err
+		}
+		allowedIPs = append(allowedIPs, ipnet)
+	}
+	return endpoint, allowedIPs, nil
+}
+
+// resolveEndpoint returns the host:port endpoint s with its host looked up
+// with the device's resolver, if it is a name rather than an IP address.
+// Binds only parse addresses.
+func (device *Device) resolveEndpoint(s string) (string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", err
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i] // zone of a link-local IPv6 address
+	}
+	if net.ParseIP(host) != nil {
+		return s, nil
+	}
+	ips, err := device.resolver.LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no addresses for %s", host)
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// normalizeAllowedIP returns ipnet with its address in the 4- or 16-byte
+// form matching its mask, and masked.
+func normalizeAllowedIP(ipnet net.IPNet) (net.IPNet, error) {
+	_, bits := ipnet.Mask.Size()
+	ip := ipnet.IP.To4()
+	if bits == 8*net.IPv6len {
+		ip = ipnet.IP.To16()
+	}
+	if ip == nil || bits != 8*len(ip) {
+		return net.IPNet{}, fmt.Errorf("invalid allowed IP %v", ipnet.String())
+	}
+	return net.IPNet{IP: ip.Mask(ipnet.Mask), Mask: ipnet.Mask}, nil
+}
+
+// addPeer creates a peer from a configuration validated by parsePeerConfig.
+func (device *Device) addPeer(cfg PeerConfig, endpoint conn.Endpoint, allowedIPs []net.IPNet) (*Peer, error) {
+	peer, err := device.newPeer(cfg, endpoint, allowedIPs)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PersistentKeepalive != 0 && device.isUp() {
+		peer.sendKeepalive()
+	}
+	return peer, nil
+}
+
+// newPeer creates, configures and starts a peer.
+// endpoint and allowedIPs must already be validated.
+func (device *Device) newPeer(cfg PeerConfig, endpoint conn.Endpoint, allowedIPs []net.IPNet) (*Peer, error) {
 	// lock resources
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
@@ -80,12 +265,22 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 		return nil, errors.New("too many peers")
 	}
 
+	pk := cfg.PublicKey
+
+	// a static-static DH with ourselves is meaningless
+	if !device.staticIdentity.privateKey.IsZero() && pk.Equals(device.staticIdentity.publicKey) {
+		return nil, ErrPeerIsSelf
+	}
+
 	// create peer
 	peer := new(Peer)
 	peer.Lock()
 	defer peer.Unlock()
 
 	peer.cookieGenerator.Init(pk)
+	device.cookieClock.RLock()
+	peer.cookieGenerator.SetClock(device.cookieClock.now)
+	device.cookieClock.RUnlock()
 	peer.device = device
 	peer.queue.outbound = newAutodrainingOutboundQueue(device)
 	peer.queue.inbound = newAutodrainingInboundQueue(device)
@@ -102,10 +297,25 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	handshake.mutex.Lock()
 	handshake.precomputedStaticStatic = device.staticIdentity.privateKey.sharedSecret(pk)
 	handshake.remoteStatic = pk
+	handshake.presharedKey = cfg.PresharedKey
 	handshake.mutex.Unlock()
 
-	// reset endpoint
-	peer.endpoint = nil
+	// take over an exported session
+	if cfg.State != nil && cfg.State.Session != nil {
+		if err := peer.importSession(cfg.State.Session); err != nil {
+			return nil, err
+		}
+	}
+
+	// apply configuration
+	peer.endpoint = endpoint
+	peer.protocolVersion = cfg.ProtocolVersion
+	peer.origin = cfg.Origin
+	atomic.StoreUint32(&peer.persistentKeepaliveInterval, uint32(cfg.PersistentKeepalive))
+	for _, ipnet := range allowedIPs {
+		ones, _ := ipnet.Mask.Size()
+		device.allowedips.Insert(ipnet.IP, uint(ones), peer)
+	}
 
 	// add
 	device.peers.keyMap[pk] = peer
@@ -120,25 +330,116 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 }
 
 func (peer *Peer) SendBuffer(buffer []byte) error {
+	retries, backoff, err := peer.trySend(buffer)
+	if err != nil && retries > 0 && isTransientSendError(err) {
+		// Wait without holding any locks, so that neither BindUpdate
+		// nor the peer's receive path stalls behind the retries.
+		atomic.AddUint64(&peer.stats.sendRetried, 1)
+		for i := 0; i < retries && isTransientSendError(err); i++ {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > MaxSendRetryBackoff {
+				backoff = MaxSendRetryBackoff
+			}
+			_, _, err = peer.trySend(buffer)
+		}
+		if err != nil {
+			atomic.AddUint64(&peer.stats.sendRetryDrops, 1)
+		}
+	}
+	if err == nil {
+		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+	} else {
+		atomic.AddUint64(&peer.stats.sendErrors, 1)
+		if errors.Is(err, syscall.EMSGSIZE) {
+			peer.lowerPathMTU(len(buffer))
+		}
+	}
+	return err
+}
+
+// trySend sends buffer to the peer's current endpoint once, and returns
+// how SetSendRetries says to retry a transient error.
+func (peer *Peer) trySend(buffer []byte) (retries int, backoff time.Duration, err error) {
 	peer.device.net.RLock()
 	defer peer.device.net.RUnlock()
 
 	if peer.device.isClosed() {
-		return nil
+		return 0, 0, nil
 	}
 
 	peer.RLock()
 	defer peer.RUnlock()
 
+	if peer.device.net.bind == nil {
+		return 0, 0, ErrNoBind
+	}
 	if peer.endpoint == nil {
-		return errors.New("no known endpoint for peer")
+		return 0, 0, ErrNoEndpoint
 	}
+	if !peer.device.endpointAllowed(peer.endpoint) {
+		return 0, 0, ErrEndpointNotAllowed
+	}
+	return peer.device.net.sendRetries, peer.device.net.sendBackoff, peer.send(buffer, peer.endpoint)
+}
 
-	err := peer.device.net.bind.Send(buffer, peer.endpoint)
-	if err == nil {
-		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+// send transmits buffer to endpoint, marked with the peer's DSCP value if
+// it has one and the bind supports it. The caller must hold
+// peer.device.net.RLock and peer.RLock.
+func (peer *Peer) send(buffer []byte, endpoint conn.Endpoint) error {
+	if bind, ok := peer.device.net.bind.(conn.BindSendDSCP); ok && peer.dscp != 0 {
+		return bind.SendDSCP(buffer, endpoint, peer.dscp)
 	}
-	return err
+	return peer.device.net.bind.Send(buffer, endpoint)
+}
+
+// isTransientSendError reports whether err is one that sending again shortly
+// may well not run into, because it only means that buffers are full.
+func isTransientSendError(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EWOULDBLOCK)
+}
+
+// SetDSCP makes the packets sent to the peer carry the 6-bit DSCP value
+// dscp, such as 46 (expedited forwarding) for a peer carrying voice, instead
+// of the one set for the whole device with Device.BindSetDSCP. Zero, the
+// default, leaves the device's value in place. Per-peer values are applied
+// only if the bind implements conn.BindSendDSCP, as the default bind on
+// Linux does; otherwise they are ignored.
+func (peer *Peer) SetDSCP(dscp uint8) error {
+	if dscp > 63 {
+		return fmt.Errorf("invalid DSCP value %d", dscp)
+	}
+	peer.Lock()
+	defer peer.Unlock()
+	peer.dscp = dscp
+	return nil
+}
+
+// lowerPathMTU records that a datagram of size bytes was too big for the
+// path to the peer's endpoint.
+func (peer *Peer) lowerPathMTU(size int) {
+	mtu := int32(size - MessageTransportSize - 1)
+	if mtu <= 0 {
+		return
+	}
+	for {
+		old := atomic.LoadInt32(&peer.pathMTU)
+		if old != 0 && old <= mtu {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&peer.pathMTU, old, mtu) {
+			peer.device.log.Verbosef("%v - Path MTU lowered to %d", peer, mtu)
+			return
+		}
+	}
+}
+
+// PathMTU returns the largest packet that is known to fit through the tunnel
+// to the peer's current endpoint, as learned from sends that failed with
+// EMSGSIZE, or 0 if no send has failed that way. Padding of outgoing packets
+// is capped to it, but larger packets are still sent as they are.
+// It is forgotten when the peer's endpoint changes.
+func (peer *Peer) PathMTU() int {
+	return int(atomic.LoadInt32(&peer.pathMTU))
 }
 
 func (peer *Peer) String() string {
@@ -167,6 +468,13 @@ func (peer *Peer) String() string {
 	return string(b)
 }
 
+// ID returns the peer's public key in the standard WireGuard base64 format.
+// Unlike String, which abbreviates the key for display, it identifies the
+// peer unambiguously, so it suits map keys and structured logs.
+func (peer *Peer) ID() string {
+	return string(marshalBase64(peer.handshake.remoteStatic[:]))
+}
+
 func (peer *Peer) Start() {
 	// should never start a peer on a closed device
 	if peer.device.isClosed() {
@@ -195,6 +503,7 @@ func (peer *Peer) Start() {
 	peer.device.queue.encryption.wg.Add(1) // keep encryption queue open for our writes
 
 	peer.timersStart()
+	peer.state.stop = make(chan struct{})
 
 	device.flushInboundQueue(peer.queue.inbound)
 	device.flushOutboundQueue(peer.queue.outbound)
@@ -261,6 +570,7 @@ func (peer *Peer) Stop() {
 	peer.device.log.Verbosef("%v - Stopping", peer)
 
 	peer.timersStop()
+	close(peer.state.stop)
 	// Signal that RoutineSequentialSender and RoutineSequentialReceiver should exit.
 	peer.queue.inbound.c <- nil
 	peer.queue.outbound.c <- nil
@@ -270,11 +580,424 @@ func (peer *Peer) Stop() {
 	peer.ZeroAndFlushAll()
 }
 
+// Close removes the peer from its device, like Device.RemovePeer, and
+// returns once the peer's routines have exited, its key material has been
+// zeroed and its indices have been released. If the peer had already been
+// removed, Close returns ErrPeerClosed, but still only after the same
+// cleanup is complete.
+func (peer *Peer) Close() error {
+	device := peer.device
+	key := peer.handshake.remoteStatic
+	device.peers.Lock()
+	removed := device.peers.keyMap[key] != peer
+	if !removed {
+		removePeerLocked(device, peer, key)
+	}
+	device.peers.Unlock()
+
+	// Stop is a no-op for a peer that is not running, but it may still
+	// hold key material, such as an imported session.
+	peer.Stop()
+	peer.ZeroAndFlushAll()
+	if removed {
+		return ErrPeerClosed
+	}
+	return nil
+}
+
+// Origin reports whether the peer is part of the device's configuration
+// or was added dynamically, as set when it was created.
+func (peer *Peer) Origin() PeerOrigin {
+	peer.RLock()
+	defer peer.RUnlock()
+	return peer.origin
+}
+
+// PublicKey returns the peer's public key.
+func (peer *Peer) PublicKey() NoisePublicKey {
+	// remoteStatic never changes after the peer is created.
+	return peer.handshake.remoteStatic
+}
+
+// UnderCookieLoad reports whether the remote peer has recently answered a
+// handshake with a cookie reply, meaning it is under load and rate-limiting
+// our handshakes, and the cookie is still being echoed in new messages.
+func (peer *Peer) UnderCookieLoad() bool {
+	return peer.cookieGenerator.HasCookie()
+}
+
+// SetPresharedKey replaces the peer's preshared key without removing the
+// peer. The zero key disables the preshared key. Since the key only enters
+// the handshake, the current session is expired and, if the device is up,
+// a new handshake is initiated, so that traffic continues under the new key
+// after a single round trip. Setting the key the peer already has is a no-op.
+func (peer *Peer) SetPresharedKey(psk NoisePresharedKey) {
+	peer.handshake.mutex.Lock()
+	if subtle.ConstantTimeCompare(peer.handshake.presharedKey[:], psk[:]) == 1 {
+		peer.handshake.mutex.Unlock()
+		return
+	}
+	peer.handshake.presharedKey = psk
+	peer.handshake.mutex.Unlock()
+
+	peer.ExpireCurrentKeypairs()
+	if peer.device.isUp() {
+		peer.sendHandshakeInitiationAfterJitter()
+	}
+}
+
+// SetManualKeepalive controls whether the application, rather than the peer's
+// persistent keepalive timer, decides when persistent keepalives are sent.
+// While manual is true, the timer is suspended and the application is expected
+// to call SendKeepalive on its own schedule, for instance only while in the
+// foreground. Keepalives required by the protocol, such as those acknowledging
+// received data, are still sent automatically.
+func (peer *Peer) SetManualKeepalive(manual bool) {
+	peer.manualKeepalive.Set(manual)
+	if !manual {
+		peer.timersAnyAuthenticatedPacketTraversal()
+	}
+}
+
+// SetResponderOnly controls whether the peer only ever responds to
+// handshakes, never initiating one itself, as suits a hub whose peers are
+// clients that are usually offline. While enabled, the peer still answers
+// handshake initiations and exchanges data and keepalives over the resulting
+// sessions, but packets to it wait until it initiates a handshake, and
+// SendHandshakeInitiation does nothing. It is disabled by default.
+func (peer *Peer) SetResponderOnly(enabled bool) {
+	peer.responderOnly.Set(enabled)
+}
+
+// SetKeepaliveJitter makes the peer's persistent keepalive timer fire at a
+// random point up to percent of the interval early, so that keepalives do
+// not form a fixed pattern on the wire. Keepalives are never delayed beyond
+// the configured interval, which keeps NAT mappings alive as before.
+// The default of 0 disables jitter; at most MaxKeepaliveJitterPercent is allowed.
+func (peer *Peer) SetKeepaliveJitter(percent int) error {
+	if percent < 0 || percent > MaxKeepaliveJitterPercent {
+		return fmt.Errorf("keepalive jitter %d%% is not between 0%% and %d%%", percent, MaxKeepaliveJitterPercent)
+	}
+	atomic.StoreUint32(&peer.keepaliveJitter, uint32(percent))
+	return nil
+}
+
+// SetStagedPacketMaxAge bounds how long a packet may wait for a handshake
+// to complete. Packets staged for longer than d when a session becomes
+// available are dropped instead of being sent late, which suits real-time
+// traffic for which a stale packet is useless. A d of 0, the default,
+// sends staged packets however long they waited.
+func (peer *Peer) SetStagedPacketMaxAge(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("invalid staged packet age %v", d)
+	}
+	peer.Lock()
+	defer peer.Unlock()
+	peer.stagedMaxAge = d
+	return nil
+}
+
+// SetJunkPackets makes the peer precede each handshake initiation with count
+// datagrams of random content, each between minSize and maxSize bytes long,
+// so that handshakes are harder to recognize by their sizes. A count of 0,
+// the default, disables junk packets.
+//
+// Junk packets are silently dropped by a standard WireGuard peer, but some
+// obfuscating implementations expect a particular number and size of them,
+// so both ends must agree on these settings to interoperate.
+func (peer *Peer) SetJunkPackets(count, minSize, maxSize int) error {
+	if count < 0 || count > MaxJunkPackets {
+		return fmt.Errorf("junk packet count %d is not between 0 and %d", count, MaxJunkPackets)
+	}
+	if count > 0 && (minSize < 1 || minSize > maxSize || maxSize > MaxMessageSize) {
+		return fmt.Errorf("invalid junk packet size range %d-%d", minSize, maxSize)
+	}
+	peer.Lock()
+	defer peer.Unlock()
+	peer.junk.count = count
+	peer.junk.minSize = minSize
+	peer.junk.maxSize = maxSize
+	return nil
+}
+
+// sendJunk sends the junk packets configured by SetJunkPackets.
+func (peer *Peer) sendJunk() {
+	peer.RLock()
+	junk := peer.junk
+	peer.RUnlock()
+
+	for i := 0; i < junk.count; i++ {
+		packet := make([]byte, junk.minSize+mrand.Intn(junk.maxSize-junk.minSize+1))
+		if _, err := rand.Read(packet); err != nil {
+			peer.device.log.Errorf("%v - Failed to generate junk packet: %v", peer, err)
+			return
+		}
+		if err := peer.SendBuffer(packet); err != nil {
+			peer.device.log.Verbosef("%v - Failed to send junk packet: %v", peer, peer.device.errorString(err))
+			return
+		}
+	}
+}
+
+// isIdle reports whether peer has no packets queued and no handshake in flight.
+func (peer *Peer) isIdle() bool {
+	return len(peer.queue.staged) == 0 &&
+		len(peer.queue.outbound.c) == 0 &&
+		len(peer.queue.inbound.c) == 0 &&
+		!peer.timers.retransmitHandshake.IsPending()
+}
+
+// Endpoint returns the destination address of the peer's current endpoint.
+// It reports ok=false if the peer has no known endpoint,
+// which is the case until it is configured with one or has been heard from.
+func (peer *Peer) Endpoint() (dst string, ok bool) {
+	peer.RLock()
+	defer peer.RUnlock()
+	if peer.endpoint == nil {
+		return "", false
+	}
+	return peer.endpoint.DstToString(), true
+}
+
+// EndpointMetadata returns the opaque metadata of the peer's current
+// endpoint, as reported by conn.EndpointMetadata, or nil if the peer
+// has no endpoint or it carries no metadata.
+func (peer *Peer) EndpointMetadata() interface{} {
+	peer.RLock()
+	defer peer.RUnlock()
+	if peer.endpoint == nil {
+		return nil
+	}
+	return conn.EndpointMetadata(peer.endpoint)
+}
+
+// sameEndpoint reports whether a and b have the same source and destination.
+func sameEndpoint(a, b conn.Endpoint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a == b || a.DstToString() == b.DstToString() && a.SrcToString() == b.SrcToString()
+}
+
 func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
-	if peer.disableRoaming {
+	roam := peer.device.endpointAllowed(endpoint)
+
+	// Packets mostly keep coming from where the previous ones did, so
+	// only take the write lock if something changes.
+	peer.RLock()
+	unchanged := sameEndpoint(peer.lastReceivedFrom, endpoint) &&
+		(peer.disableRoaming || !roam || sameEndpoint(peer.endpoint, endpoint))
+	peer.RUnlock()
+	if unchanged {
 		return
 	}
+
+	var roamed string // new endpoint, only computed if events are enabled
 	peer.Lock()
-	peer.endpoint = endpoint
+	peer.lastReceivedFrom = endpoint
+	if !peer.disableRoaming && roam {
+		if atomic.LoadInt32(&peer.pathMTU) != 0 && (peer.endpoint == nil || peer.endpoint.DstToString() != endpoint.DstToString()) {
+			atomic.StoreInt32(&peer.pathMTU, 0)
+		}
+		if peer.device.events.enabled.Get() && (peer.endpoint == nil || peer.endpoint.DstToString() != endpoint.DstToString()) {
+			roamed = endpoint.DstToString()
+		}
+		peer.endpoint = endpoint
+	}
 	peer.Unlock()
+	if roamed != "" {
+		peer.device.emitEvent(EventPeerRoamed, peer, roamed)
+	}
+}
+
+// SetSendPacing limits the rate at which packets are transmitted to the peer,
+// smoothing out bursts of queued packets. A rate of zero disables that limit.
+// Packets exceeding the rate are delayed, not dropped.
+func (peer *Peer) SetSendPacing(packetsPerSecond, bytesPerSecond uint64) {
+	peer.pacing.packets.setRate(packetsPerSecond)
+	peer.pacing.bytes.setRate(bytesPerSecond)
+}
+
+// SetRateLimit caps the bandwidth of the peer, in bytes per second of
+// WireGuard packets as counted by Stats, so that one peer cannot take more
+// than its share of a shared host. Packets sent beyond txBytesPerSec are
+// delayed, and once the outbound queue is full, dropped like any other
+// packets the link cannot keep up with. Data packets received beyond
+// rxBytesPerSec are dropped after decryption and counted as RxRateLimited;
+// the sender is expected to back off as for any other loss. Either limit
+// lets traffic run ahead by RateLimitBurstTime after a quiet period.
+// A rate of zero means unlimited, which is the default.
+func (peer *Peer) SetRateLimit(txBytesPerSec, rxBytesPerSec uint64) {
+	peer.rateLimit.tx.setRateBurst(txBytesPerSec, RateLimitBurstTime)
+	peer.rateLimit.rx.setRateBurst(rxBytesPerSec, RateLimitBurstTime)
+}
+
+// SetEndpoints sets the candidate endpoints of the peer
+// and selects the first candidate, or the one picked by the peer's
+// endpoint selector, as the current endpoint.
+func (peer *Peer) SetEndpoints(endpoints []conn.Endpoint) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.endpoints.candidates = endpoints
+	peer.endpoints.pendingHost = nil
+	atomic.StoreUint32(&peer.endpoints.failovers, 0)
+	atomic.StoreInt32(&peer.pathMTU, 0)
+	if len(endpoints) > 0 {
+		peer.endpoint = peer.selectEndpoint(endpoints)
+	}
+}
+
+// SetEndpointProbing controls whether every handshake initiation is sent
+// to all candidate endpoints set by SetEndpoints, rather than only to the
+// current endpoint, so that the peer roams to whichever candidate responds
+// first. Handshakes are repeated at least every RekeyAfterTime, so the
+// choice is periodically re-evaluated. Probing has no effect while the
+// peer has a single candidate or roaming is disabled. It is disabled by
+// default.
+func (peer *Peer) SetEndpointProbing(enabled bool) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.endpoints.probe = enabled
+}
+
+// SetEndpointSelector makes the peer pick its endpoint among candidates with
+// fn instead of taking the first, so that embedders can prefer candidates by
+// location, latency or otherwise. fn is called with the candidates whenever
+// SetEndpoints is, and with the candidates other than the current endpoint
+// when the peer fails over to another one. It must return one of them, or
+// nil to take the first. fn is called with the peer locked, so it must not
+// call methods of the peer. A nil fn restores the default.
+func (peer *Peer) SetEndpointSelector(fn func(candidates []conn.Endpoint) conn.Endpoint) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.endpoints.selector = fn
+}
+
+// selectEndpoint returns the endpoint the peer's selector picks among
+// candidates, which must not be empty. The caller must hold the peer mutex.
+func (peer *Peer) selectEndpoint(candidates []conn.Endpoint) conn.Endpoint {
+	if peer.endpoints.selector != nil {
+		if endpoint := peer.endpoints.selector(append([]conn.Endpoint(nil), candidates...)); endpoint != nil {
+			return endpoint
+		}
+	}
+	return candidates[0]
+}
+
+// SetEndpointFailover controls what happens when handshakes with the peer
+// keep failing. If enabled and the peer has several candidate endpoints,
+// as set by SetEndpoints, the peer moves on to the next candidate and starts
+// over instead of giving up, until every candidate has been tried without a
+// handshake completing. It is disabled by default.
+func (peer *Peer) SetEndpointFailover(enabled bool) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.endpoints.failover = enabled
+}
+
+// failoverEndpoint switches the peer to the candidate endpoint following
+// the current one, if endpoint failover allows it, and reports whether it did.
+func (peer *Peer) failoverEndpoint() bool {
+	peer.Lock()
+	defer peer.Unlock()
+	candidates := peer.endpoints.candidates
+	if !peer.endpoints.failover || len(candidates) < 2 ||
+		atomic.LoadUint32(&peer.endpoints.failovers) >= uint32(len(candidates)-1) {
+		return false
+	}
+	next, current := 0, -1
+	if peer.endpoint != nil {
+		for i, candidate := range candidates {
+			if candidate.DstToString() == peer.endpoint.DstToString() {
+				next, current = (i+1)%len(candidates), i
+				break
+			}
+		}
+	}
+	if peer.endpoints.selector == nil {
+		peer.endpoint = candidates[next]
+	} else {
+		others := candidates
+		if current >= 0 {
+			others = append(append([]conn.Endpoint(nil), candidates[:current]...), candidates[current+1:]...)
+		}
+		peer.endpoint = peer.selectEndpoint(others)
+	}
+	atomic.AddUint32(&peer.endpoints.failovers, 1)
+	atomic.StoreInt32(&peer.pathMTU, 0)
+	return true
+}
+
+// SetEndpointHost records host as the address of the peer's endpoint
+// without setting a port. The peer has no usable endpoint, and nothing is
+// sent to it, until the port is supplied with CompleteEndpoint.
+func (peer *Peer) SetEndpointHost(host net.IP) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.endpoint = nil
+	peer.endpoints.candidates = nil
+	peer.endpoints.pendingHost = host
+}
+
+// CompleteEndpoint sets the peer's endpoint to the host
+// previously recorded by SetEndpointHost and port.
+func (peer *Peer) CompleteEndpoint(port uint16) error {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+
+	peer.Lock()
+	defer peer.Unlock()
+
+	if peer.endpoints.pendingHost == nil {
+		return errors.New("no endpoint host awaiting a port")
+	}
+	if peer.device.net.bind == nil {
+		return ErrNoBind
+	}
+	s := net.JoinHostPort(peer.endpoints.pendingHost.String(), strconv.Itoa(int(port)))
+	endpoint, err := peer.device.net.bind.ParseEndpoint(s)
+	if err != nil {
+		return err
+	}
+	if !peer.device.endpointAllowed(endpoint) {
+		return ErrEndpointNotAllowed
+	}
+	peer.endpoint = endpoint
+	peer.endpoints.pendingHost = nil
+	atomic.StoreInt32(&peer.pathMTU, 0)
+	return nil
+}
+
+// sendProbes sends buffer to every candidate endpoint other than the current one,
+// if endpoint probing is enabled for the peer and it may roam.
+func (peer *Peer) sendProbes(buffer []byte) {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+
+	if peer.device.isClosed() {
+		return
+	}
+
+	peer.RLock()
+	defer peer.RUnlock()
+
+	if !peer.endpoints.probe || peer.disableRoaming || len(peer.endpoints.candidates) < 2 {
+		return
+	}
+
+	var current string
+	if peer.endpoint != nil {
+		current = peer.endpoint.DstToString()
+	}
+	for _, endpoint := range peer.endpoints.candidates {
+		if endpoint.DstToString() == current || !peer.device.endpointAllowed(endpoint) {
+			continue
+		}
+		err := peer.send(buffer, endpoint)
+		if err != nil {
+			peer.device.log.Verbosef("%v - Failed to send handshake probe to %s: %v", peer, peer.device.endpointString(endpoint), peer.device.errorString(err))
+			continue
+		}
+		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+	}
 }
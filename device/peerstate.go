@@ -0,0 +1,153 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A PeerState is the state of a peer's session, as exported by
+// Peer.ExportState, which a device on another host imports through
+// PeerConfig.State to carry on the session without a new handshake.
+//
+// A PeerState holds session keys: whoever obtains it can read and forge
+// the peer's traffic until the session expires. Treat it like the device's
+// private key, and only move it over an authenticated, encrypted channel.
+type PeerState struct {
+	Endpoint string        // empty if the peer has no known endpoint
+	Session  *SessionState // nil if the peer has no session that can be exported
+}
+
+// A SessionState is a single keypair of a peer.
+type SessionState struct {
+	SendKey        SessionKey // sensitive
+	ReceiveKey     SessionKey // sensitive
+	SendNonce      uint64     // next nonce to send with
+	ReceiveCounter uint64     // one more than the highest counter received, 0 if none
+	LocalIndex     uint32     // index under which the peer addresses us
+	RemoteIndex    uint32     // index under which we address the peer
+	IsInitiator    bool
+	Created        time.Time
+}
+
+// A SessionKey is a symmetric key of a session.
+type SessionKey [chacha20poly1305.KeySize]byte
+
+// String returns a placeholder so that session keys are not
+// accidentally logged. Use MarshalText to serialize the key.
+func (key SessionKey) String() string {
+	return "(redacted)"
+}
+
+// MarshalText encodes the key in the standard WireGuard base64 format.
+func (key SessionKey) MarshalText() ([]byte, error) {
+	return marshalBase64(key[:]), nil
+}
+
+func (key *SessionKey) UnmarshalText(text []byte) error {
+	return loadExactBase64(key[:], text)
+}
+
+// sessionKeys are the raw keys of a keypair, which the AEADs do not expose.
+type sessionKeys struct {
+	send, receive SessionKey
+}
+
+// SetSessionExport controls whether keypairs created from now on keep
+// their raw keys, which Peer.ExportState needs. It is off by default, so
+// that keys exist only inside the ciphers; turn it on well ahead of a
+// migration, or at least one rekey interval before.
+func (device *Device) SetSessionExport(enabled bool) {
+	device.exportSessions.Set(enabled)
+}
+
+// ExportState returns the state of the peer's current session, for a
+// device on another host to import through PeerConfig.State.
+//
+// Exporting hands the session over: this device stops sending with it,
+// since the importing device continues from the exported nonce and a nonce
+// must never be used twice. This device still accepts packets of the
+// session, and starts a new one if asked to send again. Session is nil if
+// there is no current session, it has expired or has already been
+// exported, or it was created while SetSessionExport was off. The raw keys
+// kept for export are erased once the session is exported, expired or
+// discarded.
+func (peer *Peer) ExportState() PeerState {
+	var state PeerState
+	peer.RLock()
+	if peer.endpoint != nil {
+		state.Endpoint = peer.endpoint.DstToString()
+	}
+	peer.RUnlock()
+
+	peer.keypairs.Lock()
+	defer peer.keypairs.Unlock()
+	keypair := peer.keypairs.current
+	if keypair == nil || keypair.keys == nil {
+		return state
+	}
+	if time.Since(keypair.created) >= RejectAfterTime {
+		keypair.zeroKeys()
+		return state
+	}
+	nonce := atomic.SwapUint64(&keypair.sendNonce, RejectAfterMessages)
+	if nonce >= RejectAfterMessages {
+		keypair.zeroKeys()
+		return state
+	}
+	state.Session = &SessionState{
+		SendKey:        keypair.keys.send,
+		ReceiveKey:     keypair.keys.receive,
+		SendNonce:      nonce,
+		ReceiveCounter: atomic.LoadUint64(&keypair.receiveNext),
+		LocalIndex:     keypair.localIndex,
+		RemoteIndex:    keypair.remoteIndex,
+		IsInitiator:    keypair.isInitiator,
+		Created:        keypair.created,
+	}
+	keypair.zeroKeys()
+	return state
+}
+
+// importSession installs s as the current keypair of the peer.
+func (peer *Peer) importSession(s *SessionState) error {
+	device := peer.device
+	if time.Since(s.Created) >= RejectAfterTime || s.SendNonce >= RejectAfterMessages {
+		return errors.New("imported session has expired")
+	}
+
+	keypair := new(Keypair)
+	keypair.send, _ = chacha20poly1305.New(s.SendKey[:])
+	keypair.receive, _ = chacha20poly1305.New(s.ReceiveKey[:])
+	if device.exportSessions.Get() {
+		keypair.keys = &sessionKeys{send: s.SendKey, receive: s.ReceiveKey}
+	}
+	keypair.sendNonce = s.SendNonce
+	keypair.receiveNext = s.ReceiveCounter
+	if err := keypair.replayFilter.Init(int(atomic.LoadInt32(&device.replayRingSize))); err != nil {
+		return err
+	}
+	keypair.replayFilter.Restore(s.ReceiveCounter)
+	keypair.isInitiator = s.IsInitiator
+	keypair.created = s.Created
+	keypair.localIndex = s.LocalIndex
+	keypair.remoteIndex = s.RemoteIndex
+
+	if !device.indexTable.InsertKeypair(s.LocalIndex, peer, keypair) {
+		return fmt.Errorf("session index %d is already in use", s.LocalIndex)
+	}
+	peer.keypairs.Lock()
+	peer.keypairs.current = keypair
+	peer.keypairs.Unlock()
+	atomic.StoreInt64(&peer.stats.lastHandshakeMono, monotime()-int64(time.Since(s.Created)))
+	atomic.StoreInt64(&peer.stats.lastHandshakeNano, s.Created.UnixNano())
+	return nil
+}
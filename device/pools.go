@@ -6,45 +6,140 @@
 package device
 
 import (
+	"fmt"
 	"sync"
 	"sync/atomic"
 )
 
 type WaitPool struct {
-	pool  sync.Pool
-	cond  sync.Cond
-	lock  sync.Mutex
-	count uint32
-	max   uint32
+	gets   uint64 // accessed atomically
+	misses uint64 // accessed atomically
+	pool   sync.Pool
+	cond   sync.Cond
+	lock   sync.Mutex
+	count  uint32 // items checked out while limited; accessed atomically
+	max    uint32 // accessed atomically
+}
+
+// WaitPoolStats reports the usage of a WaitPool. So that a pool without a
+// limit does not contend on shared counters, Hits, Misses and InUse only
+// count items checked out while the pool has a limit.
+type WaitPoolStats struct {
+	Hits   uint64 // Gets satisfied by a recycled item
+	Misses uint64 // Gets that had to allocate a new item
+	InUse  uint32 // items currently checked out
+	Max    uint32 // limit on InUse, 0 = unlimited
 }
 
 func NewWaitPool(max uint32, new func() interface{}) *WaitPool {
-	p := &WaitPool{pool: sync.Pool{New: new}, max: max}
+	p := &WaitPool{max: max}
+	p.pool.New = func() interface{} {
+		if atomic.LoadUint32(&p.max) != 0 {
+			atomic.AddUint64(&p.misses, 1)
+		}
+		return new()
+	}
 	p.cond = sync.Cond{L: &p.lock}
 	return p
 }
 
 func (p *WaitPool) Get() interface{} {
-	if p.max != 0 {
-		p.lock.Lock()
-		for atomic.LoadUint32(&p.count) >= p.max {
-			p.cond.Wait()
+	if atomic.LoadUint32(&p.max) == 0 {
+		return p.pool.Get()
+	}
+	p.lock.Lock()
+	for {
+		max := atomic.LoadUint32(&p.max)
+		if max == 0 || atomic.LoadUint32(&p.count) < max {
+			break
 		}
-		atomic.AddUint32(&p.count, 1)
-		p.lock.Unlock()
+		p.cond.Wait()
 	}
+	atomic.AddUint32(&p.count, 1)
+	p.lock.Unlock()
+	atomic.AddUint64(&p.gets, 1)
 	return p.pool.Get()
 }
 
 func (p *WaitPool) Put(x interface{}) {
 	p.pool.Put(x)
-	if p.max == 0 {
+	if atomic.LoadUint32(&p.max) == 0 {
 		return
 	}
-	atomic.AddUint32(&p.count, ^uint32(0))
+	// Items checked out before the limit was set were not counted.
+	for {
+		count := atomic.LoadUint32(&p.count)
+		if count == 0 || atomic.CompareAndSwapUint32(&p.count, count, count-1) {
+			break
+		}
+	}
 	p.cond.Signal()
 }
 
+// SetMax changes the maximum number of items that may be checked out at once.
+// Get blocks while the limit is reached. A max of 0 removes the limit.
+// Items checked out while there was no limit are not counted against it.
+func (p *WaitPool) SetMax(max uint32) {
+	p.lock.Lock()
+	if atomic.SwapUint32(&p.max, max) == 0 {
+		atomic.StoreUint32(&p.count, 0)
+	}
+	p.cond.Broadcast()
+	p.lock.Unlock()
+}
+
+func (p *WaitPool) Stats() WaitPoolStats {
+	gets := atomic.LoadUint64(&p.gets)
+	misses := atomic.LoadUint64(&p.misses)
+	if misses > gets {
+		misses = gets
+	}
+	return WaitPoolStats{
+		Hits:   gets - misses,
+		Misses: misses,
+		InUse:  atomic.LoadUint32(&p.count),
+		Max:    atomic.LoadUint32(&p.max),
+	}
+}
+
+// PoolStats reports the usage of a device's buffer and element pools.
+type PoolStats struct {
+	MessageBuffers   WaitPoolStats
+	InboundElements  WaitPoolStats
+	OutboundElements WaitPoolStats
+}
+
+func (device *Device) PoolStats() PoolStats {
+	return PoolStats{
+		MessageBuffers:   device.pool.messageBuffers.Stats(),
+		InboundElements:  device.pool.inboundElements.Stats(),
+		OutboundElements: device.pool.outboundElements.Stats(),
+	}
+}
+
+// SetPoolLimit caps the number of message buffers and of queue elements
+// the device may have in use at once, bounding its memory use to roughly
+// max*MaxMessageSize bytes. When the cap is reached, packet processing
+// waits for buffers to be returned. A max of 0 removes the cap, which is
+// the default on most platforms (see PreallocatedBuffersPerPool).
+// A cap below MinPoolLimit is rejected, since packets staged for a
+// handshake could then hold every buffer and stall the device.
+func (device *Device) SetPoolLimit(max uint32) error {
+	if max != 0 && max < device.MinPoolLimit() {
+		return fmt.Errorf("invalid pool limit %d, below the minimum of %d", max, device.MinPoolLimit())
+	}
+	device.pool.messageBuffers.SetMax(max)
+	device.pool.inboundElements.SetMax(max)
+	device.pool.outboundElements.SetMax(max)
+	return nil
+}
+
+// MinPoolLimit returns the lowest cap SetPoolLimit accepts: enough for a
+// peer's full queue of staged packets plus one packet per worker.
+func (device *Device) MinPoolLimit() uint32 {
+	return uint32(QueueStagedSize + device.numWorkers)
+}
+
 func (device *Device) PopulatePools() {
 	device.pool.messageBuffers = NewWaitPool(PreallocatedBuffersPerPool, func() interface{} {
 		return new([MaxMessageSize]byte)
@@ -86,3 +86,52 @@ func BenchmarkWaitPool(b *testing.B) {
 	}
 	wg.Wait()
 }
+
+func TestWaitPoolStatsAndLimit(t *testing.T) {
+	p := NewWaitPool(0, func() interface{} { return new(int) })
+	x := p.Get()
+	if s := p.Stats(); s != (WaitPoolStats{}) {
+		t.Errorf("after Get without a limit: %+v", s)
+	}
+	p.Put(x)
+
+	p.SetMax(1)
+	p.Get()
+	if s := p.Stats(); s.Hits+s.Misses != 1 || s.InUse != 1 || s.Max != 1 {
+		t.Errorf("after Get with a limit: %+v", s)
+	}
+	got := make(chan interface{})
+	go func() { got <- p.Get() }()
+	select {
+	case <-got:
+		t.Fatal("Get did not block at the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.SetMax(0)
+	select {
+	case <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get still blocked after removing the limit")
+	}
+	if s := p.Stats(); s.InUse != 2 || s.Max != 0 {
+		t.Errorf("after limit removed: %+v", s)
+	}
+}
+
+func TestSetPoolLimit(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	min := dev.MinPoolLimit()
+	if err := dev.SetPoolLimit(min - 1); err == nil {
+		t.Errorf("pool limit %d below the minimum %d accepted", min-1, min)
+	}
+	if err := dev.SetPoolLimit(min); err != nil {
+		t.Fatal(err)
+	}
+	if s := dev.PoolStats(); s.MessageBuffers.Max != min || s.OutboundElements.Max != min {
+		t.Errorf("pool stats after SetPoolLimit(%d) = %+v", min, s)
+	}
+	if err := dev.SetPoolLimit(0); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -98,7 +98,7 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
-			device.log.Verbosef("Failed to receive %s packet: %v", recvName, err)
+			device.log.Verbosef("Failed to receive %s packet: %v", recvName, device.errorString(err))
 			if neterr, ok := err.(net.Error); ok && !neterr.Temporary() {
 				return
 			}
@@ -112,7 +112,7 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 		}
 		deathSpiral = 0
 
-		if size < MinMessageSize {
+		if size < MinMessageSize || device.IsPaused() {
 			continue
 		}
 
@@ -132,6 +132,7 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 			// check size
 
 			if len(packet) < MessageTransportSize {
+				atomic.AddUint64(&device.drops.Malformed, 1)
 				continue
 			}
 
@@ -143,12 +144,14 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 			value := device.indexTable.Lookup(receiver)
 			keypair := value.keypair
 			if keypair == nil {
+				atomic.AddUint64(&device.drops.UnknownReceiver, 1)
 				continue
 			}
 
 			// check keypair expiry
 
 			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+				atomic.AddUint64(&device.drops.ExpiredKeypair, 1)
 				continue
 			}
 
@@ -270,7 +273,7 @@ func (device *Device) RoutineHandshake(id int) {
 			// consume reply
 
 			if peer := entry.peer; peer.isRunning.Get() {
-				device.log.Verbosef("Receiving cookie response from %s", elem.endpoint.DstToString())
+				device.log.Verbosef("Receiving cookie response from %s", device.endpointString(elem.endpoint))
 				if !peer.cookieGenerator.ConsumeReply(&reply) {
 					device.log.Verbosef("Could not decrypt invalid cookie response")
 				}
@@ -329,7 +332,7 @@ func (device *Device) RoutineHandshake(id int) {
 
 			peer := device.ConsumeMessageInitiation(&msg)
 			if peer == nil {
-				device.log.Verbosef("Received invalid initiation message from %s", elem.endpoint.DstToString())
+				device.log.Verbosef("Received invalid initiation message from %s", device.endpointString(elem.endpoint))
 				goto skip
 			}
 
@@ -362,14 +365,23 @@ func (device *Device) RoutineHandshake(id int) {
 
 			peer := device.ConsumeMessageResponse(&msg)
 			if peer == nil {
-				device.log.Verbosef("Received invalid response message from %s", elem.endpoint.DstToString())
+				device.log.Verbosef("Received invalid response message from %s", device.endpointString(elem.endpoint))
 				goto skip
 			}
 
 			// update endpoint
 			peer.SetEndpointFromPacket(elem.endpoint)
 
-			device.log.Verbosef("%v - Received handshake response", peer)
+			peer.handshake.mutex.RLock()
+			rtt := time.Since(peer.handshake.lastSentHandshake)
+			peer.handshake.mutex.RUnlock()
+			atomic.StoreInt64(&peer.stats.handshakeRTTNano, int64(rtt))
+
+			if device.logRTT.Get() {
+				device.log.Verbosef("%v - Received handshake response after %v", peer, rtt)
+			} else {
+				device.log.Verbosef("%v - Received handshake response", peer)
+			}
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
 
 			// update timers
@@ -388,7 +400,7 @@ func (device *Device) RoutineHandshake(id int) {
 
 			peer.timersSessionDerived()
 			peer.timersHandshakeComplete()
-			peer.SendKeepalive()
+			peer.sendKeepalive()
 		}
 	skip:
 		device.PutMessageBuffer(elem.buffer)
@@ -411,12 +423,21 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		elem.Lock()
 		if elem.packet == nil {
 			// decryption failed
+			atomic.AddUint64(&peer.stats.receiveErrors, 1)
+			atomic.AddUint64(&device.drops.Decryption, 1)
 			goto skip
 		}
 
 		if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
+			atomic.AddUint64(&peer.stats.receiveErrors, 1)
+			atomic.AddUint64(&device.drops.Replay, 1)
 			goto skip
 		}
+		// Only exportable sessions need the counter. keypair.keys is set
+		// when the keypair is created and never changes.
+		if next := elem.counter + 1; elem.keypair.keys != nil && next > atomic.LoadUint64(&elem.keypair.receiveNext) {
+			atomic.StoreUint64(&elem.keypair.receiveNext, next)
+		}
 
 		peer.SetEndpointFromPacket(elem.endpoint)
 		if peer.ReceivedWithKeypair(elem.keypair) {
@@ -435,49 +456,64 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		}
 		peer.timersDataReceived()
 
+		if !peer.rateLimit.rx.allow(uint64(len(elem.packet) + MinMessageSize)) {
+			atomic.AddUint64(&peer.stats.rxRateLimited, 1)
+			atomic.AddUint64(&device.drops.RateLimited, 1)
+			goto skip
+		}
+
 		switch elem.packet[0] >> 4 {
 		case ipv4.Version:
 			if len(elem.packet) < ipv4.HeaderLen {
+				atomic.AddUint64(&device.drops.Malformed, 1)
 				goto skip
 			}
 			field := elem.packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
 			length := binary.BigEndian.Uint16(field)
 			if int(length) > len(elem.packet) || int(length) < ipv4.HeaderLen {
+				atomic.AddUint64(&device.drops.Malformed, 1)
 				goto skip
 			}
 			elem.packet = elem.packet[:length]
 			src := elem.packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
-			if device.allowedips.LookupIPv4(src) != peer {
+			if !device.allowsSource(peer, src) {
 				device.log.Verbosef("IPv4 packet with disallowed source address from %v", peer)
+				atomic.AddUint64(&device.drops.DisallowedSource, 1)
 				goto skip
 			}
 
 		case ipv6.Version:
 			if len(elem.packet) < ipv6.HeaderLen {
+				atomic.AddUint64(&device.drops.Malformed, 1)
 				goto skip
 			}
 			field := elem.packet[IPv6offsetPayloadLength : IPv6offsetPayloadLength+2]
 			length := binary.BigEndian.Uint16(field)
 			length += ipv6.HeaderLen
 			if int(length) > len(elem.packet) {
+				atomic.AddUint64(&device.drops.Malformed, 1)
 				goto skip
 			}
 			elem.packet = elem.packet[:length]
 			src := elem.packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
-			if device.allowedips.LookupIPv6(src) != peer {
+			if !device.allowsSource(peer, src) {
 				device.log.Verbosef("IPv6 packet with disallowed source address from %v", peer)
+				atomic.AddUint64(&device.drops.DisallowedSource, 1)
 				goto skip
 			}
 
 		default:
 			device.log.Verbosef("Packet with invalid IP version from %v", peer)
+			atomic.AddUint64(&device.drops.Malformed, 1)
 			goto skip
 		}
+		atomic.StoreInt64(&peer.stats.lastReceiveNano, time.Now().UnixNano())
 
-		_, err = device.tun.device.Write(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent)
-		if err != nil && !device.isClosed() {
-			device.log.Errorf("Failed to write packet to TUN device: %v", err)
+		if inspect := device.inboundInspector(); inspect != nil && !inspect(peer, elem.packet) {
+			goto skip
 		}
+
+		device.writeToTUN(peer, elem)
 		if len(peer.queue.inbound.c) == 0 {
 			err = device.tun.device.Flush()
 			if err != nil {
@@ -489,3 +525,38 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		device.PutInboundElement(elem)
 	}
 }
+
+// allowsSource reports whether peer may send packets with the 4- or 16-byte
+// source address src.
+func (device *Device) allowsSource(peer *Peer, src []byte) bool {
+	if device.sourceTable != nil {
+		return device.sourceTable.AllowsSource(peer, src)
+	}
+	if len(src) == net.IPv4len {
+		return device.allowedips.LookupIPv4(src) == peer
+	}
+	return device.allowedips.LookupIPv6(src) == peer
+}
+
+// writeToTUN writes the decrypted packet of elem, received from peer, to the
+// TUN device, counting failures and reporting backpressure.
+func (device *Device) writeToTUN(peer *Peer, elem *QueueInboundElement) {
+	backpressure, threshold := device.tunBackpressure()
+	var start time.Time
+	if backpressure != nil {
+		start = time.Now()
+	}
+	_, err := device.tun.device.Write(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent)
+	if device.isClosed() {
+		return
+	}
+	if err != nil {
+		atomic.AddUint64(&device.drops.TUNWrite, 1)
+		device.log.Errorf("Failed to write packet to TUN device: %v", err)
+	}
+	if backpressure != nil {
+		if blocked := time.Since(start); err != nil || blocked > threshold {
+			backpressure(peer, blocked, err)
+		}
+	}
+}
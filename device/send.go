@@ -51,6 +51,7 @@ type QueueOutboundElement struct {
 	nonce   uint64                // nonce for encryption
 	keypair *Keypair              // keypair for encryption
 	peer    *Peer                 // related peer
+	staged  time.Time             // when the packet was first staged, zero if it was not
 }
 
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
@@ -58,6 +59,7 @@ func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	elem.buffer = device.GetMessageBuffer()
 	elem.Mutex = sync.Mutex{}
 	elem.nonce = 0
+	elem.staged = time.Time{}
 	// keypair and peer were cleared (if necessary) by clearPointers.
 	return elem
 }
@@ -73,9 +75,32 @@ func (elem *QueueOutboundElement) clearPointers() {
 	elem.peer = nil
 }
 
+// SendKeepalive sends a keepalive, an empty data packet, to the peer,
+// for instance to refresh NAT mappings after a network change.
+// Unlike the keepalives sent by the peer's timers, it does not start a
+// handshake: it returns ErrNoKeypair if there is no current session
+// and ErrNoEndpoint if the peer's address is unknown.
+func (peer *Peer) SendKeepalive() error {
+	if !peer.isRunning.Get() {
+		return errors.New("peer is not running")
+	}
+	peer.RLock()
+	hasEndpoint := peer.endpoint != nil
+	peer.RUnlock()
+	if !hasEndpoint {
+		return ErrNoEndpoint
+	}
+	keypair := peer.keypairs.Current()
+	if keypair == nil || atomic.LoadUint64(&keypair.sendNonce) >= RejectAfterMessages || time.Since(keypair.created) >= RejectAfterTime {
+		return ErrNoKeypair
+	}
+	peer.sendKeepalive()
+	return nil
+}
+
 /* Queues a keepalive if no packets are queued for peer
  */
-func (peer *Peer) SendKeepalive() {
+func (peer *Peer) sendKeepalive() {
 	if len(peer.queue.staged) == 0 && peer.isRunning.Get() {
 		elem := peer.device.NewOutboundElement()
 		select {
@@ -90,6 +115,9 @@ func (peer *Peer) SendKeepalive() {
 }
 
 func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
+	if peer.responderOnly.Get() {
+		return nil
+	}
 	if !isRetry {
 		atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
 	}
@@ -101,6 +129,10 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	}
 	peer.handshake.mutex.RUnlock()
 
+	if !isRetry && peer.device.rotateSourcePort(peer) {
+		return nil
+	}
+
 	peer.handshake.mutex.Lock()
 	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
 		peer.handshake.mutex.Unlock()
@@ -126,10 +158,14 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
+	atomic.AddUint64(&peer.stats.handshakesInitiated, 1)
+	atomic.CompareAndSwapInt64(&peer.stats.firstAttemptMono, 0, monotime())
+	peer.sendJunk()
 	err = peer.SendBuffer(packet)
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to send handshake initiation: %v", peer, err)
+		peer.device.log.Errorf("%v - Failed to send handshake initiation: %v", peer, peer.device.errorString(err))
 	}
+	peer.sendProbes(packet)
 	peer.timersHandshakeInitiated()
 
 	return err
@@ -166,13 +202,13 @@ func (peer *Peer) SendHandshakeResponse() error {
 
 	err = peer.SendBuffer(packet)
 	if err != nil {
-		peer.device.log.Errorf("%v - Failed to send handshake response: %v", peer, err)
+		peer.device.log.Errorf("%v - Failed to send handshake response: %v", peer, peer.device.errorString(err))
 	}
 	return err
 }
 
 func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement) error {
-	device.log.Verbosef("Sending cookie response for denied handshake message for %v", initiatingElem.endpoint.DstToString())
+	device.log.Verbosef("Sending cookie response for denied handshake message for %v", device.endpointString(initiatingElem.endpoint))
 
 	sender := binary.LittleEndian.Uint32(initiatingElem.packet[4:8])
 	reply, err := device.cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
@@ -239,7 +275,7 @@ func (device *Device) RoutineReadFromTUN() {
 			return
 		}
 
-		if size == 0 || size > MaxContentSize {
+		if size == 0 || size > MaxContentSize || device.IsPaused() {
 			continue
 		}
 
@@ -270,6 +306,9 @@ func (device *Device) RoutineReadFromTUN() {
 		if peer == nil {
 			continue
 		}
+		if inspect := device.outboundInspector(); inspect != nil && !inspect(peer, elem.packet) {
+			continue
+		}
 		if peer.isRunning.Get() {
 			peer.StagePacket(elem)
 			elem = nil
@@ -279,6 +318,9 @@ func (device *Device) RoutineReadFromTUN() {
 }
 
 func (peer *Peer) StagePacket(elem *QueueOutboundElement) {
+	if elem.staged.IsZero() {
+		elem.staged = time.Now()
+	}
 	for {
 		select {
 		case peer.queue.staged <- elem:
@@ -306,9 +348,18 @@ top:
 		return
 	}
 
+	peer.RLock()
+	maxAge := peer.stagedMaxAge
+	peer.RUnlock()
+
 	for {
 		select {
 		case elem := <-peer.queue.staged:
+			if maxAge > 0 && !elem.staged.IsZero() && time.Since(elem.staged) > maxAge {
+				peer.device.PutMessageBuffer(elem.buffer)
+				peer.device.PutOutboundElement(elem)
+				continue
+			}
 			elem.peer = peer
 			elem.nonce = atomic.AddUint64(&keypair.sendNonce, 1) - 1
 			if elem.nonce >= RejectAfterMessages {
@@ -323,6 +374,7 @@ top:
 			// add to parallel and sequential queue
 			if peer.isRunning.Get() {
 				peer.queue.outbound.c <- elem
+				peer.recordOutboundDepth()
 				peer.device.queue.encryption.c <- elem
 			} else {
 				peer.device.PutMessageBuffer(elem.buffer)
@@ -346,15 +398,19 @@ func (peer *Peer) FlushStagedPackets() {
 	}
 }
 
-func calculatePaddingSize(packetSize, mtu int) int {
+// paddingZeros is the source of padding bytes appended by RoutineEncryption.
+// It is never written to.
+var paddingZeros [MaxContentSize]byte
+
+func calculatePaddingSize(packetSize, mtu, multiple int) int {
 	lastUnit := packetSize
 	if mtu == 0 {
-		return ((lastUnit + PaddingMultiple - 1) & ^(PaddingMultiple - 1)) - lastUnit
+		return ((lastUnit + multiple - 1) & ^(multiple - 1)) - lastUnit
 	}
 	if lastUnit > mtu {
 		lastUnit %= mtu
 	}
-	paddedSize := ((lastUnit + PaddingMultiple - 1) & ^(PaddingMultiple - 1))
+	paddedSize := ((lastUnit + multiple - 1) & ^(multiple - 1))
 	if paddedSize > mtu {
 		paddedSize = mtu
 	}
@@ -367,7 +423,6 @@ func calculatePaddingSize(packetSize, mtu int) int {
  * Obs. One instance per core
  */
 func (device *Device) RoutineEncryption(id int) {
-	var paddingZeros [PaddingMultiple]byte
 	var nonce [chacha20poly1305.NonceSize]byte
 
 	defer device.log.Verbosef("Routine: encryption worker %d - stopped", id)
@@ -385,8 +440,12 @@ func (device *Device) RoutineEncryption(id int) {
 		binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
 		binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
 
-		// pad content to multiple of 16
-		paddingSize := calculatePaddingSize(len(elem.packet), int(atomic.LoadInt32(&device.tun.mtu)))
+		// pad content to the configured multiple (16 by default)
+		mtu := atomic.LoadInt32(&device.tun.mtu)
+		if pmtu := atomic.LoadInt32(&elem.peer.pathMTU); pmtu != 0 && pmtu < mtu {
+			mtu = pmtu
+		}
+		paddingSize := calculatePaddingSize(len(elem.packet), int(mtu), int(atomic.LoadInt32(&device.tun.padding)))
 		elem.packet = append(elem.packet, paddingZeros[:paddingSize]...)
 
 		// encrypt content and release to consumer
@@ -414,6 +473,7 @@ func (peer *Peer) RoutineSequentialSender() {
 		peer.stopping.Done()
 	}()
 	device.log.Verbosef("%v - Routine: sequential sender - started", peer)
+	stop := peer.state.stop
 
 	for elem := range peer.queue.outbound.c {
 		if elem == nil {
@@ -432,6 +492,29 @@ func (peer *Peer) RoutineSequentialSender() {
 			continue
 		}
 
+		// pace and rate limit transmission, if configured
+
+		delay := peer.pacing.packets.delay(1)
+		if d := peer.pacing.bytes.delay(uint64(len(elem.packet))); d > delay {
+			delay = d
+		}
+		if d := peer.rateLimit.tx.delay(uint64(len(elem.packet))); d > delay {
+			delay = d
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-stop:
+				// Drop the packet rather than hold up Stop; the queue
+				// is drained until the nil that Stop sends.
+				timer.Stop()
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+				continue
+			}
+		}
+
 		peer.timersAnyAuthenticatedPacketTraversal()
 		peer.timersAnyAuthenticatedPacketSent()
 
@@ -444,7 +527,7 @@ func (peer *Peer) RoutineSequentialSender() {
 		device.PutMessageBuffer(elem.buffer)
 		device.PutOutboundElement(elem)
 		if err != nil {
-			device.log.Errorf("%v - Failed to send data packet: %v", peer, err)
+			device.log.Errorf("%v - Failed to send data packet: %v", peer, device.errorString(err))
 			continue
 		}
 
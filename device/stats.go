@@ -0,0 +1,262 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PeerStats is a snapshot of the statistics of a peer.
+type PeerStats struct {
+	TxBytes       uint64    // bytes sent to the peer
+	RxBytes       uint64    // bytes received from the peer
+	LastHandshake time.Time // zero if no handshake has completed
+
+	// SinceLastHandshake is the time elapsed since LastHandshake, measured
+	// on the monotonic clock, so that it stays correct when the wall clock
+	// is stepped. It is zero if no handshake has completed.
+	SinceLastHandshake time.Duration
+
+	// LastReceive is when the most recent data packet from the peer was
+	// accepted, or zero if none has been. Unlike LastHandshake, it does
+	// not advance for handshakes and keepalives, so it tells a silent
+	// but connected peer from one that is exchanging traffic.
+	LastReceive time.Time
+
+	// LastHandshakeRTT is the time between sending the most recent handshake
+	// initiation that was answered and receiving its response, or zero if
+	// no handshake initiated by us has completed.
+	LastHandshakeRTT time.Duration
+
+	HandshakesInitiated uint64 // handshake initiations sent
+	HandshakesCompleted uint64 // handshakes completed, as initiator or responder
+	SendErrors          uint64 // packets the bind failed to send
+	ReceiveErrors       uint64 // packets that failed decryption or replay checks
+
+	// SendRetried counts the packets that were resent after a transient
+	// send error, and SendRetryDrops those of them that still could not be
+	// sent; see Device.SetSendRetries. Only the latter count as SendErrors.
+	SendRetried    uint64
+	SendRetryDrops uint64
+
+	// RxRateLimited counts the data packets from the peer that were
+	// dropped for exceeding the receive limit set with SetRateLimit.
+	RxRateLimited uint64
+
+	// LastReceiveFamily is the address family (4 or 6) of the endpoint
+	// from which the most recent authenticated packet was received,
+	// or 0 if nothing has been received from the peer.
+	LastReceiveFamily int
+
+	// OutboundQueueLen is the number of packets waiting to be sent to the
+	// peer, and OutboundQueuePeak the largest such number since the peer
+	// was created, out of QueueOutboundSize. A peak persistently near the
+	// capacity means the link cannot keep up and packets will be dropped.
+	OutboundQueueLen  int
+	OutboundQueuePeak int
+}
+
+// Stats returns a snapshot of the statistics of the peer.
+func (peer *Peer) Stats() PeerStats {
+	stats := PeerStats{
+		TxBytes:             atomic.LoadUint64(&peer.stats.txBytes),
+		RxBytes:             atomic.LoadUint64(&peer.stats.rxBytes),
+		HandshakesInitiated: atomic.LoadUint64(&peer.stats.handshakesInitiated),
+		HandshakesCompleted: atomic.LoadUint64(&peer.stats.handshakesCompleted),
+		SendErrors:          atomic.LoadUint64(&peer.stats.sendErrors),
+		ReceiveErrors:       atomic.LoadUint64(&peer.stats.receiveErrors),
+		SendRetried:         atomic.LoadUint64(&peer.stats.sendRetried),
+		SendRetryDrops:      atomic.LoadUint64(&peer.stats.sendRetryDrops),
+		RxRateLimited:       atomic.LoadUint64(&peer.stats.rxRateLimited),
+		LastHandshakeRTT:    time.Duration(atomic.LoadInt64(&peer.stats.handshakeRTTNano)),
+	}
+	stats.OutboundQueueLen, stats.OutboundQueuePeak = peer.OutboundQueueDepth()
+	if nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano); nano != 0 {
+		stats.LastHandshake = time.Unix(0, nano)
+		stats.SinceLastHandshake = time.Duration(monotime() - atomic.LoadInt64(&peer.stats.lastHandshakeMono))
+	}
+	if nano := atomic.LoadInt64(&peer.stats.lastReceiveNano); nano != 0 {
+		stats.LastReceive = time.Unix(0, nano)
+	}
+
+	peer.RLock()
+	from := peer.lastReceivedFrom
+	peer.RUnlock()
+	if from != nil {
+		if from.DstIP().To4() != nil {
+			stats.LastReceiveFamily = 4
+		} else {
+			stats.LastReceiveFamily = 6
+		}
+	}
+	return stats
+}
+
+// AllStats returns a snapshot of the statistics of every peer of the device,
+// keyed by public key, taken in a single pass over the peers.
+// The map belongs to the caller.
+func (device *Device) AllStats() map[NoisePublicKey]PeerStats {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	stats := make(map[NoisePublicKey]PeerStats, len(device.peers.keyMap))
+	for key, peer := range device.peers.keyMap {
+		stats[key] = peer.Stats()
+	}
+	return stats
+}
+
+// OutboundQueueDepth returns the current and the largest number of packets
+// waiting to be sent to the peer. It is cheap enough to poll frequently.
+func (peer *Peer) OutboundQueueDepth() (current, peak int) {
+	return len(peer.queue.outbound.c), int(atomic.LoadUint32(&peer.stats.outboundPeak))
+}
+
+// recordOutboundDepth updates the peak depth of the peer's outbound queue
+// after a packet has been queued. The packet counts towards the depth even
+// if the sequential sender has already taken it off the queue.
+func (peer *Peer) recordOutboundDepth() {
+	depth := uint32(len(peer.queue.outbound.c))
+	if depth == 0 {
+		depth = 1
+	}
+	for {
+		peak := atomic.LoadUint32(&peer.stats.outboundPeak)
+		if depth <= peak || atomic.CompareAndSwapUint32(&peer.stats.outboundPeak, peak, depth) {
+			return
+		}
+	}
+}
+
+// Handshakes returns the number of handshakes the peer has completed,
+// counting each confirmed keypair once. A steadily rising count beyond the
+// regular rekey interval suggests an unstable link or clock problems.
+func (peer *Peer) Handshakes() uint64 {
+	return atomic.LoadUint64(&peer.stats.handshakesCompleted)
+}
+
+// DeviceMetrics is a snapshot of the statistics of a device,
+// summed over its current peers. Counters of removed peers are not included.
+type DeviceMetrics struct {
+	Peers               int    // number of configured peers
+	TxBytes             uint64 // bytes sent to peers
+	RxBytes             uint64 // bytes received from peers
+	HandshakesInitiated uint64 // handshake initiations sent
+	HandshakesCompleted uint64 // handshakes completed
+	SendErrors          uint64 // packets the bind failed to send
+	SendRetried         uint64 // packets resent after a transient send error
+	SendRetryDrops      uint64 // packets still failing after all resends
+	ReceiveErrors       uint64 // packets that failed decryption or replay checks
+	IndexTableSize      int    // handshakes and keypairs currently indexed
+
+	// Drops counts the transport packets received by the device since it
+	// was created that were dropped, by reason.
+	Drops InboundDrops
+}
+
+// InboundDrops counts dropped inbound transport packets by reason.
+type InboundDrops struct {
+	UnknownReceiver  uint64 // no keypair for the receiver index, such as after a restart
+	ExpiredKeypair   uint64 // keypair older than RejectAfterTime
+	Decryption       uint64 // failed authentication
+	Replay           uint64 // counter already seen or too old
+	DisallowedSource uint64 // inner source address outside the peer's allowed IPs
+	Malformed        uint64 // truncated packets and invalid inner IP headers
+	TUNWrite         uint64 // decrypted packets the TUN device failed to accept
+	RateLimited      uint64 // data packets beyond the receive rate limit of their peer
+}
+
+// Metrics returns a snapshot of the statistics of the device.
+func (device *Device) Metrics() DeviceMetrics {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	m := DeviceMetrics{
+		Peers:          len(device.peers.keyMap),
+		IndexTableSize: device.indexTable.Len(),
+		Drops: InboundDrops{
+			UnknownReceiver:  atomic.LoadUint64(&device.drops.UnknownReceiver),
+			ExpiredKeypair:   atomic.LoadUint64(&device.drops.ExpiredKeypair),
+			Decryption:       atomic.LoadUint64(&device.drops.Decryption),
+			Replay:           atomic.LoadUint64(&device.drops.Replay),
+			DisallowedSource: atomic.LoadUint64(&device.drops.DisallowedSource),
+			Malformed:        atomic.LoadUint64(&device.drops.Malformed),
+			TUNWrite:         atomic.LoadUint64(&device.drops.TUNWrite),
+			RateLimited:      atomic.LoadUint64(&device.drops.RateLimited),
+		},
+	}
+	for _, peer := range device.peers.keyMap {
+		m.TxBytes += atomic.LoadUint64(&peer.stats.txBytes)
+		m.RxBytes += atomic.LoadUint64(&peer.stats.rxBytes)
+		m.HandshakesInitiated += atomic.LoadUint64(&peer.stats.handshakesInitiated)
+		m.HandshakesCompleted += atomic.LoadUint64(&peer.stats.handshakesCompleted)
+		m.SendErrors += atomic.LoadUint64(&peer.stats.sendErrors)
+		m.SendRetried += atomic.LoadUint64(&peer.stats.sendRetried)
+		m.SendRetryDrops += atomic.LoadUint64(&peer.stats.sendRetryDrops)
+		m.ReceiveErrors += atomic.LoadUint64(&peer.stats.receiveErrors)
+	}
+	return m
+}
+
+// PeerDiagnostics is a snapshot of the cryptographic state of a peer,
+// meant for troubleshooting. It contains no key material.
+type PeerDiagnostics struct {
+	Current  *KeypairDiagnostics // nil if there is no current keypair
+	Next     *KeypairDiagnostics // nil unless a responder keypair awaits confirmation
+	Previous *KeypairDiagnostics // nil if there is no previous keypair
+
+	HandshakeState    string    // state of the handshake in progress, such as "handshakeInitiationCreated"
+	HandshakeIndex    uint32    // local index of the handshake in progress, 0 if none
+	LastHandshake     time.Time // zero if no handshake has completed
+	HandshakeAttempts uint32    // retransmissions of the current handshake initiation
+}
+
+// KeypairDiagnostics describes one keypair of a peer.
+type KeypairDiagnostics struct {
+	Age         time.Duration // time since the keypair was derived
+	SendNonce   uint64        // counter of the next packet to send
+	LocalIndex  uint32
+	RemoteIndex uint32
+	IsInitiator bool // whether we initiated the handshake that derived it
+}
+
+// Diagnostics returns a snapshot of the keypairs and handshake of the peer.
+func (peer *Peer) Diagnostics() PeerDiagnostics {
+	now := time.Now()
+	describe := func(kp *Keypair) *KeypairDiagnostics {
+		if kp == nil {
+			return nil
+		}
+		return &KeypairDiagnostics{
+			Age:         now.Sub(kp.created),
+			SendNonce:   atomic.LoadUint64(&kp.sendNonce),
+			LocalIndex:  kp.localIndex,
+			RemoteIndex: kp.remoteIndex,
+			IsInitiator: kp.isInitiator,
+		}
+	}
+
+	var diag PeerDiagnostics
+	peer.keypairs.RLock()
+	diag.Current = describe(peer.keypairs.current)
+	diag.Next = describe(peer.keypairs.loadNext())
+	diag.Previous = describe(peer.keypairs.previous)
+	peer.keypairs.RUnlock()
+
+	peer.handshake.mutex.RLock()
+	diag.HandshakeState = peer.handshake.state.String()
+	if peer.handshake.state != handshakeZeroed {
+		diag.HandshakeIndex = peer.handshake.localIndex
+	}
+	peer.handshake.mutex.RUnlock()
+
+	if nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano); nano != 0 {
+		diag.LastHandshake = time.Unix(0, nano)
+	}
+	diag.HandshakeAttempts = atomic.LoadUint32(&peer.timers.handshakeAttempts)
+	return diag
+}
@@ -74,9 +74,65 @@ func (peer *Peer) timersActive() bool {
 	return peer.isRunning.Get() && peer.device != nil && peer.device.isUp()
 }
 
+// initialHandshakeRemaining returns how long peer may keep trying its first
+// handshake before the device's initial handshake timeout, counted from the
+// first initiation it sent, runs out. It reports ok=false if no timeout
+// applies: none is set, peer has completed a handshake before, or it has
+// not sent an initiation yet.
+func (peer *Peer) initialHandshakeRemaining() (remaining time.Duration, ok bool) {
+	timeout := peer.device.initialHandshakeTimeout()
+	if timeout == 0 || atomic.LoadInt64(&peer.stats.lastHandshakeNano) != 0 {
+		return 0, false
+	}
+	first := atomic.LoadInt64(&peer.stats.firstAttemptMono)
+	if first == 0 {
+		return 0, false
+	}
+	return timeout - time.Duration(monotime()-first), true
+}
+
+// initialHandshakeExpired reports whether peer has never completed a handshake
+// and has been trying for at least the device's initial handshake timeout.
+func (peer *Peer) initialHandshakeExpired() bool {
+	remaining, ok := peer.initialHandshakeRemaining()
+	return ok && remaining <= 0
+}
+
+// postponedWhilePaused reports whether the device is paused. If it is,
+// timer is re-armed to fire again after d, so that what it would have sent
+// is sent once the device resumes instead.
+func (peer *Peer) postponedWhilePaused(timer *Timer, d time.Duration) bool {
+	if !peer.device.IsPaused() {
+		return false
+	}
+	if peer.timersActive() {
+		timer.Mod(d)
+	}
+	return true
+}
+
 func expiredRetransmitHandshake(peer *Peer) {
-	if atomic.LoadUint32(&peer.timers.handshakeAttempts) > MaxTimerHandshakes {
-		peer.device.log.Verbosef("%s - Handshake did not complete after %d attempts, giving up", peer, MaxTimerHandshakes+2)
+	if peer.postponedWhilePaused(peer.timers.retransmitHandshake, RekeyTimeout) {
+		return
+	}
+	initialExpired := peer.initialHandshakeExpired()
+	if atomic.LoadUint32(&peer.timers.handshakeAttempts) > MaxTimerHandshakes || initialExpired {
+		if peer.failoverEndpoint() {
+			peer.RLock()
+			endpoint := peer.endpoint
+			peer.RUnlock()
+			peer.device.log.Verbosef("%s - Handshake did not complete, trying next endpoint %s", peer, peer.device.endpointString(endpoint))
+			peer.device.emitEvent(EventHandshakeFailed, peer, "")
+			atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
+			atomic.StoreInt64(&peer.stats.firstAttemptMono, 0)
+			peer.SendHandshakeInitiation(true)
+			return
+		}
+		if initialExpired {
+			peer.device.log.Verbosef("%s - Initial handshake did not complete after %v, giving up", peer, peer.device.initialHandshakeTimeout())
+		} else {
+			peer.device.log.Verbosef("%s - Handshake did not complete after %d attempts, giving up", peer, MaxTimerHandshakes+2)
+		}
 
 		if peer.timersActive() {
 			peer.timers.sendKeepalive.Del()
@@ -93,6 +149,12 @@ func expiredRetransmitHandshake(peer *Peer) {
 		if peer.timersActive() && !peer.timers.zeroKeyMaterial.IsPending() {
 			peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
 		}
+		atomic.StoreInt64(&peer.stats.firstAttemptMono, 0)
+
+		if giveUp := peer.device.handshakeGiveUpCallback(); giveUp != nil {
+			go giveUp(peer)
+		}
+		peer.device.emitEvent(EventHandshakeGaveUp, peer, "")
 	} else {
 		atomic.AddUint32(&peer.timers.handshakeAttempts, 1)
 		peer.device.log.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)", peer, int(RekeyTimeout.Seconds()), atomic.LoadUint32(&peer.timers.handshakeAttempts)+1)
@@ -104,12 +166,18 @@ func expiredRetransmitHandshake(peer *Peer) {
 		}
 		peer.Unlock()
 
+		peer.device.emitEvent(EventHandshakeFailed, peer, "")
 		peer.SendHandshakeInitiation(true)
 	}
 }
 
 func expiredSendKeepalive(peer *Peer) {
-	peer.SendKeepalive()
+	if peer.device.IsPaused() {
+		// Nothing was received while paused, so there is nothing to answer.
+		peer.timers.needAnotherKeepalive.Set(false)
+		return
+	}
+	peer.sendKeepalive()
 	if peer.timers.needAnotherKeepalive.Get() {
 		peer.timers.needAnotherKeepalive.Set(false)
 		if peer.timersActive() {
@@ -119,6 +187,9 @@ func expiredSendKeepalive(peer *Peer) {
 }
 
 func expiredNewHandshake(peer *Peer) {
+	if peer.postponedWhilePaused(peer.timers.newHandshake, RekeyTimeout) {
+		return
+	}
 	peer.device.log.Verbosef("%s - Retrying handshake because we stopped hearing back after %d seconds", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
 	/* We clear the endpoint address src address, in case this is the cause of trouble. */
 	peer.Lock()
@@ -135,9 +206,28 @@ func expiredZeroKeyMaterial(peer *Peer) {
 	peer.ZeroAndFlushAll()
 }
 
+func expiredKeypairExpiring(peer *Peer) {
+	fn := peer.device.keypairExpiringCallback()
+	if fn == nil {
+		return
+	}
+	keypair := peer.keypairs.Current()
+	if keypair == nil {
+		return
+	}
+	remaining := RejectAfterTime - time.Since(keypair.created)
+	if remaining <= 0 {
+		return
+	}
+	go fn(peer, remaining)
+}
+
 func expiredPersistentKeepalive(peer *Peer) {
-	if atomic.LoadUint32(&peer.persistentKeepaliveInterval) > 0 {
-		peer.SendKeepalive()
+	if keepalive := atomic.LoadUint32(&peer.persistentKeepaliveInterval); keepalive > 0 && !peer.manualKeepalive.Get() {
+		if peer.postponedWhilePaused(peer.timers.persistentKeepalive, peer.persistentKeepaliveDelay(keepalive)) {
+			return
+		}
+		peer.sendKeepalive()
 	}
 }
 
@@ -176,18 +266,40 @@ func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
 /* Should be called after a handshake initiation message is sent. */
 func (peer *Peer) timersHandshakeInitiated() {
 	if peer.timersActive() {
-		peer.timers.retransmitHandshake.Mod(RekeyTimeout + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
+		d := RekeyTimeout + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs))
+		// Check back when the initial handshake timeout runs out, so as to
+		// give up on time rather than at the next retransmission.
+		if remaining, ok := peer.initialHandshakeRemaining(); ok && remaining < d {
+			d = remaining
+		}
+		peer.timers.retransmitHandshake.Mod(d)
 	}
 }
 
+// processStart anchors the timestamps returned by monotime.
+var processStart = time.Now()
+
+// monotime returns the nanoseconds elapsed since processStart, read from the
+// monotonic clock, so that differences between such timestamps are not
+// disturbed by steps of the wall clock. Unlike a time.Time, it can be
+// stored atomically.
+func monotime() int64 {
+	return int64(time.Since(processStart))
+}
+
 /* Should be called after a handshake response message is received and processed or when getting key confirmation via the first data message. */
 func (peer *Peer) timersHandshakeComplete() {
 	if peer.timersActive() {
 		peer.timers.retransmitHandshake.Del()
+		peer.timers.keypairExpiring.Mod(RejectAfterTime - KeypairExpiringNotice)
 	}
 	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
+	atomic.StoreUint32(&peer.endpoints.failovers, 0)
 	peer.timers.sentLastMinuteHandshake.Set(false)
+	atomic.StoreInt64(&peer.stats.lastHandshakeMono, monotime())
 	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().UnixNano())
+	atomic.AddUint64(&peer.stats.handshakesCompleted, 1)
+	peer.device.emitEvent(EventHandshakeComplete, peer, "")
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
@@ -200,9 +312,19 @@ func (peer *Peer) timersSessionDerived() {
 /* Should be called before a packet with authentication -- keepalive, data, or handshake -- is sent, or after one is received. */
 func (peer *Peer) timersAnyAuthenticatedPacketTraversal() {
 	keepalive := atomic.LoadUint32(&peer.persistentKeepaliveInterval)
-	if keepalive > 0 && peer.timersActive() {
-		peer.timers.persistentKeepalive.Mod(time.Duration(keepalive) * time.Second)
+	if keepalive > 0 && !peer.manualKeepalive.Get() && peer.timersActive() {
+		peer.timers.persistentKeepalive.Mod(peer.persistentKeepaliveDelay(keepalive))
+	}
+}
+
+// persistentKeepaliveDelay returns the keepalive interval in seconds,
+// shortened by a random amount within the peer's keepalive jitter.
+func (peer *Peer) persistentKeepaliveDelay(keepalive uint32) time.Duration {
+	interval := time.Duration(keepalive) * time.Second
+	if jitter := atomic.LoadUint32(&peer.keepaliveJitter); jitter > 0 {
+		interval -= time.Duration(rand.Int63n(int64(interval)*int64(jitter)/100 + 1))
 	}
+	return interval
 }
 
 func (peer *Peer) timersInit() {
@@ -211,10 +333,12 @@ func (peer *Peer) timersInit() {
 	peer.timers.newHandshake = peer.NewTimer(expiredNewHandshake)
 	peer.timers.zeroKeyMaterial = peer.NewTimer(expiredZeroKeyMaterial)
 	peer.timers.persistentKeepalive = peer.NewTimer(expiredPersistentKeepalive)
+	peer.timers.keypairExpiring = peer.NewTimer(expiredKeypairExpiring)
 }
 
 func (peer *Peer) timersStart() {
 	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
+	atomic.StoreInt64(&peer.stats.firstAttemptMono, 0)
 	peer.timers.sentLastMinuteHandshake.Set(false)
 	peer.timers.needAnotherKeepalive.Set(false)
 }
@@ -225,4 +349,5 @@ func (peer *Peer) timersStop() {
 	peer.timers.newHandshake.DelSync()
 	peer.timers.zeroKeyMaterial.DelSync()
 	peer.timers.persistentKeepalive.DelSync()
+	peer.timers.keypairExpiring.DelSync()
 }
@@ -19,24 +19,7 @@ func (device *Device) RoutineTUNEventReader() {
 
 	for event := range device.tun.device.Events() {
 		if event&tun.EventMTUUpdate != 0 {
-			mtu, err := device.tun.device.MTU()
-			if err != nil {
-				device.log.Errorf("Failed to load updated MTU of device: %v", err)
-				continue
-			}
-			if mtu < 0 {
-				device.log.Errorf("MTU not updated to negative value: %v", mtu)
-				continue
-			}
-			var tooLarge string
-			if mtu > MaxContentSize {
-				tooLarge = fmt.Sprintf(" (too large, capped at %v)", MaxContentSize)
-				mtu = MaxContentSize
-			}
-			old := atomic.SwapInt32(&device.tun.mtu, int32(mtu))
-			if int(old) != mtu {
-				device.log.Verbosef("MTU updated: %v%s", mtu, tooLarge)
-			}
+			device.MTUChanged()
 		}
 
 		if event&tun.EventUp != 0 {
@@ -52,3 +35,37 @@ func (device *Device) RoutineTUNEventReader() {
 
 	device.log.Verbosef("Routine: event worker - stopped")
 }
+
+// MTUChanged makes the device re-read the MTU of its TUN device. The TUN
+// device usually reports changes itself, through tun.EventMTUUpdate, but an
+// embedder that changes the MTU behind the device's back should call it, lest
+// packets be padded beyond the new MTU.
+// Since an MTU change usually follows a change of the underlying network,
+// the path MTUs learned for peers are forgotten as well.
+func (device *Device) MTUChanged() {
+	mtu, err := device.tun.device.MTU()
+	if err != nil {
+		device.log.Errorf("Failed to load updated MTU of device: %v", err)
+		return
+	}
+	if mtu < 0 {
+		device.log.Errorf("MTU not updated to negative value: %v", mtu)
+		return
+	}
+	var tooLarge string
+	if mtu > MaxContentSize {
+		tooLarge = fmt.Sprintf(" (too large, capped at %v)", MaxContentSize)
+		mtu = MaxContentSize
+	}
+	old := atomic.SwapInt32(&device.tun.mtu, int32(mtu))
+	if int(old) == mtu {
+		return
+	}
+	device.log.Verbosef("MTU updated: %v%s", mtu, tooLarge)
+
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		atomic.StoreInt32(&peer.pathMTU, 0)
+	}
+	device.peers.RUnlock()
+}
@@ -18,14 +18,27 @@ import (
 	"sync/atomic"
 	"time"
 
+	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/ipc"
 )
 
 type IPCError struct {
 	code int64 // error code
 	err  error // underlying/wrapped error
+	kind error // one of the ErrIpc values, or nil
 }
 
+// Kinds of invalid configuration reported by IpcSet and IpcSetOperation.
+// The errors they return match one of these with errors.Is, so that tools
+// can tell which part of a configuration was rejected.
+var (
+	ErrIpcUnknownKey       = errors.New("unknown UAPI key")
+	ErrIpcInvalidKey       = errors.New("invalid public, private or preshared key")
+	ErrIpcInvalidEndpoint  = errors.New("invalid endpoint")
+	ErrIpcInvalidAllowedIP = errors.New("invalid allowed IP")
+	ErrIpcInvalidValue     = errors.New("invalid value")
+)
+
 func (s IPCError) Error() string {
 	return fmt.Sprintf("IPC error %d: %v", s.code, s.err)
 }
@@ -38,10 +51,20 @@ func (s IPCError) ErrorCode() int64 {
 	return s.code
 }
 
+// Is reports whether target is the kind of the error, one of the ErrIpc values.
+func (s IPCError) Is(target error) bool {
+	return s.kind != nil && s.kind == target
+}
+
 func ipcErrorf(code int64, msg string, args ...interface{}) *IPCError {
 	return &IPCError{code: code, err: fmt.Errorf(msg, args...)}
 }
 
+// ipcInvalidf returns an IpcErrorInvalid error of the given kind.
+func ipcInvalidf(kind error, msg string, args ...interface{}) *IPCError {
+	return &IPCError{code: ipc.IpcErrorInvalid, err: fmt.Errorf(msg, args...), kind: kind}
+}
+
 var byteBufferPool = &sync.Pool{
 	New: func() interface{} { return new(bytes.Buffer) },
 }
@@ -71,66 +94,79 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 		buf.WriteByte('\n')
 	}
 
-	func() {
+	// send lines (does not require resource locks)
+	flush := func() error {
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
+		}
+		buf.Reset()
+		return nil
+	}
 
-		// lock required resources
+	// lock required resources, for the output to be a consistent snapshot
 
-		device.net.RLock()
-		defer device.net.RUnlock()
+	device.net.RLock()
+	defer device.net.RUnlock()
 
-		device.staticIdentity.RLock()
-		defer device.staticIdentity.RUnlock()
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
 
-		device.peers.RLock()
-		defer device.peers.RUnlock()
+	device.peers.RLock()
+	defer device.peers.RUnlock()
 
-		// serialize device related values
+	// serialize device related values
 
-		if !device.staticIdentity.privateKey.IsZero() {
-			keyf("private_key", (*[32]byte)(&device.staticIdentity.privateKey))
-		}
+	if !device.staticIdentity.privateKey.IsZero() {
+		keyf("private_key", (*[32]byte)(&device.staticIdentity.privateKey))
+	}
 
-		if device.net.port != 0 {
-			sendf("listen_port=%d", device.net.port)
-		}
+	if device.net.port != 0 {
+		sendf("listen_port=%d", device.net.port)
+	}
 
-		if device.net.fwmark != 0 {
-			sendf("fwmark=%d", device.net.fwmark)
-		}
+	if device.net.fwmark != 0 {
+		sendf("fwmark=%d", device.net.fwmark)
+	}
 
-		// serialize each peer state
+	if err := flush(); err != nil {
+		return err
+	}
 
-		for _, peer := range device.peers.keyMap {
-			peer.RLock()
-			defer peer.RUnlock()
+	// serialize each peer state, flushing after each one so that the output
+	// for a device with many peers is never held in memory all at once
 
-			keyf("public_key", (*[32]byte)(&peer.handshake.remoteStatic))
-			keyf("preshared_key", (*[32]byte)(&peer.handshake.presharedKey))
-			sendf("protocol_version=1")
-			if peer.endpoint != nil {
-				sendf("endpoint=%s", peer.endpoint.DstToString())
-			}
+	for _, peer := range device.peers.keyMap {
+		peer.RLock()
+		keyf("public_key", (*[32]byte)(&peer.handshake.remoteStatic))
+		keyf("preshared_key", (*[32]byte)(&peer.handshake.presharedKey))
+		version := peer.protocolVersion
+		if version == 0 {
+			version = CurrentProtocolVersion
+		}
+		sendf("protocol_version=%d", version)
+		if peer.endpoint != nil {
+			sendf("endpoint=%s", peer.endpoint.DstToString())
+		}
 
-			nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
-			secs := nano / time.Second.Nanoseconds()
-			nano %= time.Second.Nanoseconds()
+		nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+		secs := nano / time.Second.Nanoseconds()
+		nano %= time.Second.Nanoseconds()
 
-			sendf("last_handshake_time_sec=%d", secs)
-			sendf("last_handshake_time_nsec=%d", nano)
-			sendf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes))
-			sendf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes))
-			sendf("persistent_keepalive_interval=%d", atomic.LoadUint32(&peer.persistentKeepaliveInterval))
+		sendf("last_handshake_time_sec=%d", secs)
+		sendf("last_handshake_time_nsec=%d", nano)
+		sendf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes))
+		sendf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes))
+		sendf("persistent_keepalive_interval=%d", atomic.LoadUint32(&peer.persistentKeepaliveInterval))
 
-			device.allowedips.EntriesForPeer(peer, func(ip net.IP, cidr uint) bool {
-				sendf("allowed_ip=%s/%d", ip.String(), cidr)
-				return true
-			})
-		}
-	}()
+		device.allowedips.EntriesForPeer(peer, func(ip net.IP, cidr uint) bool {
+			sendf("allowed_ip=%s/%d", ip.String(), cidr)
+			return true
+		})
+		peer.RUnlock()
 
-	// send lines (does not require resource locks)
-	if _, err := w.Write(buf.Bytes()); err != nil {
-		return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
+		if err := flush(); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -139,6 +175,55 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 // IpcSetOperation implements the WireGuard configuration protocol "set" operation.
 // See https://www.wireguard.com/xplatform/#configuration-protocol for details.
 func (device *Device) IpcSetOperation(r io.Reader) (err error) {
+	return device.ipcSetOperation(r, true)
+}
+
+// IpcSetOperationLenient is like IpcSetOperation,
+// but skips unknown keys with a logged warning instead of failing.
+// This allows configurations produced by newer UAPI implementations,
+// which may contain additional keys, to be applied.
+func (device *Device) IpcSetOperationLenient(r io.Reader) (err error) {
+	return device.ipcSetOperation(r, false)
+}
+
+// An unknownKeyError reports a UAPI key that is not recognized.
+type unknownKeyError struct {
+	scope string // "device" or "peer"
+	key   string
+}
+
+func (e *unknownKeyError) Error() string {
+	return fmt.Sprintf("invalid UAPI %s key: %v", e.scope, e.key)
+}
+
+// SetIpcBase64Keys controls whether IPC set operations also accept keys in
+// the base64 format of WireGuard configuration files, which makes it easier
+// to feed them from such files. Hex keys are accepted either way, and the
+// get operation always reports keys in hex, as the protocol requires.
+func (device *Device) SetIpcBase64Keys(enabled bool) {
+	device.ipcBase64Keys.Set(enabled)
+}
+
+// SetRejectPrivilegedPorts controls whether IPC set operations reject a
+// listen_port below MinUnprivilegedPort, other than 0. Binding to such a
+// port requires privileges that an unprivileged process lacks, so this
+// turns a confusing permission error at bind time, or one that only
+// occurs once the device is brought up, into an immediate invalid value
+// error. It is off by default.
+func (device *Device) SetRejectPrivilegedPorts(enabled bool) {
+	device.rejectPrivPort.Set(enabled)
+}
+
+// parseKey decodes a key from the value of a private_key, public_key or
+// preshared_key line into dst.
+func (device *Device) parseKey(dst []byte, value string) error {
+	if device.ipcBase64Keys.Get() {
+		return loadExactKey(dst, value)
+	}
+	return loadExactHex(dst, value)
+}
+
+func (device *Device) ipcSetOperation(r io.Reader, strict bool) (err error) {
 	device.ipcMutex.Lock()
 	defer device.ipcMutex.Unlock()
 
@@ -158,9 +243,10 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 			// Blank line means terminate operation.
 			return nil
 		}
-		parts := strings.Split(line, "=")
+		// Split at the first "=" only, as base64 keys end in "=" padding.
+		parts := strings.SplitN(line, "=", 2)
 		if len(parts) != 2 {
-			return ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q, found %d =-separated parts, want 2", line, len(parts))
+			return ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q, found no =", line)
 		}
 		key := parts[0]
 		value := parts[1]
@@ -184,6 +270,11 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 		} else {
 			err = device.handlePeerLine(peer, key, value)
 		}
+		var unknown *unknownKeyError
+		if !strict && errors.As(err, &unknown) {
+			device.log.Verbosef("UAPI: Ignoring unknown %s key: %v", unknown.scope, unknown.key)
+			continue
+		}
 		if err != nil {
 			return err
 		}
@@ -200,9 +291,12 @@ func (device *Device) handleDeviceLine(key, value string) error {
 	switch key {
 	case "private_key":
 		var sk NoisePrivateKey
-		err := sk.FromMaybeZeroHex(value)
+		err := device.parseKey(sk[:], value)
 		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set private_key: %w", err)
+			return ipcInvalidf(ErrIpcInvalidKey, "failed to set private_key: %w", err)
+		}
+		if !sk.IsZero() {
+			sk.clamp()
 		}
 		device.log.Verbosef("UAPI: Updating private key")
 		device.SetPrivateKey(sk)
@@ -210,7 +304,10 @@ func (device *Device) handleDeviceLine(key, value string) error {
 	case "listen_port":
 		port, err := strconv.ParseUint(value, 10, 16)
 		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse listen_port: %w", err)
+			return ipcInvalidf(ErrIpcInvalidValue, "failed to parse listen_port: %w", err)
+		}
+		if port != 0 && port < MinUnprivilegedPort && device.rejectPrivPort.Get() {
+			return ipcInvalidf(ErrIpcInvalidValue, "listen_port %d is privileged", port)
 		}
 
 		// update port and rebind
@@ -225,9 +322,9 @@ func (device *Device) handleDeviceLine(key, value string) error {
 		}
 
 	case "fwmark":
-		mark, err := strconv.ParseUint(value, 10, 32)
+		mark, err := parseFwmark(value)
 		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "invalid fwmark: %w", err)
+			return ipcInvalidf(ErrIpcInvalidValue, "invalid fwmark: %w", err)
 		}
 
 		device.log.Verbosef("UAPI: Updating fwmark")
@@ -237,13 +334,13 @@ func (device *Device) handleDeviceLine(key, value string) error {
 
 	case "replace_peers":
 		if value != "true" {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set replace_peers, invalid value: %v", value)
+			return ipcInvalidf(ErrIpcInvalidValue, "failed to set replace_peers, invalid value: %v", value)
 		}
 		device.log.Verbosef("UAPI: Removing all peers")
 		device.RemoveAllPeers()
 
 	default:
-		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI device key: %v", key)
+		return &IPCError{code: ipc.IpcErrorInvalid, err: &unknownKeyError{"device", key}, kind: ErrIpcUnknownKey}
 	}
 
 	return nil
@@ -265,9 +362,9 @@ func (peer *ipcSetPeer) handlePostConfig() {
 func (device *Device) handlePublicKeyLine(peer *ipcSetPeer, value string) error {
 	// Load/create the peer we are configuring.
 	var publicKey NoisePublicKey
-	err := publicKey.FromHex(value)
+	err := device.parseKey(publicKey[:], value)
 	if err != nil {
-		return ipcErrorf(ipc.IpcErrorInvalid, "failed to get peer by public key: %w", err)
+		return ipcInvalidf(ErrIpcInvalidKey, "failed to get peer by public key: %w", err)
 	}
 
 	// Ignore peer with the same public key as this device.
@@ -297,7 +394,7 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 	case "update_only":
 		// allow disabling of creation
 		if value != "true" {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set update only, invalid value: %v", value)
+			return ipcInvalidf(ErrIpcInvalidValue, "failed to set update only, invalid value: %v", value)
 		}
 		if peer.created && !peer.dummy {
 			device.RemovePeer(peer.handshake.remoteStatic)
@@ -308,7 +405,7 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 	case "remove":
 		// remove currently selected peer from device
 		if value != "true" {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set remove, invalid value: %v", value)
+			return ipcInvalidf(ErrIpcInvalidValue, "failed to set remove, invalid value: %v", value)
 		}
 		if !peer.dummy {
 			device.log.Verbosef("%v - UAPI: Removing", peer.Peer)
@@ -321,29 +418,45 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		device.log.Verbosef("%v - UAPI: Updating preshared key", peer.Peer)
 
 		peer.handshake.mutex.Lock()
-		err := peer.handshake.presharedKey.FromHex(value)
+		err := device.parseKey(peer.handshake.presharedKey[:], value)
 		peer.handshake.mutex.Unlock()
 
 		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set preshared key: %w", err)
+			return ipcInvalidf(ErrIpcInvalidKey, "failed to set preshared key: %w", err)
 		}
 
 	case "endpoint":
+		// A host awaiting its port can only be set with Peer.SetEndpointHost,
+		// so that a mistyped endpoint does not clear the current one.
+		if _, err := parseEndpointHostOnly(value); err == nil {
+			return ipcInvalidf(ErrIpcInvalidEndpoint, "failed to set endpoint %v: missing port", value)
+		}
 		device.log.Verbosef("%v - UAPI: Updating endpoint", peer.Peer)
-		endpoint, err := device.net.bind.ParseEndpoint(value)
-		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set endpoint %v: %w", value, err)
+		// A comma-separated list of endpoints sets the candidates.
+		var endpoints []conn.Endpoint
+		for _, s := range strings.Split(value, ",") {
+			endpoint, err := device.net.bind.ParseEndpoint(s)
+			if err == nil && !device.endpointAllowed(endpoint) {
+				err = ErrEndpointNotAllowed
+			}
+			if err != nil {
+				return ipcInvalidf(ErrIpcInvalidEndpoint, "failed to set endpoint %v: %w", value, err)
+			}
+			endpoints = append(endpoints, endpoint)
 		}
-		peer.Lock()
-		defer peer.Unlock()
-		peer.endpoint = endpoint
+		peer.SetEndpoints(endpoints)
 
 	case "persistent_keepalive_interval":
-		device.log.Verbosef("%v - UAPI: Updating persistent keepalive interval", peer.Peer)
-
+		// An interval of 0 explicitly disables persistent keepalives,
+		// whereas omitting the key leaves the current interval unchanged.
 		secs, err := strconv.ParseUint(value, 10, 16)
 		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set persistent keepalive interval: %w", err)
+			return ipcInvalidf(ErrIpcInvalidValue, "failed to set persistent keepalive interval: %w", err)
+		}
+		if secs == 0 {
+			device.log.Verbosef("%v - UAPI: Disabling persistent keepalive", peer.Peer)
+		} else {
+			device.log.Verbosef("%v - UAPI: Updating persistent keepalive interval", peer.Peer)
 		}
 
 		old := atomic.SwapUint32(&peer.persistentKeepaliveInterval, uint32(secs))
@@ -354,14 +467,14 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 				return ipcErrorf(ipc.IpcErrorIO, "failed to get tun device status: %w", err)
 			}
 			if device.isUp() && !peer.dummy {
-				peer.SendKeepalive()
+				peer.sendKeepalive()
 			}
 		}
 
 	case "replace_allowed_ips":
 		device.log.Verbosef("%v - UAPI: Removing all allowedips", peer.Peer)
 		if value != "true" {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to replace allowedips, invalid value: %v", value)
+			return ipcInvalidf(ErrIpcInvalidValue, "failed to replace allowedips, invalid value: %v", value)
 		}
 		if peer.dummy {
 			return nil
@@ -373,7 +486,7 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 
 		_, network, err := net.ParseCIDR(value)
 		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set allowed ip: %w", err)
+			return ipcInvalidf(ErrIpcInvalidAllowedIP, "failed to set allowed ip: %w", err)
 		}
 		if peer.dummy {
 			return nil
@@ -382,17 +495,46 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		device.allowedips.Insert(network.IP, uint(ones), peer.Peer)
 
 	case "protocol_version":
-		if value != "1" {
-			return ipcErrorf(ipc.IpcErrorInvalid, "invalid protocol version: %v", value)
+		if value != strconv.Itoa(CurrentProtocolVersion) {
+			return ipcInvalidf(ErrIpcInvalidValue, "invalid protocol version: %v", value)
+		}
+		if peer.dummy {
+			return nil
 		}
+		peer.Lock()
+		peer.protocolVersion = CurrentProtocolVersion
+		peer.Unlock()
 
 	default:
-		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI peer key: %v", key)
+		return &IPCError{code: ipc.IpcErrorInvalid, err: &unknownKeyError{"peer", key}, kind: ErrIpcUnknownKey}
 	}
 
 	return nil
 }
 
+// parseFwmark parses a fwmark in decimal or, with a 0x prefix, in hexadecimal,
+// as firewall tools commonly print them. A leading 0 is not treated as octal.
+func parseFwmark(s string) (uint64, error) {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		return strconv.ParseUint(s[2:], 16, 32)
+	}
+	return strconv.ParseUint(s, 10, 32)
+}
+
+// parseEndpointHostOnly parses an endpoint that consists of an IP address
+// without a port, such as "192.0.2.1" or "[2001:db8::1]".
+func parseEndpointHostOnly(s string) (net.IP, error) {
+	host := s
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid endpoint host: %q", s)
+	}
+	return ip, nil
+}
+
 func (device *Device) IpcGet() (string, error) {
 	buf := new(strings.Builder)
 	if err := device.IpcGetOperation(buf); err != nil {
@@ -0,0 +1,54 @@
+// +build go1.18
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+// FuzzIpcSetOperation feeds arbitrary input to the UAPI parser, which must
+// reject what it cannot parse without panicking. Run it with
+//
+//	go test -fuzz=FuzzIpcSetOperation ./device
+func FuzzIpcSetOperation(f *testing.F) {
+	f.Add([]byte(uapiCfg(
+		"private_key", "a8dcb9a2f6c6b2d5e8b1bd5d38d1b2bd7d7c8c1f8b6f2e4a5b7c9d1e3f5a7b49",
+		"listen_port", "51820",
+		"fwmark", "0x20",
+		"replace_peers", "true",
+		"public_key", "ad8f5d4a22bd33f4e4f2e4ba10a56fa4d5f5f6cdd5a22a8cd6e6b1f1c2a3e4f5",
+		"preshared_key", "0000000000000000000000000000000000000000000000000000000000000000",
+		"endpoint", "127.0.0.1:1,[::1]:2",
+		"persistent_keepalive_interval", "25",
+		"replace_allowed_ips", "true",
+		"allowed_ip", "10.0.0.0/8",
+		"allowed_ip", "fd00::/64",
+		"protocol_version", "1",
+		"public_key", "bd8f5d4a22bd33f4e4f2e4ba10a56fa4d5f5f6cdd5a22a8cd6e6b1f1c2a3e4f5",
+		"update_only", "true",
+		"endpoint", "192.0.2.1",
+		"remove", "true",
+	)))
+	f.Add([]byte("public_key=\nendpoint=[::1\n"))
+	f.Add([]byte("listen_port=65536\nfwmark=0x\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// The device stays down, so the bind parses endpoints but never opens.
+		dev := NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewStdNetBind(), NewLogger(LogLevelSilent, ""))
+		defer dev.Close()
+		dev.IpcSetOperation(bytes.NewReader(data))
+		dev.IpcSetOperationLenient(bytes.NewReader(data))
+		if _, err := dev.IpcGet(); err != nil {
+			t.Errorf("IpcGet after IpcSet: %v", err)
+		}
+	})
+}
@@ -0,0 +1,350 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestParseEndpointHostOnly(t *testing.T) {
+	tests := []struct {
+		in   string
+		want net.IP
+	}{
+		{"192.0.2.1", net.ParseIP("192.0.2.1")},
+		{"[2001:db8::1]", net.ParseIP("2001:db8::1")},
+		{"2001:db8::1", net.ParseIP("2001:db8::1")},
+		{"192.0.2.1:51820", nil},
+		{"[2001:db8::1]:51820", nil},
+		{"example.com", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseEndpointHostOnly(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseEndpointHostOnly(%q) = %v; want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseEndpointHostOnly(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestIpcSetLenient(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	cfg := uapiCfg(
+		"private_key", "a8dcb9a2f6c6b2d5e8b1bd5d38d1b2bd7d7c8c1f8b6f2e4a5b7c9d1e3f5a7b49",
+		"future_device_key", "1",
+		"public_key", "ad8f5d4a22bd33f4e4f2e4ba10a56fa4d5f5f6cdd5a22a8cd6e6b1f1c2a3e4f5",
+		"future_peer_key", "1",
+		"persistent_keepalive_interval", "25",
+	)
+	if err := dev.IpcSet(cfg); err == nil {
+		t.Errorf("strict IpcSet accepted unknown keys")
+	}
+	if err := dev.IpcSetOperationLenient(strings.NewReader(cfg)); err != nil {
+		t.Fatalf("lenient IpcSet failed: %v", err)
+	}
+	if dev.Config().PrivateKey.IsZero() {
+		t.Errorf("private key not applied before unknown key")
+	}
+	peers := dev.Config().Peers
+	if len(peers) != 1 || peers[0].PersistentKeepalive != 25 {
+		t.Errorf("peer config not applied after unknown key: %+v", peers)
+	}
+}
+
+func TestParseFwmark(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"4660", 4660, true},
+		{"010", 10, true},
+		{"0x1234", 0x1234, true},
+		{"0XfFfF", 0xffff, true},
+		{"0xffffffff", 0xffffffff, true},
+		{"4294967295", 0xffffffff, true},
+		{"0x100000000", 0, false},
+		{"4294967296", 0, false},
+		{"0x", 0, false},
+		{"-1", 0, false},
+		{"0x-1", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseFwmark(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("parseFwmark(%q) = %#x, %v; want %#x, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// countingWriter records each Write and fails once limit writes have been made.
+type countingWriter struct {
+	strings.Builder
+	writes int
+	limit  int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && w.writes >= w.limit {
+		return 0, errors.New("write limit reached")
+	}
+	w.writes++
+	return w.Builder.Write(p)
+}
+
+func TestIpcGetStreamsPeers(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	const numPeers = 3
+	for i := 0; i < numPeers; i++ {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dev.NewPeer(sk.publicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := new(countingWriter)
+	if err := dev.IpcGetOperation(w); err != nil {
+		t.Fatal(err)
+	}
+	if w.writes != 1+numPeers {
+		t.Errorf("output written in %d writes; want %d", w.writes, 1+numPeers)
+	}
+	if got := strings.Count(w.String(), "public_key="); got != numPeers {
+		t.Errorf("output has %d peers; want %d", got, numPeers)
+	}
+
+	w = &countingWriter{limit: 2}
+	err := dev.IpcGetOperation(w)
+	var ipcErr *IPCError
+	if !errors.As(err, &ipcErr) || ipcErr.ErrorCode() != ipc.IpcErrorIO {
+		t.Errorf("failing writer: got %v; want an IO error", err)
+	}
+}
+
+// hookWriter calls hook before each Write.
+type hookWriter struct {
+	strings.Builder
+	hook func()
+}
+
+func (w *hookWriter) Write(p []byte) (int, error) {
+	w.hook()
+	return w.Builder.Write(p)
+}
+
+func TestIpcGetConcurrentRemovePeer(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	const numPeers = 3
+	var removed NoisePublicKey
+	for i := 0; i < numPeers; i++ {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		removed = sk.publicKey()
+		if _, err := dev.NewPeer(removed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Remove a peer as soon as the device section has been written.
+	done := make(chan struct{})
+	started := false
+	w := &hookWriter{}
+	w.hook = func() {
+		if !started {
+			started = true
+			go func() {
+				dev.RemovePeer(removed)
+				close(done)
+			}()
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+		select {
+		case <-done:
+			t.Errorf("peer removed while IpcGet was writing peers")
+		default:
+		}
+	}
+	if err := dev.IpcGetOperation(w); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if got := strings.Count(w.String(), "public_key="); got != numPeers {
+		t.Errorf("output has %d peers; want the %d present when it started", got, numPeers)
+	}
+
+	out, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(out, "public_key="); got != numPeers-1 {
+		t.Errorf("output has %d peers after removal; want %d", got, numPeers-1)
+	}
+	if strings.Contains(out, hex.EncodeToString(removed[:])) {
+		t.Errorf("removed peer still in output")
+	}
+}
+
+func TestIpcSetErrorKinds(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	const pk = "ad8f5d4a22bd33f4e4f2e4ba10a56fa4d5f5f6cdd5a22a8cd6e6b1f1c2a3e4f5"
+	tests := []struct {
+		cfg  string
+		want error
+	}{
+		{uapiCfg("bogus", "1"), ErrIpcUnknownKey},
+		{uapiCfg("public_key", pk, "bogus", "1"), ErrIpcUnknownKey},
+		{uapiCfg("private_key", "zz"), ErrIpcInvalidKey},
+		{uapiCfg("public_key", "zz"), ErrIpcInvalidKey},
+		{uapiCfg("public_key", pk, "preshared_key", "zz"), ErrIpcInvalidKey},
+		{uapiCfg("public_key", pk, "endpoint", "192.0.2.1:bogus"), ErrIpcInvalidEndpoint},
+		{uapiCfg("public_key", pk, "endpoint", "192.0.2.1"), ErrIpcInvalidEndpoint},
+		{uapiCfg("public_key", pk, "allowed_ip", "10.0.0.0/33"), ErrIpcInvalidAllowedIP},
+		{uapiCfg("listen_port", "70000"), ErrIpcInvalidValue},
+		{uapiCfg("public_key", pk, "persistent_keepalive_interval", "-1"), ErrIpcInvalidValue},
+	}
+	for _, tt := range tests {
+		err := dev.IpcSet(tt.cfg)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("IpcSet(%q) = %v; want %v", tt.cfg, err, tt.want)
+		}
+		if err != nil && !strings.HasPrefix(err.Error(), "IPC error ") {
+			t.Errorf("IpcSet(%q) error text changed: %v", tt.cfg, err)
+		}
+	}
+
+	// An endpoint without a port leaves the current one in place.
+	if err := dev.IpcSet(uapiCfg("public_key", pk, "endpoint", "192.0.2.1:51820")); err != nil {
+		t.Fatal(err)
+	}
+	dev.IpcSet(uapiCfg("public_key", pk, "endpoint", "192.0.2.2"))
+	if peers := dev.Config().Peers; len(peers) != 1 || peers[0].Endpoint != "192.0.2.1:51820" {
+		t.Errorf("after endpoint without port, peers = %+v; want endpoint 192.0.2.1:51820", peers)
+	}
+}
+
+func TestIpcSetBase64Keys(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := peerKey.publicKey()
+	pkText, _ := pk.MarshalText()
+	skText, _ := sk.MarshalText()
+	psk := NoisePresharedKey{1, 2, 3}
+	pskText, _ := psk.MarshalText()
+	cfg := uapiCfg(
+		"private_key", string(skText),
+		"public_key", string(pkText),
+		"preshared_key", string(pskText),
+	)
+
+	if err := dev.IpcSet(cfg); !errors.Is(err, ErrIpcInvalidKey) {
+		t.Errorf("base64 keys without SetIpcBase64Keys: err = %v; want ErrIpcInvalidKey", err)
+	}
+	dev.SetIpcBase64Keys(true)
+	if err := dev.IpcSet(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.Config().PrivateKey.Equals(sk) {
+		t.Errorf("base64 private key not applied")
+	}
+	peer := dev.LookupPeer(pk)
+	if peer == nil {
+		t.Fatal("peer with base64 public key not created")
+	}
+	if got := peer.config().PresharedKey; got != psk {
+		t.Errorf("base64 preshared key not applied")
+	}
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]), "persistent_keepalive_interval", "25")); err != nil {
+		t.Errorf("hex public key rejected with SetIpcBase64Keys: %v", err)
+	}
+	if err := dev.IpcSet(uapiCfg("public_key", string(pkText[:43]))); !errors.Is(err, ErrIpcInvalidKey) {
+		t.Errorf("truncated base64 key: err = %v; want ErrIpcInvalidKey", err)
+	}
+}
+
+func TestIpcSetRejectPrivilegedPorts(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	dev.SetRejectPrivilegedPorts(true)
+	if err := dev.IpcSet(uapiCfg("listen_port", "443")); !errors.Is(err, ErrIpcInvalidValue) {
+		t.Errorf("privileged port: err = %v; want ErrIpcInvalidValue", err)
+	}
+	for _, port := range []string{"0", "1024"} {
+		if err := dev.IpcSet(uapiCfg("listen_port", port)); err != nil {
+			t.Errorf("listen_port %s rejected: %v", port, err)
+		}
+	}
+}
+
+func TestIpcSetPersistentKeepalive(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	const pub = "ad8f5d4a22bd33f4e4f2e4ba10a56fa4d5f5f6cdd5a22a8cd6e6b1f1c2a3e4f5"
+
+	keepalive := func() uint16 {
+		peers := dev.Config().Peers
+		if len(peers) != 1 {
+			t.Fatalf("%d peers configured; want 1", len(peers))
+		}
+		return peers[0].PersistentKeepalive
+	}
+	if err := dev.IpcSet(uapiCfg("public_key", pub, "persistent_keepalive_interval", "25")); err != nil {
+		t.Fatal(err)
+	}
+	if got := keepalive(); got != 25 {
+		t.Fatalf("persistent keepalive = %d; want 25", got)
+	}
+
+	// Omitting the key leaves the interval alone.
+	if err := dev.IpcSet(uapiCfg("public_key", pub, "allowed_ip", "10.0.0.1/32")); err != nil {
+		t.Fatal(err)
+	}
+	if got := keepalive(); got != 25 {
+		t.Errorf("persistent keepalive = %d after a set without the key; want 25", got)
+	}
+
+	// An explicit 0 disables it.
+	if err := dev.IpcSet(uapiCfg("public_key", pub, "persistent_keepalive_interval", "0")); err != nil {
+		t.Fatal(err)
+	}
+	if got := keepalive(); got != 0 {
+		t.Errorf("persistent keepalive = %d after setting 0; want disabled", got)
+	}
+}
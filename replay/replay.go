@@ -6,6 +6,8 @@
 // Package replay implements an efficient anti-replay algorithm as specified in RFC 6479.
 package replay
 
+import "fmt"
+
 type block uint64
 
 const (
@@ -13,23 +15,77 @@ const (
 	blockBits   = 1 << blockBitLog // must be power of 2
 	ringBlocks  = 1 << 7           // must be power of 2
 	windowSize  = (ringBlocks - 1) * blockBits
-	blockMask   = ringBlocks - 1
 	bitMask     = blockBits - 1
 )
 
+// Ring sizes, in counters, accepted by Filter.Init. A filter with a ring
+// of n counters accepts messages up to n-64 counters behind the newest.
+const (
+	DefaultRingSize = ringBlocks * blockBits
+	MinRingSize     = 2 * blockBits
+	MaxRingSize     = 1 << 20
+)
+
 // A Filter rejects replayed messages by checking if message counter value is
 // within a sliding window of previously received messages.
-// The zero value for Filter is an empty filter ready to use.
+// The zero value for Filter is an empty filter ready to use,
+// with a ring of DefaultRingSize counters.
 // Filters are unsafe for concurrent use.
 type Filter struct {
 	last uint64
-	ring [ringBlocks]block
+	ring []block // allocated on first use if Init was not called
+}
+
+// CheckRingSize reports an error if size is not a ring size accepted by
+// Filter.Init, that is a power of two between MinRingSize and MaxRingSize.
+func CheckRingSize(size int) error {
+	if size < MinRingSize || size > MaxRingSize || size&(size-1) != 0 {
+		return fmt.Errorf("replay ring size %d is not a power of two between %d and %d", size, MinRingSize, MaxRingSize)
+	}
+	return nil
+}
+
+// Init resets the filter to empty state with a ring of size counters.
+// It fails if CheckRingSize rejects size.
+func (f *Filter) Init(size int) error {
+	if err := CheckRingSize(size); err != nil {
+		return err
+	}
+	f.last = 0
+	f.ring = make([]block, size/blockBits)
+	return nil
 }
 
 // Reset resets the filter to empty state.
 func (f *Filter) Reset() {
 	f.last = 0
-	f.ring[0] = 0
+	if f.ring != nil {
+		f.ring[0] = 0
+	}
+}
+
+// Restore sets the filter to the state it would have after accepting every
+// counter below next, so that all of them are rejected from now on while
+// counters from next onwards are accepted once. It keeps the ring size.
+// Restore is used to carry a filter's state across to a new Filter, for
+// which next is one more than the highest counter accepted by the old one.
+func (f *Filter) Restore(next uint64) {
+	if f.ring == nil {
+		f.ring = make([]block, ringBlocks)
+	}
+	if next == 0 {
+		f.last = 0
+		for i := range f.ring {
+			f.ring[i] = 0
+		}
+		return
+	}
+	f.last = next - 1
+	for i := range f.ring {
+		f.ring[i] = ^block(0)
+	}
+	// counters after last in its own block have not been seen
+	f.ring[(f.last>>blockBitLog)&uint64(len(f.ring)-1)] = ^block(0) >> (bitMask - f.last&bitMask)
 }
 
 // ValidateCounter checks if the counter should be accepted.
@@ -38,18 +94,23 @@ func (f *Filter) ValidateCounter(counter uint64, limit uint64) bool {
 	if counter >= limit {
 		return false
 	}
+	if f.ring == nil {
+		f.ring = make([]block, ringBlocks)
+	}
+	blocks := uint64(len(f.ring))
+	blockMask := blocks - 1
 	indexBlock := counter >> blockBitLog
 	if counter > f.last { // move window forward
 		current := f.last >> blockBitLog
 		diff := indexBlock - current
-		if diff > ringBlocks {
-			diff = ringBlocks // cap diff to clear the whole ring
+		if diff > blocks {
+			diff = blocks // cap diff to clear the whole ring
 		}
 		for i := current + 1; i <= current+diff; i++ {
 			f.ring[i&blockMask] = 0
 		}
 		f.last = counter
-	} else if f.last-counter > windowSize { // behind current window
+	} else if f.last-counter > (blocks-1)*blockBits { // behind current window
 		return false
 	}
 	// check and set bit
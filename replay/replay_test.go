@@ -117,3 +117,47 @@ func TestReplay(t *testing.T) {
 	T(0, true)
 	T(windowSize+1, true)
 }
+
+func TestReplayRingSize(t *testing.T) {
+	var filter Filter
+	for _, size := range []int{0, MinRingSize - 1, MinRingSize + 1, 3 * MinRingSize, MaxRingSize * 2} {
+		if err := filter.Init(size); err == nil {
+			t.Errorf("Init(%d) succeeded", size)
+		}
+	}
+	for _, size := range []int{MinRingSize, DefaultRingSize, MaxRingSize} {
+		if err := filter.Init(size); err != nil {
+			t.Fatalf("Init(%d): %v", size, err)
+		}
+		window := uint64(size - blockBits)
+		if !filter.ValidateCounter(window+1, RejectAfterMessages) {
+			t.Errorf("size %d: newest counter rejected", size)
+		}
+		if !filter.ValidateCounter(1, RejectAfterMessages) {
+			t.Errorf("size %d: counter at the edge of the window rejected", size)
+		}
+		if filter.ValidateCounter(0, RejectAfterMessages) {
+			t.Errorf("size %d: counter behind the window accepted", size)
+		}
+		if filter.ValidateCounter(1, RejectAfterMessages) {
+			t.Errorf("size %d: replayed counter accepted", size)
+		}
+	}
+}
+
+func TestReplayRestore(t *testing.T) {
+	for _, next := range []uint64{0, 1, 63, 64, 65, 1000, windowSize + 7} {
+		var filter Filter
+		filter.Restore(next)
+		for counter := uint64(0); counter < next; counter++ {
+			if filter.ValidateCounter(counter, RejectAfterMessages) {
+				t.Errorf("next %d: counter %d accepted", next, counter)
+			}
+		}
+		for counter := next; counter < next+2*blockBits; counter++ {
+			if !filter.ValidateCounter(counter, RejectAfterMessages) {
+				t.Errorf("next %d: counter %d rejected", next, counter)
+			}
+		}
+	}
+}
@@ -8,26 +8,73 @@ package tai64n
 import (
 	"bytes"
 	"encoding/binary"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const TimestampSize = 12
 const base = uint64(0x400000000000000a)
-const whitenerMask = uint32(0x1000000 - 1)
+
+// DefaultGranularity is the default granularity of Now, 2^24 ns or about
+// 16.8 ms.
+const DefaultGranularity = 0x1000000 * time.Nanosecond
+
+var (
+	granularity = int64(DefaultGranularity) // accessed atomically
+
+	last struct {
+		sync.Mutex
+		ts Timestamp // most recent timestamp returned by Now
+	}
+)
+
+// SetGranularity sets the precision to which Now whitens timestamps, so that
+// they do not leak fine-grained information about the local clock. A peer
+// accepts a handshake initiation only if its timestamp is after that of the
+// previous one, so no more than one handshake per granularity can be
+// initiated. Granularities below a second are applied within each second,
+// and larger ones are rounded down to whole seconds. A granularity that is
+// not positive disables whitening. It is safe to call concurrently with Now.
+func SetGranularity(d time.Duration) {
+	atomic.StoreInt64(&granularity, int64(d))
+}
+
+// Granularity returns the granularity set by SetGranularity.
+func Granularity() time.Duration {
+	return time.Duration(atomic.LoadInt64(&granularity))
+}
 
 type Timestamp [TimestampSize]byte
 
-func stamp(t time.Time) Timestamp {
+func stamp(t time.Time, granularity time.Duration) Timestamp {
 	var tai64n Timestamp
-	secs := base + uint64(t.Unix())
-	nano := uint32(t.Nanosecond()) &^ whitenerMask
-	binary.BigEndian.PutUint64(tai64n[:], secs)
+	secs := uint64(t.Unix())
+	nano := uint32(t.Nanosecond())
+	if granularity >= time.Second {
+		secs -= secs % uint64(granularity/time.Second)
+		nano = 0
+	} else if granularity > 0 {
+		nano -= nano % uint32(granularity)
+	}
+	binary.BigEndian.PutUint64(tai64n[:], base+secs)
 	binary.BigEndian.PutUint32(tai64n[8:], nano)
 	return tai64n
 }
 
+// Now returns the current time, whitened to the granularity. It never
+// returns a timestamp before one it returned already, even if the clock
+// steps back or the granularity grows coarser; it repeats the latest one
+// instead.
 func Now() Timestamp {
-	return stamp(time.Now())
+	ts := stamp(time.Now(), Granularity())
+	last.Lock()
+	defer last.Unlock()
+	if last.ts.After(ts) {
+		return last.ts
+	}
+	last.ts = ts
+	return ts
 }
 
 func (t1 Timestamp) After(t2 Timestamp) bool {
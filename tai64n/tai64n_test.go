@@ -30,11 +30,85 @@ func TestMonotonic(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ts1, ts2 := stamp(tt.t1), stamp(tt.t2)
+			ts1, ts2 := stamp(tt.t1, DefaultGranularity), stamp(tt.t2, DefaultGranularity)
 			got := ts2.After(ts1)
 			if got != tt.wantAfter {
 				t.Errorf("after = %v; want %v", got, tt.wantAfter)
 			}
 		})
 	}
+
+	// Other granularities are just as monotonic and whiten accordingly.
+	for _, granularity := range []time.Duration{
+		0,
+		time.Millisecond,
+		DefaultGranularity,
+		100 * time.Millisecond,
+		time.Second,
+		10 * time.Second,
+	} {
+		t.Run(granularity.String(), func(t *testing.T) {
+			// Step through several granules, in increments that do not
+			// divide the granularity.
+			step := granularity/7 + 1
+			start := time.Unix(1600000000, 123456789)
+			prev := stamp(start, granularity)
+			var changes int
+			for d := step; d < 5*granularity; d += step {
+				ts := stamp(start.Add(d), granularity)
+				if prev.After(ts) {
+					t.Fatalf("timestamp went backwards after %v", d)
+				}
+				if ts.After(prev) {
+					changes++
+				}
+				prev = ts
+			}
+			if granularity > 0 && (changes < 4 || changes > 6) {
+				t.Errorf("timestamp changed %d times over 5 granules", changes)
+			}
+
+			// Within a granule, timestamps are indistinguishable.
+			if granularity > 1 {
+				t1 := time.Unix(1600000000, 0)
+				if granularity < time.Second {
+					t1 = t1.Add(granularity)
+				} else {
+					t1 = time.Unix(1600000000-1600000000%int64(granularity/time.Second), 0)
+				}
+				t2 := t1.Add(granularity - 1)
+				if stamp(t1, granularity) != stamp(t2, granularity) {
+					t.Errorf("%v and %v have different timestamps", t1, t2)
+				}
+				if !stamp(t2.Add(1), granularity).After(stamp(t2, granularity)) {
+					t.Errorf("timestamp did not advance at the end of the granule")
+				}
+			}
+		})
+	}
+}
+
+func TestNowNeverGoesBackwards(t *testing.T) {
+	defer SetGranularity(DefaultGranularity)
+
+	SetGranularity(time.Millisecond)
+	fine := Now()
+	SetGranularity(10 * time.Second)
+	if coarse := Now(); fine.After(coarse) {
+		t.Errorf("timestamp went backwards when the granularity grew coarser")
+	}
+
+	// As if the clock had stepped back by an hour.
+	last.Lock()
+	future := stamp(time.Now().Add(time.Hour), time.Millisecond)
+	defer func(ts Timestamp) {
+		last.Lock()
+		last.ts = ts
+		last.Unlock()
+	}(last.ts)
+	last.ts = future
+	last.Unlock()
+	if got := Now(); got != future {
+		t.Errorf("Now = %v after the clock stepped back; want %v", got, future)
+	}
 }
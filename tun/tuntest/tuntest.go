@@ -79,6 +79,11 @@ func genICMPv4(payload []byte, dst, src net.IP) []byte {
 	return pkt
 }
 
+// A ChannelTUN is an in-memory tun.Device backed by channels.
+// Packets written to Outbound are read by the device as if they were
+// sent by the host, and packets the device writes are delivered on Inbound.
+// Combined with bindtest.NewChannelBinds, it allows a pair of devices
+// to be exercised end-to-end without any real network interfaces.
 type ChannelTUN struct {
 	Inbound  chan []byte // incoming packets, closed on TUN close
 	Outbound chan []byte // outbound packets, blocks forever on TUN close